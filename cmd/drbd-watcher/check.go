@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+)
+
+// checkCmd implements "drbd-watcher check", a Nagios or Icinga plugin.
+// It prints one line and exits with the plugin state.
+func checkCmd(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	source := fs.String("source", string(drbd.SourceProcDRBD), "Where to read DRBD state from: proc, drbdsetup, or netlink")
+	lenient := fs.Bool("lenient", false, "Skip lines in /proc/drbd that can't be parsed")
+	_ = fs.String("config", "", "JSON configuration file, for -source, -lenient, min_replicas, and expected")
+	disconnected := fs.String("disconnected", "critical", "State when a peer is not connected or quorum is lost")
+	notUpToDate := fs.String("not-up-to-date", "warning", "State when a disk, here or on a peer, is not UpToDate")
+	roleMismatch := fs.String("role-mismatch", "critical", "State when a resource doesn't have its -role")
+	roles := fs.String("role", "", "Comma separated expected roles (eg r0=Primary,r1=Secondary)")
+	fewReplicas := fs.String("few-replicas", "critical", "State when a resource has fewer UpToDate replicas than its min_replicas")
+	drifted := fs.String("drifted", "warning", "State when a resource isn't in, or is missing from, its expected state")
+	speedWarning := fs.Int64("sync-speed-warning", 0, "Warn when a resync is slower than this many KiB/s")
+	speedCritical := fs.Int64("sync-speed-critical", 0, "Critical when a resync is slower than this many KiB/s")
+	oosWarning := fs.Int64("oos-warning", 0, "Warn when more than this many KiB are out of sync")
+	oosCritical := fs.Int64("oos-critical", 0, "Critical when more than this many KiB are out of sync")
+	sample := fs.Duration("sample", 0, "Read the state twice, this far apart, to measure resync speed when the source doesn't report it")
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "check", "[flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	unknown := func(err error) {
+		fmt.Println(drbd.CheckResult{Level: drbd.CheckUnknown, Messages: []string{err.Error()}})
+		os.Exit(int(drbd.CheckUnknown))
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(int(drbd.CheckUnknown))
+	}
+	config, err := resolveFlags(fs)
+	if err != nil {
+		unknown(err)
+	}
+	t := drbd.Thresholds{
+		SyncSpeedWarning:  *speedWarning,
+		SyncSpeedCritical: *speedCritical,
+		OutOfSyncWarning:  *oosWarning,
+		OutOfSyncCritical: *oosCritical,
+		Roles:             make(map[string]string),
+	}
+	for _, level := range []struct {
+		into *drbd.CheckLevel
+		flag string
+	}{
+		{&t.Disconnected, *disconnected},
+		{&t.NotUpToDate, *notUpToDate},
+		{&t.RoleMismatch, *roleMismatch},
+		{&t.FewReplicas, *fewReplicas},
+		{&t.Drifted, *drifted},
+	} {
+		var err error
+		*level.into, err = drbd.ParseCheckLevel(level.flag)
+		if err != nil {
+			unknown(err)
+		}
+	}
+	if *roles != "" {
+		for _, r := range strings.Split(*roles, ",") {
+			kv := strings.SplitN(r, "=", 2)
+			if len(kv) != 2 {
+				unknown(fmt.Errorf("-role %s is not resource=role", r))
+			}
+			t.Roles[kv[0]] = kv[1]
+		}
+	}
+
+	opts := drbd.Options{
+		Source:  drbd.Source(*source),
+		Lenient: *lenient,
+	}
+	err = config.Apply(&opts)
+	if err != nil {
+		unknown(err)
+	}
+	t.MinReplicas = opts.MinReplicas
+	t.Expected = opts.Expected
+	statuses, err := opts.Status()
+	if err != nil {
+		unknown(err)
+	}
+	if *sample > 0 {
+		before := statuses
+		time.Sleep(*sample)
+		statuses, err = opts.Status()
+		if err != nil {
+			unknown(err)
+		}
+		drbd.MeasureSyncSpeed(before, statuses, *sample)
+	}
+	r := drbd.Check(statuses, t)
+	fmt.Println(r)
+	os.Exit(int(r.Level))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+)
+
+// history implements "drbd-watcher history"
+func history(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	journal := fs.String("journal", "", "Journal file written by the watcher's -journal flag")
+	resources := fs.String("resource", "", "Comma separated resources to show (eg r0,r1)")
+	since := fs.String("since", "", "Show records after this time (RFC3339, or a duration like 2h meaning that long ago)")
+	until := fs.String("until", "", "Show records before this time (RFC3339, or a duration)")
+	types := fs.String("type", "", "Comma separated record types (delta, event, hook) or events (eg Promoted) to show")
+	asJSON := fs.Bool("json", false, "Print records as JSON lines")
+	_ = fs.String("config", "", "JSON configuration file, for -journal")
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "history", "-journal file", "[flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	_, err := resolveFlags(fs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *journal == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var filter drbd.JournalFilter
+	if *resources != "" {
+		for _, name := range strings.Split(*resources, ",") {
+			r, err := drbd.ParseResource(name)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			filter.Resources = append(filter.Resources, r)
+		}
+	}
+	if *types != "" {
+		filter.Types = strings.Split(*types, ",")
+	}
+	filter.Since, err = parseWhen(*since)
+	if err != nil {
+		fmt.Println("-since:", err)
+		os.Exit(1)
+	}
+	filter.Until, err = parseWhen(*until)
+	if err != nil {
+		fmt.Println("-until:", err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	err = drbd.ReadJournal(*journal, filter, func(r drbd.Record) error {
+		if *asJSON {
+			return enc.Encode(r)
+		}
+		fmt.Println(r)
+		return nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// parseWhen accepts an RFC3339 time or a duration that is how long ago
+func parseWhen(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -1,30 +1,57 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
-	"time"
-
-	"github.com/muir/drbd-watcher/pkg/drbd"
 )
 
-var naptime = flag.Duration("sleep", time.Second, "Amount of time to sleep between checking /proc/drbd")
-var exitOnError = flag.Bool("ignore-errors", false, "Keep running even if there are errors")
-
 func main() {
-	flag.Parse()
-	if flag.NArg() == 0 {
-		Usage("must specifiy a command to run")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "watch":
+			watchCmd(os.Args[2:])
+			return
+		case "status":
+			statusCmd(os.Args[2:])
+			return
+		case "check":
+			checkCmd(os.Args[2:])
+			return
+		case "validate":
+			validateCmd(os.Args[2:])
+			return
+		case "history":
+			history(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "record":
+			record(os.Args[2:])
+			return
+		case "simulate":
+			simulateCmd(os.Args[2:])
+			return
+		case "help", "-h", "-help", "--help":
+			Usage("")
+		}
 	}
-	err := drbd.RunCommandOnChange(*naptime, *exitOnError, flag.Args())
-	fmt.Println(err)
-	os.Exit(1)
+	// without a subcommand, the arguments are those of watch
+	watchCmd(os.Args[1:])
 }
 
 func Usage(message string) {
-	fmt.Println(os.Args[0], "[flags]", "command", "[command args]")
-	fmt.Println(message)
-	flag.Usage()
+	fmt.Println(os.Args[0], "watch", "[flags]", "[command [command args]]")
+	fmt.Println(os.Args[0], "status", "[flags]")
+	fmt.Println(os.Args[0], "check", "[flags]")
+	fmt.Println(os.Args[0], "validate", "[flags]", "[command [command args]]")
+	fmt.Println(os.Args[0], "history", "[flags]")
+	fmt.Println(os.Args[0], "replay", "[flags]", "command", "[command args]")
+	fmt.Println(os.Args[0], "record", "[flags]")
+	fmt.Println(os.Args[0], "simulate", "[flags]", "scenario.json...", "[-- command [command args]]")
+	fmt.Println("Use", os.Args[0], "<subcommand> -h for the flags of a subcommand.")
+	if message != "" {
+		fmt.Println(message)
+	}
 	os.Exit(1)
 }
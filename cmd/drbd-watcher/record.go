@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+)
+
+// record implements "drbd-watcher record"
+func record(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory to write the recording to")
+	nap := fs.Duration("sleep", time.Second, "Amount of time to sleep between checking /proc/drbd")
+	segmentSize := fs.Int64("segment-size", 1<<20, "Start a new recording file after this many bytes")
+	maxSize := fs.Int64("max-size", 100<<20, "Remove the oldest recording files when they total more than this many bytes (0 is unlimited)")
+	maxAge := fs.Duration("max-age", 30*24*time.Hour, "Remove recording files older than this (0 is unlimited)")
+	_ = fs.String("config", "", "JSON configuration file, for -sleep")
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "record", "-dir directory", "[flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	_, err := resolveFlags(fs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *dir == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	rec := &drbd.Recorder{
+		Dir:         *dir,
+		SegmentSize: *segmentSize,
+		MaxSize:     *maxSize,
+		MaxAge:      *maxAge,
+	}
+	err = rec.Record(context.Background(), drbd.Options{Nap: *nap})
+	fmt.Println(err)
+	os.Exit(1)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+)
+
+// replay implements "drbd-watcher replay".  It takes the flags of
+// watch, and its configuration file, so that a recording can be
+// replayed with the same settle time, groups, and failover groups.
+func replay(args []string) {
+	w := newWatchFlags("replay")
+	fs := w.fs
+	recording := fs.String("recording", "", "Directory written by 'drbd-watcher record', journal, or 'drbdsetup events2 --timestamps' output")
+	speed := fs.Float64("speed", 1, "How much faster than real time to replay (0 is as fast as possible)")
+	step := fs.Bool("step", false, "Wait for return to be pressed before each snapshot")
+	fstab := fs.String("fstab", "/etc/fstab", "fstab to find mount points in")
+	linger := fs.Duration("linger", 2*time.Second, "Amount of time to wait for commands after the last snapshot")
+	// the replayed /proc/drbd changes faster than the real one.  Setting
+	// the Value, rather than the flag, leaves -sleep to the environment
+	// and the configuration file.
+	sleep := fs.Lookup("sleep")
+	_ = sleep.Value.Set("10ms")
+	sleep.DefValue = "10ms"
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "replay", "-recording file", "[flags]", "[command [command args]]")
+		fmt.Println("The flags and configuration file of watch apply, except that the replayed /proc/drbd is always read and")
+		fmt.Println("-source, -state-file, -startup, -journal, and -listen are ignored.")
+		fs.PrintDefaults()
+	}
+	opts, command, err := w.options(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *recording == "" || len(command) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	snapshots, err := drbd.ReadRecording(*recording)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	dir, err := ioutil.TempDir("", "drbd-replay")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	opts.ProcDRBD = dir + "/proc-drbd"
+	opts.ProcMounts = dir + "/proc-mounts"
+	opts.Fstab = *fstab
+	opts.Source = drbd.SourceProcDRBD
+	opts.StateFile = ""
+	opts.Startup = drbd.StartupInitial
+	done := make(chan error, 1)
+	go func() {
+		done <- opts.RunCommandOnChange(!*w.ignoreErrors, command)
+	}()
+
+	r := drbd.Replayer{
+		Snapshots: snapshots,
+		Speed:     *speed,
+	}
+	if *step {
+		stdin := bufio.NewReader(os.Stdin)
+		r.Step = func(i int, s drbd.Snapshot) error {
+			fmt.Printf("snapshot %d of %d from %s, press return: ", i+1, len(snapshots), s.Time.Format(time.RFC3339Nano))
+			_, err := stdin.ReadString('\n')
+			return err
+		}
+	}
+	err = r.Run(opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	select {
+	case err := <-done:
+		fmt.Println(err)
+		os.Exit(1)
+	case <-time.After(*linger):
+	}
+}
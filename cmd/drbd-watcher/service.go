@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/muir/drbd-watcher/pkg/systemd"
+)
+
+// service tells systemd how the watcher is doing and answers HTTP
+// requests about it
+type service struct {
+	opts  drbd.Options
+	stale time.Duration
+	stuck time.Duration
+
+	mu       sync.Mutex
+	ready    bool
+	lastRead time.Time
+	status   string
+}
+
+// newService reports unhealthy when the state hasn't been read for
+// stale, which defaults to three naps, or when a command has been
+// running for stuck
+func newService(opts drbd.Options, stale, stuck time.Duration) *service {
+	if stale == 0 {
+		stale = 3 * opts.Nap
+	}
+	return &service{
+		opts:     opts,
+		stale:    stale,
+		stuck:    stuck,
+		lastRead: time.Now(),
+	}
+}
+
+// notify sends state to systemd, if the watcher is running under it
+func notify(state string) {
+	_, err := systemd.Notify(state)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// polled is Options.Polled.  The watcher is ready once the state has
+// been read for the first time.
+func (s *service) polled(rs drbd.Resources) {
+	status := summarize(rs.States())
+	s.mu.Lock()
+	first, changed := !s.ready, status != s.status
+	s.ready, s.status, s.lastRead = true, status, time.Now()
+	s.mu.Unlock()
+	switch {
+	case first:
+		notify("READY=1\nSTATUS=" + status)
+	case changed:
+		notify("STATUS=" + status)
+	}
+}
+
+// summarize counts resources by connection state, for example
+// "3 resources: 2 Connected, 1 WFConnection"
+func summarize(states drbd.States) string {
+	if len(states) == 0 {
+		return "no resources"
+	}
+	count := make(map[string]int)
+	for _, s := range states {
+		count[s.Connection]++
+	}
+	connections := make([]string, 0, len(count))
+	for c := range count {
+		connections = append(connections, c)
+	}
+	sort.Strings(connections)
+	parts := make([]string, len(connections))
+	for i, c := range connections {
+		parts[i] = strconv.Itoa(count[c]) + " " + c
+	}
+	noun := " resources: "
+	if len(states) == 1 {
+		noun = " resource: "
+	}
+	return strconv.Itoa(len(states)) + noun + strings.Join(parts, ", ")
+}
+
+// start starts the systemd watchdog, if it is enabled, and serves
+// HTTP on listen and on sockets from systemd socket activation
+func (s *service) start(listen string) error {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		return err
+	}
+	if interval > 0 {
+		if interval <= s.opts.Nap {
+			log.Printf("WatchdogSec (%s) should be longer than -sleep (%s)\n", interval, s.opts.Nap)
+		}
+		go s.watchdog(interval)
+	}
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	if listen != "" {
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.serveStatus)
+	mux.HandleFunc("/healthz", s.serveHealth)
+	mux.HandleFunc("/readyz", s.serveReady)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Printf("listening on %s\n", l.Addr())
+			log.Println(http.Serve(l, mux))
+		}(l)
+	}
+	return nil
+}
+
+// watchdog pings systemd as long as the state is being read.  The
+// netlink source returns the state every nap even when nothing has
+// changed, so it is covered too.
+func (s *service) watchdog(interval time.Duration) {
+	for range time.Tick(interval / 2) {
+		s.mu.Lock()
+		since := time.Since(s.lastRead)
+		s.mu.Unlock()
+		if since >= interval {
+			log.Printf("no successful read for %s, not pinging the watchdog\n", since.Round(time.Second))
+			continue
+		}
+		notify("WATCHDOG=1")
+	}
+}
+
+// serveHealth responds with the watcher's health, and 503 Service
+// Unavailable if it's unhealthy
+func (s *service) serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := s.opts.Control.Health(s.stale, s.stuck)
+	code := http.StatusOK
+	if !h.Healthy() {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
+
+// serveReady is like serveHealth but only 503 until the state has
+// been read and once the watcher is stopping
+func (s *service) serveReady(w http.ResponseWriter, r *http.Request) {
+	h := s.opts.Control.Health(s.stale, s.stuck)
+	code := http.StatusOK
+	if !h.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, h)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// serveStatus responds with what "drbd-watcher status -format json"
+// prints
+func (s *service) serveStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, err := s.opts.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
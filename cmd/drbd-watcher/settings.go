@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+)
+
+// envName is the environment variable for a flag: -flap-count is
+// DRBD_WATCHER_FLAP_COUNT
+func envName(flagName string) string {
+	return "DRBD_WATCHER_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// configSettings are the flag values that a configuration file sets.
+// Numbers and booleans that are in the file are set even when they
+// are zero or false, so "journal_keep": 0 overrides the default of 5.
+// Empty strings are not set.
+func configSettings(c *drbd.Config) map[string]string {
+	s := make(map[string]string)
+	has := func(name string) bool {
+		return c.Has(strings.Replace(name, "-", "_", -1))
+	}
+	set := func(name, value string) {
+		if value != "" {
+			s[name] = value
+		}
+	}
+	setInt := func(name string, value int64) {
+		if value != 0 || has(name) {
+			s[name] = strconv.FormatInt(value, 10)
+		}
+	}
+	setBool := func(name string, value bool) {
+		if value || has(name) {
+			s[name] = strconv.FormatBool(value)
+		}
+	}
+	set("sleep", c.Sleep)
+	set("fast-sleep", c.FastSleep)
+	set("missed-gap", c.MissedGap)
+	setBool("ignore-errors", c.IgnoreErrors)
+	set("settle", c.Settle)
+	setInt("flap-count", int64(c.FlapCount))
+	set("flap-window", c.FlapWindow)
+	set("state-file", c.StateFile)
+	set("startup", c.Startup)
+	set("journal", c.Journal)
+	setInt("journal-max-size", c.JournalMaxSize)
+	setInt("journal-keep", int64(c.JournalKeep))
+	set("source", c.Source)
+	setBool("lenient", c.Lenient)
+	set("stop-timeout", c.StopTimeout)
+	set("listen", c.Listen)
+	setInt("read-retries", int64(c.ReadRetries))
+	set("stale-after", c.StaleAfter)
+	set("stuck-after", c.StuckAfter)
+	setInt("max-parallel", int64(c.MaxParallel))
+	return s
+}
+
+// resolveFlags fills in the flags that weren't given on the command
+// line, first from their environment variables and then from the
+// configuration file named by -config.  It returns the configuration,
+// which is empty if there is no file.
+func resolveFlags(fs *flag.FlagSet) (*drbd.Config, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		err = errors.Wrapf(fs.Set(f.Name, value), "%s=%s", envName(f.Name), value)
+		given[f.Name] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &drbd.Config{}
+	filename := ""
+	if f := fs.Lookup("config"); f != nil {
+		filename = f.Value.String()
+	}
+	if filename == "" {
+		return config, nil
+	}
+	config, err = drbd.LoadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range configSettings(config) {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		err := fs.Set(name, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s in %s", name, filename)
+		}
+	}
+	return config, nil
+}
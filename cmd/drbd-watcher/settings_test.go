@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setenv sets an environment variable and returns a function that
+// puts it back
+func setenv(t *testing.T, key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value), "setenv %s", key)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestResolveFlags(t *testing.T) {
+	fh, err := ioutil.TempFile("", "drbd-watcher-config")
+	require.NoError(t, err, "config file")
+	defer os.Remove(fh.Name())
+	_, err = fh.WriteString(`{ "sleep": "3s", "settle": "4s", "journal_keep": 0, "ignore_errors": false, "command": [ "true" ] }`)
+	require.NoError(t, err, "write config")
+	require.NoError(t, fh.Close(), "close config")
+
+	cases := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		flag  string
+		want  string
+		error bool
+	}{
+		{name: "config", flag: "sleep", want: "3s"},
+		{name: "default", flag: "flap-count", want: "0"},
+		{name: "flag beats config", args: []string{"-sleep", "1s"}, flag: "sleep", want: "1s"},
+		{name: "flag beats environment", args: []string{"-settle", "1s"}, env: map[string]string{"DRBD_WATCHER_SETTLE": "2s"}, flag: "settle", want: "1s"},
+		{name: "environment beats config", env: map[string]string{"DRBD_WATCHER_SLEEP": "2s"}, flag: "sleep", want: "2s"},
+		{name: "zero beats default", flag: "journal-keep", want: "0"},
+		{name: "environment beats zero", env: map[string]string{"DRBD_WATCHER_JOURNAL_KEEP": "7"}, flag: "journal-keep", want: "7"},
+		{name: "false from config", flag: "ignore-errors", want: "false"},
+		{name: "bad environment", env: map[string]string{"DRBD_WATCHER_SLEEP": "soon"}, error: true},
+		{name: "bad flag from environment", env: map[string]string{"DRBD_WATCHER_FLAP_COUNT": "many"}, error: true},
+	}
+	for _, tc := range cases {
+		var restore []func()
+		for key, value := range tc.env {
+			restore = append(restore, setenv(t, key, value))
+		}
+		w := newWatchFlags("watch")
+		require.NoError(t, w.fs.Parse(append([]string{"-config", fh.Name()}, tc.args...)), tc.name)
+		config, err := resolveFlags(w.fs)
+		for _, r := range restore {
+			r()
+		}
+		if tc.error {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, []string{"true"}, config.Command, tc.name)
+		assert.Equal(t, tc.want, w.fs.Lookup(tc.flag).Value.String(), tc.name)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "DRBD_WATCHER_FLAP_COUNT", envName("flap-count"), "env name")
+}
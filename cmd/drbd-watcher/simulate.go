@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/muir/drbd-watcher/pkg/simulate"
+)
+
+// simulateCmd implements "drbd-watcher simulate"
+func simulateCmd(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "Show every invocation")
+	_ = fs.String("config", "", "JSON configuration file, for the command of scenarios that don't have one")
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "simulate", "[flags]", "scenario.json...", "[-- command [command args]]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	config, err := resolveFlags(fs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	files := fs.Args()
+	var command []string
+	for i, a := range files {
+		if a == "--" {
+			command = files[i+1:]
+			files = files[:i]
+			break
+		}
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	failed := false
+	for _, file := range files {
+		s, err := simulate.Load(file)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		switch {
+		case len(command) > 0:
+			s.Command = command
+		case len(s.Command) == 0:
+			s.Command = config.Command
+		}
+		result, err := s.Run()
+		if err != nil {
+			fmt.Println(s.Name, err)
+			os.Exit(1)
+		}
+		if *verbose {
+			for i, inv := range result.Invocations {
+				fmt.Printf("%s: invocation %d: %v", s.Name, i+1, inv.Args)
+				if inv.Err != nil {
+					fmt.Print(" ", inv.Err)
+				}
+				fmt.Println()
+			}
+		}
+		if result.Passed() {
+			fmt.Println("PASS", s.Name)
+			continue
+		}
+		failed = true
+		fmt.Println("FAIL", s.Name)
+		for _, f := range result.Failures {
+			fmt.Println("\t" + f)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// statusCmd implements "drbd-watcher status".  It exits 2 if any
+// device is degraded or the watcher, with -watcher, is unhealthy.
+func statusCmd(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	format := fs.String("format", "table", "Output format: table, json, or yaml")
+	source := fs.String("source", string(drbd.SourceProcDRBD), "Where to read DRBD state from: proc, drbdsetup, or netlink")
+	_ = fs.String("config", "", "JSON configuration file, for min_replicas")
+	lenient := fs.Bool("lenient", false, "Skip lines in /proc/drbd that can't be parsed")
+	watcher := fs.String("watcher", "", "URL of a running watcher's -listen address (eg http://localhost:9090) to include its health")
+	fs.Usage = func() {
+		fmt.Println(os.Args[0], "status", "[flags]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	config, err := resolveFlags(fs)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opts := drbd.Options{
+		Source:  drbd.Source(*source),
+		Lenient: *lenient,
+	}
+	err = config.Apply(&opts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	statuses, err := opts.Status()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// without -watcher, the output is just the statuses
+	var output interface{} = statuses
+	var health *drbd.Health
+	if *watcher != "" {
+		health, err = watcherHealth(*watcher)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		output = struct {
+			Resources []drbd.Status `json:"resources" yaml:"resources"`
+			Watcher   *drbd.Health  `json:"watcher" yaml:"watcher"`
+		}{statuses, health}
+	}
+	switch *format {
+	case "table":
+		printStatusTable(statuses)
+		if health != nil {
+			printHealth(*health)
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(output)
+	case "yaml":
+		var out []byte
+		out, err = yaml.Marshal(output)
+		os.Stdout.Write(out)
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if health != nil && !health.Healthy() {
+		os.Exit(2)
+	}
+	for _, s := range statuses {
+		if s.Degraded {
+			os.Exit(2)
+		}
+	}
+}
+
+// watcherHealth asks a running watcher how it is doing
+func watcherHealth(url string) (*drbd.Health, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/healthz")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var h drbd.Health
+	err = json.NewDecoder(resp.Body).Decode(&h)
+	if err != nil {
+		return nil, errors.Wrapf(err, "health from %s", url)
+	}
+	return &h, nil
+}
+
+func printHealth(h drbd.Health) {
+	fmt.Println()
+	if h.Healthy() {
+		fmt.Println("watcher: healthy")
+	} else {
+		fmt.Println("watcher: unhealthy:", strings.Join(h.Problems, "; "))
+	}
+	lastRead := "never"
+	if !h.LastRead.IsZero() {
+		lastRead = h.At.Sub(h.LastRead).Round(time.Second).String() + " ago"
+	}
+	minors := make([]int, 0, len(h.Queued))
+	for r := range h.Queued {
+		minors = append(minors, r)
+	}
+	sort.Ints(minors)
+	queued := make([]string, len(minors))
+	for i, r := range minors {
+		queued[i] = "r" + strconv.Itoa(r) + "=" + strconv.Itoa(h.Queued[r])
+	}
+	if len(queued) == 0 {
+		queued = []string{"none"}
+	}
+	fmt.Printf("last read: %s, read errors: %d, running: %d (oldest %.0fs), queued: %s\n",
+		lastRead, h.ReadErrors, h.Running, h.OldestRunningSeconds, strings.Join(queued, " "))
+}
+
+func printStatusTable(statuses []drbd.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RESOURCE\tVOLUME\tMINOR\tCS\tROLES\tDISKS\tSYNC\tMOUNTS\tMOUNTED\tPROBLEMS")
+	for _, s := range statuses {
+		sync, mounts, problems := "-", "-", "-"
+		if s.SyncPercent != nil {
+			sync = strconv.FormatFloat(*s.SyncPercent, 'f', 1, 64) + "%"
+		}
+		if len(s.Mounts) > 0 {
+			mounts = strings.Join(s.Mounts, ",")
+		}
+		if s.Degraded {
+			problems = strings.Join(s.Problems, "; ")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s/%s\t%s/%s\t%s\t%s\t%t\t%s\n",
+			s.Name, s.Volume, s.Minor, s.Connection, s.SelfRole, s.RemoteRole,
+			s.SelfDisk, s.RemoteDisk, sync, mounts, s.Mounted, problems)
+	}
+	w.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+)
+
+// validateCmd implements "drbd-watcher validate".  It takes the same
+// flags as watch and checks, without watching, that the watcher
+// would start and that the commands it runs can be found.
+func validateCmd(args []string) {
+	w := newWatchFlags("validate")
+	w.fs.Usage = func() {
+		fmt.Println(os.Args[0], "validate", "[flags]", "[command [command args]]")
+		w.fs.PrintDefaults()
+	}
+	opts, command, err := w.options(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var problems []string
+	looked := make(map[string]bool)
+	executable := func(what, name string) {
+		if looked[name] {
+			return
+		}
+		looked[name] = true
+		if _, err := exec.LookPath(name); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", what, err))
+		}
+	}
+	if len(command) == 0 {
+		problems = append(problems, "no command: give one after the flags or in the configuration file")
+	} else {
+		executable("command", command[0])
+	}
+	for _, g := range opts.Failover {
+		for _, u := range g.Units {
+			if u.Resource != "" {
+				executable("failover group "+g.Name, "drbdadm")
+			}
+			if u.Mount != "" {
+				executable("failover group "+g.Name, "mount")
+				executable("failover group "+g.Name, "umount")
+				executable("failover group "+g.Name, "mountpoint")
+			}
+			if u.Service != "" {
+				executable("failover group "+g.Name, "systemctl")
+			}
+		}
+	}
+	if opts.Source == drbd.SourceDrbdsetup || opts.Source == drbd.SourceNetlink {
+		executable("source "+string(opts.Source), "drbdsetup")
+	}
+	if *w.listen != "" {
+		if _, err := net.ResolveTCPAddr("tcp", *w.listen); err != nil {
+			problems = append(problems, fmt.Sprintf("listen: %s", err))
+		}
+	}
+	for _, file := range []string{*w.journal, *w.stateFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Dir(file)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("configuration is valid")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+)
+
+// watchFlags are the flags of "drbd-watcher watch", which
+// "drbd-watcher validate" shares
+type watchFlags struct {
+	fs           *flag.FlagSet
+	nap          *time.Duration
+	fastNap      *time.Duration
+	missedGap    *time.Duration
+	ignoreErrors *bool
+	settle       *time.Duration
+	flapCount    *int
+	flapWindow   *time.Duration
+	stateFile    *string
+	startup      *string
+	journal      *string
+	journalSize  *int64
+	journalKeep  *int
+	configFile   *string
+	source       *string
+	lenient      *bool
+	maxParallel  *int
+	stopTimeout  *time.Duration
+	listen       *string
+	readRetries  *int
+	staleAfter   *time.Duration
+	stuckAfter   *time.Duration
+}
+
+func newWatchFlags(name string) *watchFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return &watchFlags{
+		fs:           fs,
+		nap:          fs.Duration("sleep", time.Second, "Amount of time to sleep between checking /proc/drbd"),
+		fastNap:      fs.Duration("fast-sleep", 0, "Amount of time to sleep between checks while a resource is resyncing or disconnected (0 always uses -sleep)"),
+		missedGap:    fs.Duration("missed-gap", 0, "Mark changes as MAYBE_MISSED when checks were further apart than this (0 is twice the sleep)"),
+		ignoreErrors: fs.Bool("ignore-errors", false, "Keep running even if the command or a failover fails"),
+		settle:       fs.Duration("settle", 0, "Amount of time a change must persist before the command is run"),
+		flapCount:    fs.Int("flap-count", 0, "Number of changes within -flap-window that mark a resource as flapping (0 disables)"),
+		flapWindow:   fs.Duration("flap-window", time.Minute, "Window for counting changes, and quiet time needed to stop flapping"),
+		stateFile:    fs.String("state-file", "", "File to save resource states in so that they survive restarts"),
+		startup:      fs.String("startup", string(drbd.StartupInitial), "What to run the command for at startup: initial (all resources), changes (since -state-file was saved), or none"),
+		journal:      fs.String("journal", "", "Append-only journal of changes, events, and command results"),
+		journalSize:  fs.Int64("journal-max-size", 10<<20, "Rotate the journal when it grows beyond this many bytes"),
+		journalKeep:  fs.Int("journal-keep", 5, "Number of rotated journal files to keep"),
+		configFile:   fs.String("config", "", "JSON configuration file"),
+		source:       fs.String("source", string(drbd.SourceProcDRBD), "Where to read DRBD state from: proc (/proc/drbd, DRBD 8), drbdsetup (drbdsetup status --json, DRBD 9), or netlink (DRBD 9 notifications)"),
+		lenient:      fs.Bool("lenient", false, "Log lines in /proc/drbd that can't be parsed instead of stopping"),
+		maxParallel:  fs.Int("max-parallel", 0, "Maximum number of commands to run at once (0 is unlimited)"),
+		stopTimeout:  fs.Duration("stop-timeout", 30*time.Second, "How long to wait for running commands after SIGTERM or SIGINT (0 waits as long as it takes)"),
+		listen:       fs.String("listen", "", "Address to serve HTTP status requests on (eg localhost:9090); sockets from systemd socket activation are also served"),
+		readRetries:  fs.Int("read-retries", 0, "Number of consecutive failed reads of the DRBD state to retry before stopping"),
+		staleAfter:   fs.Duration("stale-after", 0, "Report the watcher as unhealthy when the DRBD state hasn't been read for this long (0 is three times -sleep)"),
+		stuckAfter:   fs.Duration("stuck-after", 10*time.Minute, "Report the watcher as unhealthy when a command has been running for this long (0 never)"),
+	}
+}
+
+// options parses args and returns the Options and the command.  The
+// command is the arguments left after the flags or else the command in
+// the configuration file.
+func (w *watchFlags) options(args []string) (drbd.Options, []string, error) {
+	_ = w.fs.Parse(args)
+	config, err := resolveFlags(w.fs)
+	if err != nil {
+		return drbd.Options{}, nil, err
+	}
+	opts := drbd.Options{
+		Nap:         *w.nap,
+		FastNap:     *w.fastNap,
+		MissedGap:   *w.missedGap,
+		Source:      drbd.Source(*w.source),
+		Lenient:     *w.lenient,
+		Settle:      *w.settle,
+		FlapCount:   *w.flapCount,
+		FlapWindow:  *w.flapWindow,
+		StateFile:   *w.stateFile,
+		Startup:     drbd.Startup(*w.startup),
+		StopTimeout: *w.stopTimeout,
+		ReadRetries: *w.readRetries,
+	}
+	err = config.Apply(&opts)
+	if err != nil {
+		return drbd.Options{}, nil, errors.Wrapf(err, "%s", *w.configFile)
+	}
+	opts.MaxParallel = *w.maxParallel
+	command := w.fs.Args()
+	if len(command) == 0 {
+		command = config.Command
+	}
+	return opts, command, opts.Validate()
+}
+
+// watchCmd implements "drbd-watcher watch", which is also what runs
+// when no subcommand is given.  SIGTERM and SIGINT stop it, SIGHUP
+// reloads the configuration, and SIGUSR1 logs what it knows.
+func watchCmd(args []string) {
+	w := newWatchFlags("watch")
+	w.fs.Usage = func() {
+		fmt.Println(os.Args[0], "watch", "[flags]", "[command [command args]]")
+		fmt.Println("Flags can also be set with DRBD_WATCHER_<FLAG> environment variables (eg DRBD_WATCHER_FLAP_COUNT) or in the -config file.")
+		w.fs.PrintDefaults()
+	}
+	opts, command, err := w.options(args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(command) == 0 {
+		Usage("must specify a command to run")
+	}
+	if *w.journal != "" {
+		journal, err := drbd.OpenJournal(*w.journal, *w.journalSize, *w.journalKeep)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.Journal = journal
+	}
+	opts.Control = drbd.NewControl()
+	svc := newService(opts, *w.staleAfter, *w.stuckAfter)
+	opts.Polled = svc.polled
+	err = svc.start(*w.listen)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go handleSignals(opts.Control, args)
+	err = opts.RunCommandOnChange(!*w.ignoreErrors, command)
+	if err == drbd.ErrStopped {
+		log.Println("stopped")
+		os.Exit(0)
+	}
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+// handleSignals acts on signals for as long as the watcher runs.  A
+// reload reads the flags, environment, and configuration file again.
+func handleSignals(control *drbd.Control, args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGTERM, syscall.SIGINT:
+			log.Printf("%s: stopping\n", sig)
+			notify("STOPPING=1")
+			control.Stop()
+		case syscall.SIGHUP:
+			notify("RELOADING=1")
+			opts, command, err := newWatchFlags("watch").options(args)
+			if err == nil {
+				err = control.Reload(opts, command)
+			}
+			if err != nil {
+				log.Printf("reload failed, keeping the old configuration: %s\n", err)
+			}
+			notify("READY=1")
+		case syscall.SIGUSR1:
+			for _, line := range control.Dump() {
+				log.Println(line)
+			}
+		}
+	}
+}
@@ -14,4 +14,5 @@ require (
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d // indirect
 	google.golang.org/api v0.19.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2
 )
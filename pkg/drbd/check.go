@@ -0,0 +1,213 @@
+package drbd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckLevel is a monitoring plugin state.  It is also the plugin's
+// exit code.
+type CheckLevel int
+
+// Monitoring plugin states, as used by Nagios and Icinga
+const (
+	CheckOK       CheckLevel = 0
+	CheckWarning  CheckLevel = 1
+	CheckCritical CheckLevel = 2
+	CheckUnknown  CheckLevel = 3
+)
+
+var checkLevelNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func (l CheckLevel) String() string {
+	if l >= 0 && int(l) < len(checkLevelNames) {
+		return checkLevelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseCheckLevel accepts "ok", "warning", "critical", or "unknown"
+func ParseCheckLevel(s string) (CheckLevel, error) {
+	for i, name := range checkLevelNames {
+		if strings.EqualFold(s, name) {
+			return CheckLevel(i), nil
+		}
+	}
+	return CheckUnknown, errors.Errorf("invalid check level '%s'", s)
+}
+
+// Thresholds say what Check reports.  Zero speeds and sizes are not
+// checked.
+type Thresholds struct {
+	// Disconnected is the level when a peer is not connected or
+	// quorum is lost
+	Disconnected CheckLevel
+	// NotUpToDate is the level when a disk, here or on a connected
+	// peer, is not UpToDate.  A local disk may be Diskless only on a
+	// client.
+	NotUpToDate CheckLevel
+	// SyncSpeedWarning and SyncSpeedCritical are in KiB/s.  A resync
+	// slower than these is reported.
+	SyncSpeedWarning  int64
+	SyncSpeedCritical int64
+	// OutOfSyncWarning and OutOfSyncCritical are in KiB
+	OutOfSyncWarning  int64
+	OutOfSyncCritical int64
+	// Roles are the expected roles, by resource name.  RoleMismatch
+	// is the level when a resource has a different role.
+	Roles        map[string]string
+	RoleMismatch CheckLevel
+	// MinReplicas and Expected are as in Options.  FewReplicas is the
+	// level when a resource has fewer UpToDate replicas, and Drifted
+	// when it isn't in, or is missing from, its expected state.
+	MinReplicas map[string]int
+	FewReplicas CheckLevel
+	Expected    map[string]Expected
+	Drifted     CheckLevel
+}
+
+// CheckResult is the outcome of Check
+type CheckResult struct {
+	Level    CheckLevel
+	Messages []string
+	Perfdata []string
+}
+
+// String is the plugin output line, for example
+// "DRBD CRITICAL - data/0 peer beta connection is Connecting | 'data/0 oos'=0KB;;"
+func (r CheckResult) String() string {
+	s := "DRBD " + r.Level.String() + " - "
+	if len(r.Messages) == 0 {
+		s += "all devices are healthy"
+	} else {
+		s += strings.Join(r.Messages, ", ")
+	}
+	if len(r.Perfdata) > 0 {
+		s += " | " + strings.Join(r.Perfdata, " ")
+	}
+	return s
+}
+
+// Check evaluates statuses against thresholds.  Messages are ordered
+// most severe first.
+func Check(statuses []Status, t Thresholds) CheckResult {
+	type message struct {
+		level CheckLevel
+		text  string
+	}
+	var messages []message
+	var r CheckResult
+	found := make(map[string]bool)
+	for _, s := range statuses {
+		found[s.Name] = true
+		device := s.Name + "/" + strconv.Itoa(s.Volume)
+		add := func(level CheckLevel, format string, args ...interface{}) {
+			if level == CheckOK {
+				return
+			}
+			messages = append(messages, message{level, device + " " + fmt.Sprintf(format, args...)})
+			if level > r.Level {
+				r.Level = level
+			}
+		}
+		if s.Connection == "Unconfigured" {
+			continue
+		}
+		// the same as Status.Problems: only a client may be Diskless
+		if !s.Client && s.SelfDisk != "UpToDate" && s.SelfDisk != "" {
+			add(t.NotUpToDate, "disk is %s", s.SelfDisk)
+		}
+		if s.Quorum == "no" {
+			add(t.Disconnected, "has no quorum")
+		}
+		for _, p := range s.Peers {
+			peer := "peer " + Change{PeerNodeID: p.NodeID, Peer: p.Name}.peer()
+			if !connected(connectionName(p.Connection)) {
+				add(t.Disconnected, "%s connection is %s", peer, p.Connection)
+				continue
+			}
+			if p.Disk != "UpToDate" && p.Disk != "Diskless" {
+				add(t.NotUpToDate, "%s disk is %s", peer, p.Disk)
+			}
+		}
+		if want := t.Roles[s.Name]; want != "" && s.SelfRole != want {
+			add(t.RoleMismatch, "is %s, not %s", s.SelfRole, want)
+		}
+		if min := t.MinReplicas[s.Name]; min > 0 && s.Replicas < min {
+			add(t.FewReplicas, "has %d UpToDate replicas, fewer than %d", s.Replicas, min)
+		}
+		if e, ok := t.Expected[s.Name]; ok {
+			state := State{
+				Connection: s.Connection,
+				SelfRole:   s.SelfRole,
+				RemoteRole: s.RemoteRole,
+				SelfDisk:   s.SelfDisk,
+				RemoteDisk: s.RemoteDisk,
+				Client:     s.Client,
+			}
+			for _, d := range e.Diff(state) {
+				add(t.Drifted, "%s", d)
+			}
+		}
+		if s.SyncPercent != nil && s.SyncSpeed > 0 {
+			switch {
+			case s.SyncSpeed < t.SyncSpeedCritical:
+				add(CheckCritical, "resync at %d KiB/s", s.SyncSpeed)
+			case s.SyncSpeed < t.SyncSpeedWarning:
+				add(CheckWarning, "resync at %d KiB/s", s.SyncSpeed)
+			}
+		}
+		switch {
+		case t.OutOfSyncCritical > 0 && s.OutOfSync > t.OutOfSyncCritical:
+			add(CheckCritical, "%d KiB out of sync", s.OutOfSync)
+		case t.OutOfSyncWarning > 0 && s.OutOfSync > t.OutOfSyncWarning:
+			add(CheckWarning, "%d KiB out of sync", s.OutOfSync)
+		}
+		r.Perfdata = append(r.Perfdata, perfdata(device+" oos", s.OutOfSync, "KB", t.OutOfSyncWarning, t.OutOfSyncCritical))
+		if s.SyncPercent != nil {
+			r.Perfdata = append(r.Perfdata, fmt.Sprintf("'%s synced'=%.1f%%;;;0;100", device, *s.SyncPercent))
+		}
+		if s.SyncSpeed > 0 {
+			r.Perfdata = append(r.Perfdata, perfdata(device+" speed", s.SyncSpeed, "", 0, 0))
+		}
+	}
+	missing := make([]string, 0, len(t.Expected))
+	for name := range t.Expected {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		if t.Drifted == CheckOK {
+			break
+		}
+		messages = append(messages, message{t.Drifted, name + " is missing"})
+		if t.Drifted > r.Level {
+			r.Level = t.Drifted
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].level > messages[j].level
+	})
+	for _, m := range messages {
+		r.Messages = append(r.Messages, m.text)
+	}
+	return r
+}
+
+// perfdata formats 'label'=value[uom];warn;crit, leaving out
+// thresholds that are zero
+func perfdata(label string, value int64, uom string, warn, crit int64) string {
+	threshold := func(v int64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprintf("'%s'=%d%s;%s;%s", label, value, uom, threshold(warn), threshold(crit))
+}
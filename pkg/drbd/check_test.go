@@ -0,0 +1,86 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("/proc/drbd", exampleProcDRBD2)
+	statuses, err := Options{FS: fs}.Status()
+	require.NoError(t, err, "status")
+	assert.Equal(t, int64(32924), statuses[0].SyncSpeed, "speed")
+	assert.Equal(t, int64(106597444), statuses[0].OutOfSync, "out of sync")
+
+	thresholds := Thresholds{
+		Disconnected:      CheckCritical,
+		NotUpToDate:       CheckWarning,
+		SyncSpeedWarning:  30000,
+		SyncSpeedCritical: 1000,
+		Roles:             map[string]string{"r0": "Secondary"},
+		RoleMismatch:      CheckCritical,
+	}
+	r := Check(statuses[:1], thresholds)
+	assert.Equal(t, CheckCritical, r.Level, "level")
+	assert.Equal(t, "DRBD CRITICAL - r0/0 is Primary, not Secondary, r0/0 peer 1 disk is Inconsistent | "+
+		"'r0/0 oos'=106597444KB;; 'r0/0 synced'=34.7%;;;0;100 'r0/0 speed'=32924;;", r.String(), "output")
+
+	thresholds.Roles = nil
+	r = Check(statuses, thresholds)
+	assert.Equal(t, CheckWarning, r.Level, "without roles")
+	assert.Contains(t, r.Messages, "r1/0 resync at 11812 KiB/s", "slow resync")
+
+	thresholds.OutOfSyncCritical = 1 << 20
+	assert.Equal(t, CheckCritical, Check(statuses, thresholds).Level, "out of sync")
+
+	fs.WriteFile("/proc/drbd", RenderProcDRBD(States{0: stateConnected, 1: stateDisconnected}))
+	statuses, err = Options{FS: fs}.Status()
+	require.NoError(t, err, "status")
+	r = Check(statuses, thresholds)
+	assert.Equal(t, []string{"r1/0 peer 1 connection is WFConnection"}, r.Messages, "disconnected")
+	r = Check(statuses[:1], thresholds)
+	assert.Equal(t, "DRBD OK - all devices are healthy | 'r0/0 oos'=0KB;;1048576", r.String(), "healthy")
+
+	thresholds.MinReplicas = map[string]int{"r0": 3}
+	thresholds.FewReplicas = CheckCritical
+	thresholds.Expected = map[string]Expected{"r0": {Role: "Secondary"}, "r5": {}}
+	thresholds.Drifted = CheckWarning
+	r = Check(statuses[:1], thresholds)
+	assert.Equal(t, CheckCritical, r.Level, "too few replicas")
+	assert.Equal(t, []string{"r0/0 has 2 UpToDate replicas, fewer than 3", "r0/0 role is Primary, not Secondary", "r5 is missing"},
+		r.Messages, "replicas and drift")
+
+	// a detached disk is a problem for both status and check, but a
+	// diskless client isn't
+	detached := stateConnected
+	detached.SelfDisk = "Diskless"
+	fs.WriteFile("/proc/drbd", RenderProcDRBD(States{0: detached}))
+	statuses, err = Options{FS: fs}.Status()
+	require.NoError(t, err, "status")
+	assert.True(t, statuses[0].Degraded, "status degraded")
+	thresholds = Thresholds{NotUpToDate: CheckWarning}
+	r = Check(statuses, thresholds)
+	assert.Equal(t, CheckWarning, r.Level, "detached")
+	assert.Equal(t, []string{"r0/0 disk is Diskless"}, r.Messages, "detached")
+	statuses[0].Client = true
+	assert.Equal(t, CheckOK, Check(statuses, thresholds).Level, "client")
+
+	level, err := ParseCheckLevel("Warning")
+	require.NoError(t, err, "parse")
+	assert.Equal(t, CheckWarning, level, "parsed")
+	_, err = ParseCheckLevel("bad")
+	assert.Error(t, err, "invalid level")
+}
+
+func TestMeasureSyncSpeed(t *testing.T) {
+	synced := 50.0
+	before := []Status{{Minor: 1, OutOfSync: 3000, SyncPercent: &synced}}
+	after := []Status{{Minor: 1, OutOfSync: 1000, SyncPercent: &synced}, {Minor: 2, OutOfSync: 5}}
+	MeasureSyncSpeed(before, after, 2*time.Second)
+	assert.Equal(t, int64(1000), after[0].SyncSpeed, "measured")
+	assert.Equal(t, int64(0), after[1].SyncSpeed, "not syncing")
+}
@@ -0,0 +1,133 @@
+package drbd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is how the watcher tells and waits for time.  It is an
+// interface so that tests can control time with a ManualClock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// AfterFunc calls f after d.  The real clock calls it in its own
+	// goroutine but a ManualClock calls it from Advance, so f must not
+	// block or wait for the clock to move.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer can be stopped
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                            { return time.Now() }
+func (realClock) Sleep(d time.Duration)                     { time.Sleep(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// ManualClock is a Clock that only moves when Advance is called
+type ManualClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*manualTimer
+}
+
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	f     func()
+}
+
+// NewManualClock returns a ManualClock set to now
+func NewManualClock(now time.Time) *ManualClock {
+	c := &ManualClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the clock's time
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock has been advanced by d
+func (c *ManualClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	done := make(chan struct{})
+	c.AfterFunc(d, func() { close(done) })
+	<-done
+}
+
+// AfterFunc calls f once the clock has been advanced by d.  Unlike
+// time.AfterFunc, f is called by Advance, not in its own goroutine.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{
+		clock: c,
+		at:    c.now.Add(d),
+		f:     f,
+	}
+	c.waiters = append(c.waiters, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Stop prevents the timer from firing.  It returns false if the timer
+// has already fired or been stopped.
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward, firing timers and waking
+// sleepers, in order, as their time arrives
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].at.Before(c.waiters[j].at)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].at.After(target) {
+			break
+		}
+		t := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.now = t.at
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = target
+	c.mu.Unlock()
+}
+
+// BlockUntil waits until there are at least n sleepers and timers
+// waiting for the clock to advance.  Tests use it to know that the
+// watcher has caught up and gone back to sleep.
+func (c *ManualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
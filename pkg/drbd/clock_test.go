@@ -0,0 +1,33 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualClock(t *testing.T) {
+	clock := NewManualClock(testStart)
+	var fired []int
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, 3) })
+	assert.True(t, stopped.Stop(), "stop")
+	assert.False(t, stopped.Stop(), "stop again")
+
+	clock.Advance(time.Second / 2)
+	assert.Empty(t, fired, "too early")
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, []int{1, 2}, fired, "in order")
+	assert.Equal(t, testStart.Add(2*time.Second+time.Second/2), clock.Now(), "now")
+
+	woke := make(chan time.Time)
+	go func() {
+		clock.Sleep(time.Minute)
+		woke <- clock.Now()
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	assert.Equal(t, testStart.Add(time.Minute+2*time.Second+time.Second/2), <-woke, "slept")
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"os"
 	"strings"
-	"syscall"
 	"testing"
 	"time"
 
@@ -18,29 +17,6 @@ func envValue(t *testing.T, env map[string]string, key string, want string) {
 	}
 }
 
-func remove(t *testing.T, name string) {
-	assert.NoErrorf(t, os.Remove(name), "remove %s", name)
-}
-
-func noFile(t *testing.T, name string, nap time.Duration) {
-	time.Sleep(nap)
-	_, err := os.Stat(name)
-	require.Error(t, err, "expecting error")
-	require.Equal(t, syscall.ENOENT, err.(*os.PathError).Err, "expecting file not to exist")
-}
-
-func waitForFile(t *testing.T, name string, nap time.Duration) {
-	for i := 0; i < 10; i++ {
-		time.Sleep(nap / 10)
-		_, err := os.Stat(name)
-		if err == nil {
-			t.Logf("file %s appeared after %d iterations", name, i)
-			return
-		}
-	}
-	t.Fatalf("file %s did not appear after waiting %s", name, nap)
-}
-
 func readOutput(t *testing.T, name string) (string, map[string]string) {
 	fh, err := os.Open(name)
 	require.NoErrorf(t, err, "open %s", name)
@@ -73,6 +49,67 @@ func writeFile(t *testing.T, name string, contents string) {
 	require.NoErrorf(t, os.Rename(name+".tmp", name), "rename %s.tmp -> %s", name, name)
 }
 
+// stopWatchers makes any watchers of a /proc/drbd file return
+// by giving them something they can't parse
+func stopWatchers(t *testing.T, procDRBD string) {
+	writeFile(t, procDRBD, "version: 8.4.10\nsrcversion: 0\nstop watching\n")
+	time.Sleep(napTime / 5)
+}
+
+var testStart = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// memWatcher is a watcher running against a MemFS and a ManualClock
+type memWatcher struct {
+	o     Options
+	fs    *MemFS
+	clock *ManualClock
+	errs  chan error
+}
+
+// newMemWatcher starts watch with files in a MemFS and waits for
+// it to take its first look at ProcDRBD
+func newMemWatcher(o Options, files map[string]string, watch func(Options) error) *memWatcher {
+	w := &memWatcher{
+		fs:    NewMemFS(),
+		clock: NewManualClock(testStart),
+		errs:  make(chan error, 1),
+	}
+	for name, contents := range files {
+		w.fs.WriteFile(name, contents)
+	}
+	if o.Nap == 0 {
+		o.Nap = time.Second
+	}
+	o.FS = w.fs
+	o.Clock = w.clock
+	w.o = o
+	go func() {
+		w.errs <- watch(o)
+	}()
+	w.clock.BlockUntil(1)
+	return w
+}
+
+// change replaces ProcDRBD and waits for the watcher to look at it
+// and go back to sleep
+func (w *memWatcher) change(contents string) {
+	w.fs.WriteFile(w.o.procDRBD(), contents)
+	w.clock.Advance(w.o.Nap)
+	w.clock.BlockUntil(1)
+}
+
+// stop makes the watcher return by giving it something it can't parse
+func (w *memWatcher) stop(t *testing.T) {
+	w.fs.WriteFile(w.o.procDRBD(), "version: 8.4.10\nsrcversion: 0\nstop watching\n")
+	w.clock.Advance(w.o.Nap)
+	select {
+	case err := <-w.errs:
+		assert.Error(t, err, "stopped watcher")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+}
+
 const exampleFstab = `UUID=65429799-d704-460d-b471-e5f04f64a221 / ext4 defaults 0 0
 /dev/drbd0  /r0 btrfs noauto,rw,relatime,space_cache,subvolid=5,subvol=/,ssd 0 0
 `
@@ -0,0 +1,207 @@
+package drbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the on-disk configuration for the watcher.  It is
+// JSON, for example:
+//
+//	{
+//		"command": [ "/usr/local/bin/on-drbd-change" ],
+//		"sleep": "2s",
+//		"source": "drbdsetup",
+//		"max_parallel": 2,
+//		"min_replicas": { "r0": 2 },
+//		"expected": {
+//			"r0": { "role": "Primary", "peer_role": "Secondary", "disk": "UpToDate", "peer_disk": "UpToDate", "connection": "Connected" }
+//		},
+//		"drift_grace": "30s",
+//		"groups": [
+//			{ "name": "pg", "resources": [ "r0", "r1" ] }
+//		],
+//		"failover": [
+//			{ "name": "web", "units": [
+//				{ "name": "www", "resource": "r2", "mount": "/var/www" },
+//				{ "name": "nginx", "service": "nginx", "after": [ "www" ] }
+//			] }
+//		]
+//	}
+type Config struct {
+	// Command, and the settings up to MaxParallel, are the same as
+	// the flags of "drbd-watcher watch".  Flags and environment
+	// variables override them.  Durations are strings like "1s".
+	Command        []string `json:"command"`
+	Sleep          string   `json:"sleep"`
+	FastSleep      string   `json:"fast_sleep"`
+	MissedGap      string   `json:"missed_gap"`
+	IgnoreErrors   bool     `json:"ignore_errors"`
+	Settle         string   `json:"settle"`
+	FlapCount      int      `json:"flap_count"`
+	FlapWindow     string   `json:"flap_window"`
+	StateFile      string   `json:"state_file"`
+	Startup        string   `json:"startup"`
+	Journal        string   `json:"journal"`
+	JournalMaxSize int64    `json:"journal_max_size"`
+	JournalKeep    int      `json:"journal_keep"`
+	Source         string   `json:"source"`
+	Lenient        bool     `json:"lenient"`
+	StopTimeout    string   `json:"stop_timeout"`
+	Listen         string   `json:"listen"`
+	ReadRetries    int      `json:"read_retries"`
+	StaleAfter     string   `json:"stale_after"`
+	StuckAfter     string   `json:"stuck_after"`
+
+	MaxParallel int                 `json:"max_parallel"`
+	MinReplicas map[string]int      `json:"min_replicas"`
+	Expected    map[string]Expected `json:"expected"`
+	DriftGrace  string              `json:"drift_grace"`
+	Groups      []GroupConfig       `json:"groups"`
+	Failover    []FailoverConfig    `json:"failover"`
+
+	// present holds the keys that are in the file, so that false and
+	// zero can be told from missing
+	present map[string]bool
+}
+
+// GroupConfig lists the resources in a Group.  Resources are named
+// the same way they are passed to commands: "r0", "r1", etc.
+type GroupConfig struct {
+	Name      string   `json:"name"`
+	Resources []string `json:"resources"`
+}
+
+// FailoverConfig describes a FailoverGroup
+type FailoverConfig struct {
+	Name  string       `json:"name"`
+	Units []UnitConfig `json:"units"`
+}
+
+// UnitConfig describes a Unit
+type UnitConfig struct {
+	Name     string   `json:"name"`
+	Resource string   `json:"resource"`
+	Mount    string   `json:"mount"`
+	Service  string   `json:"service"`
+	After    []string `json:"after"`
+}
+
+// LoadConfig reads a JSON configuration file
+func LoadConfig(filename string) (*Config, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %s", filename)
+	}
+	var c Config
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s", filename)
+	}
+	var keys map[string]json.RawMessage
+	err = json.Unmarshal(b, &keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s", filename)
+	}
+	c.present = make(map[string]bool, len(keys))
+	for key := range keys {
+		c.present[strings.ToLower(key)] = true
+	}
+	return &c, nil
+}
+
+// Has reports whether the file sets key, like "ignore_errors", even
+// to false or zero
+func (c *Config) Has(key string) bool {
+	return c.present[key]
+}
+
+// Apply copies the configuration into Options
+func (c *Config) Apply(o *Options) error {
+	o.MaxParallel = c.MaxParallel
+	for name, n := range c.MinReplicas {
+		if n < 0 {
+			return errors.Errorf("min_replicas for %s must not be negative", name)
+		}
+	}
+	o.MinReplicas = c.MinReplicas
+	o.Expected = c.Expected
+	o.DriftGrace = 0
+	if c.DriftGrace != "" {
+		grace, err := time.ParseDuration(c.DriftGrace)
+		if err != nil || grace < 0 {
+			return errors.Errorf("invalid drift_grace '%s'", c.DriftGrace)
+		}
+		o.DriftGrace = grace
+	}
+	o.Groups = nil
+	seen := make(map[int]string)
+	for _, gc := range c.Groups {
+		g := Group{Name: gc.Name}
+		for _, name := range gc.Resources {
+			r, err := ParseResource(name)
+			if err != nil {
+				return errors.Wrapf(err, "group %s", gc.Name)
+			}
+			if other, ok := seen[r]; ok {
+				return errors.Errorf("resource %s is in both group %s and group %s", name, other, gc.Name)
+			}
+			seen[r] = gc.Name
+			g.Resources = append(g.Resources, r)
+		}
+		o.Groups = append(o.Groups, g)
+	}
+	o.Failover = nil
+	for _, fc := range c.Failover {
+		fg := FailoverGroup{Name: fc.Name}
+		for _, uc := range fc.Units {
+			fg.Units = append(fg.Units, Unit{
+				Name:     uc.Name,
+				Resource: uc.Resource,
+				Mount:    uc.Mount,
+				Service:  uc.Service,
+				After:    uc.After,
+			})
+		}
+		plan, err := fg.Plan()
+		if err != nil {
+			return err
+		}
+		// resources in a failover group are scheduled as a group
+		g := Group{Name: fc.Name}
+		for _, u := range plan {
+			if u.Resource == "" {
+				continue
+			}
+			r, err := ParseResource(u.Resource)
+			if err != nil {
+				return errors.Wrapf(err, "failover group %s", fc.Name)
+			}
+			if other, ok := seen[r]; ok {
+				return errors.Errorf("resource %s is in both group %s and failover group %s", u.Resource, other, fc.Name)
+			}
+			seen[r] = fc.Name
+			g.Resources = append(g.Resources, r)
+		}
+		o.Groups = append(o.Groups, g)
+		o.Failover = append(o.Failover, fg)
+	}
+	return nil
+}
+
+// ParseResource turns a resource name like "r0" into its number
+func ParseResource(name string) (int, error) {
+	r, err := strconv.Atoi(strings.TrimPrefix(name, "r"))
+	if err != nil || r < 0 {
+		return 0, errors.Errorf("invalid resource name '%s', expecting r0, r1, etc", name)
+	}
+	return r, nil
+}
@@ -0,0 +1,71 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	filename := dir + "/config.json"
+	writeFile(t, filename, `{
+		"max_parallel": 1,
+		"min_replicas": { "r0": 2 },
+		"expected": { "r0": { "role": "Primary", "connection": "Connected" } },
+		"drift_grace": "30s",
+		"groups": [
+			{ "name": "pg", "resources": [ "r1", "r0" ] }
+		]
+	}`)
+	c, err := LoadConfig(filename)
+	require.NoError(t, err, "load")
+	var o Options
+	require.NoError(t, c.Apply(&o), "apply")
+	assert.Equal(t, 1, o.MaxParallel, "max parallel")
+	assert.Equal(t, map[string]int{"r0": 2}, o.MinReplicas, "min replicas")
+	assert.Equal(t, []Group{{Name: "pg", Resources: []int{1, 0}}}, o.Groups, "groups")
+	assert.Equal(t, map[string]Expected{"r0": {Role: "Primary", Connection: "Connected"}}, o.Expected, "expected")
+	assert.Equal(t, 30*time.Second, o.DriftGrace, "drift grace")
+	assert.True(t, c.Has("max_parallel"), "has max parallel")
+	assert.False(t, c.Has("ignore_errors"), "has ignore errors")
+
+	writeFile(t, filename, `{ "ignore_errors": false, "Journal_Keep": 0 }`)
+	c, err = LoadConfig(filename)
+	require.NoError(t, err, "load false and zero")
+	assert.True(t, c.Has("ignore_errors"), "false is set")
+	assert.True(t, c.Has("journal_keep"), "zero is set")
+	assert.False(t, c.Has("max_parallel"), "missing")
+
+	writeFile(t, filename, `{ "drift_grace": "soon" }`)
+	c, err = LoadConfig(filename)
+	require.NoError(t, err, "load drift grace")
+	assert.Error(t, c.Apply(&o), "invalid drift grace")
+
+	writeFile(t, filename, `{ "groups": [ { "name": "a", "resources": [ "r0" ] }, { "name": "b", "resources": [ "r0" ] } ] }`)
+	c, err = LoadConfig(filename)
+	require.NoError(t, err, "load duplicate")
+	assert.Error(t, c.Apply(&o), "resource in two groups")
+
+	writeFile(t, filename, `{
+		"groups": [ { "name": "pg", "resources": [ "r1", "r0" ] } ],
+		"failover": [ { "name": "web", "units": [
+			{ "name": "nginx", "service": "nginx", "after": [ "www" ] },
+			{ "name": "www", "resource": "r2", "mount": "/var/www" }
+		] } ]
+	}`)
+	c, err = LoadConfig(filename)
+	require.NoError(t, err, "load failover")
+	require.NoError(t, c.Apply(&o), "apply failover")
+	assert.Equal(t, []Group{{Name: "pg", Resources: []int{1, 0}}, {Name: "web", Resources: []int{2}}}, o.Groups, "failover groups are scheduled as groups")
+	require.Len(t, o.Failover, 1, "failover")
+	assert.Len(t, o.Failover[0].Units, 2, "failover units")
+
+	writeFile(t, filename, `{ "max_paralel": 1 }`)
+	_, err = LoadConfig(filename)
+	assert.Error(t, err, "misspelled key")
+}
@@ -0,0 +1,179 @@
+package drbd
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStopped is returned by React, Invoke, and RunCommandOnChange
+// once they have been stopped with Control.Stop
+var ErrStopped = errors.New("stopped")
+
+// Control stops, reloads, and inspects a running watcher.  Pass it
+// in Options.Control to React, Invoke, or RunCommandOnChange.
+type Control struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu          sync.Mutex
+	states      States
+	reload      func(Options, []string)
+	pending     func() []string
+	health      func(*Health)
+	minReplicas map[string]int
+	reloaded    bool
+	clock       Clock
+	started     time.Time
+	lastRead    time.Time
+	readErrors  int
+	lastError   string
+}
+
+// NewControl returns a Control for one watcher
+func NewControl() *Control {
+	return &Control{stop: make(chan struct{})}
+}
+
+// Stop makes the watcher stop reading DRBD state.  Changes that
+// haven't been dispatched are dropped, and the Options.StateFile is
+// rewritten with the states from before them.  Invoke and RunCommandOnChange
+// wait up to Options.StopTimeout for the callbacks that are running
+// before they return.
+func (c *Control) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// Reload replaces the rules of a running Invoke or RunCommandOnChange:
+// Settle, FlapCount, FlapWindow, MaxParallel, Groups, Failover,
+// MinReplicas, Expected, and DriftGrace.  The other options only take
+// effect on restart.  command, if it isn't empty, replaces the command
+// run by RunCommandOnChange.  The states that have been seen are kept
+// so nothing is dispatched just because of the reload.
+func (c *Control) Reload(o Options, command []string) error {
+	err := o.Validate()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reload == nil {
+		return errors.New("the watcher is not running")
+	}
+	c.minReplicas = o.MinReplicas
+	c.reloaded = true
+	c.reload(o, command)
+	return nil
+}
+
+// Dump describes the state of each resource, as last seen, and the
+// changes that have not yet been handled
+func (c *Control) Dump() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	minors := make([]int, 0, len(c.states))
+	for r := range c.states {
+		minors = append(minors, r)
+	}
+	sort.Ints(minors)
+	lines := make([]string, 0, len(minors))
+	for _, r := range minors {
+		s := c.states[r]
+		lines = append(lines, "r"+strconv.Itoa(r)+" state: "+s.Connection+" "+
+			s.SelfRole+"/"+s.RemoteRole+" "+s.SelfDisk+"/"+s.RemoteDisk)
+	}
+	if c.pending != nil {
+		lines = append(lines, c.pending()...)
+	}
+	return lines
+}
+
+// stopped is closed by Stop.  It is nil, and never closed, without
+// a Control.
+func (c *Control) stopped() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.stop
+}
+
+func (c *Control) isStopped() bool {
+	select {
+	case <-c.stopped():
+		return true
+	default:
+		return false
+	}
+}
+
+// seen records the states for Dump
+func (c *Control) seen(states States) {
+	if c == nil {
+		return
+	}
+	copied := make(States, len(states))
+	for r, s := range states {
+		copied[r] = s
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = copied
+}
+
+// running registers a running Invoke's reload, pending, and health
+// functions
+func (c *Control) running(reload func(Options, []string), pending func() []string, health func(*Health)) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reload = reload
+	c.pending = pending
+	c.health = health
+}
+
+// minReplicasFor is MinReplicas from the last Reload, if any
+func (o Options) minReplicasFor(name string) int {
+	if c := o.Control; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.reloaded {
+			return c.minReplicas[name]
+		}
+	}
+	return o.MinReplicas[name]
+}
+
+// withRules returns o with the options that Reload replaces taken from n
+func (o Options) withRules(n Options) Options {
+	o.Settle = n.Settle
+	o.FlapCount = n.FlapCount
+	o.FlapWindow = n.FlapWindow
+	o.MaxParallel = n.MaxParallel
+	o.Groups = n.Groups
+	o.Failover = n.Failover
+	o.MinReplicas = n.MinReplicas
+	o.Expected = n.Expected
+	o.DriftGrace = n.DriftGrace
+	return o
+}
+
+// sleep is like Clock.Sleep but returns early, with false, if the
+// watcher is stopped
+func (o Options) sleep(d time.Duration) bool {
+	woke := make(chan struct{})
+	timer := o.clock().AfterFunc(d, func() { close(woke) })
+	select {
+	case <-woke:
+		return true
+	case <-o.Control.stopped():
+		timer.Stop()
+		return false
+	}
+}
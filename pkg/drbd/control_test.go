@@ -0,0 +1,122 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlStop(t *testing.T) {
+	b := newBlockingCallback()
+	c := NewControl()
+	w := newMemWatcher(Options{Control: c, MaxParallel: 1}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.Invoke(b.callback)
+	})
+	assert.Equal(t, []int{0}, b.startedAfter(1), "initial")
+	w.change(exampleProcDRBD2)
+
+	// three states, one running, and three queued
+	var dump []string
+	for i := 0; i < 50 && len(dump) < 7; i++ {
+		time.Sleep(napTime / 10)
+		dump = c.Dump()
+	}
+	assert.Contains(t, dump, "r0 state: SyncSource Primary/Secondary UpToDate/Inconsistent", "state")
+	assert.Contains(t, dump, "r0 running", "running")
+	assert.Contains(t, dump, "r1 queued: Connection:->SyncSource; Role:/->Primary/Secondary; Disk:/->UpToDate/Inconsistent", "queued")
+
+	c.Stop()
+	select {
+	case err := <-w.errs:
+		t.Fatalf("stopped before the callback returned: %v", err)
+	case <-time.After(napTime):
+	}
+	close(b.release)
+	select {
+	case err := <-w.errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+	assert.Equal(t, []int{0}, b.startedAfter(1), "queued changes dropped")
+}
+
+func TestControlStopTimeout(t *testing.T) {
+	b := newBlockingCallback()
+	defer close(b.release)
+	c := NewControl()
+	w := newMemWatcher(Options{Control: c, StopTimeout: time.Minute}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.Invoke(b.callback)
+	})
+	assert.Equal(t, []int{0}, b.startedAfter(1), "initial")
+	c.Stop()
+	// keep advancing until the stop timeout has been set
+	for i := 0; i < 50; i++ {
+		w.clock.Advance(time.Minute)
+		select {
+		case err := <-w.errs:
+			assert.EqualError(t, err, "stopped with 1 commands still running after 1m0s", "timed out")
+			return
+		case <-time.After(napTime / 10):
+		}
+	}
+	t.Fatal("watcher did not stop")
+}
+
+func TestControlReload(t *testing.T) {
+	assert.Error(t, NewControl().Reload(Options{}, nil), "not running")
+
+	deltas := make(chan Delta, 10)
+	c := NewControl()
+	w := newMemWatcher(Options{Control: c}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.Invoke(func(delta Delta) error {
+			deltas <- delta
+			return nil
+		})
+	})
+	select {
+	case delta := <-deltas:
+		assert.Equal(t, 0, delta.Resource, "initial")
+	case <-time.After(napTime * 10):
+		t.Fatal("no initial delta")
+	}
+
+	assert.Error(t, c.Reload(Options{Settle: -time.Second}, nil), "invalid")
+	require.NoError(t, c.Reload(Options{Settle: time.Minute, MinReplicas: map[string]int{"r0": 2}}, nil), "reload")
+	w.change(exampleProcDRBD1)
+	w.change(exampleProcDRBD2)
+	select {
+	case delta := <-deltas:
+		t.Fatalf("r%d dispatched before it settled", delta.Resource)
+	case <-time.After(napTime):
+	}
+	w.clock.Advance(time.Minute)
+	got := make(map[int]Delta)
+	for len(got) < 3 {
+		select {
+		case delta := <-deltas:
+			got[delta.Resource] = delta
+		case <-time.After(napTime * 10):
+			t.Fatalf("only %d deltas after settling", len(got))
+		}
+	}
+	assert.Equal(t, State{Connection: "WFConnection", SelfRole: "Secondary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"},
+		got[0].Old, "states kept across the reload")
+	assert.Equal(t, 2, got[0].MinReplicas, "reloaded min replicas")
+
+	c.Stop()
+	select {
+	case err := <-w.errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+}
@@ -0,0 +1,221 @@
+package drbd
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// debouncer sits between React and the dispatching of deltas.  It
+// holds changes back until they have persisted for the settle time
+// and it collapses a resource that keeps changing into a single
+// flapping Delta.  next is called with the debouncer locked so it
+// must not block.  Deltas that aren't passed on right away are
+// recorded in the journal as suppressed.
+type debouncer struct {
+	settle     time.Duration
+	flapCount  int
+	flapWindow time.Duration
+	next       func(Delta)
+	clock      Clock
+	journal    *Journal
+
+	mu        sync.Mutex
+	resources map[int]*settling
+}
+
+// settling is the debounce state of one resource
+type settling struct {
+	pending    *Delta
+	timer      Timer
+	generation int
+	changes    []time.Time // recent transitions, for flap detection
+	flapping   bool
+	flapFrom   Delta // the change that started the flapping
+	current    State
+	lastDelta  Delta
+}
+
+func newDebouncer(o Options, next func(Delta)) *debouncer {
+	return &debouncer{
+		settle:     o.Settle,
+		flapCount:  o.FlapCount,
+		flapWindow: o.FlapWindow,
+		next:       next,
+		clock:      o.clock(),
+		journal:    o.Journal,
+		resources:  make(map[int]*settling),
+	}
+}
+
+// configure replaces the settle and flap settings.  Changes that are
+// already settling keep their timers.
+func (d *debouncer) configure(o Options) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.settle = o.Settle
+	d.flapCount = o.FlapCount
+	d.flapWindow = o.FlapWindow
+}
+
+// pending describes the changes that are settling and the resources
+// that are flapping, for Control.Dump
+func (d *debouncer) pending() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	resources := make([]int, 0, len(d.resources))
+	for r := range d.resources {
+		resources = append(resources, r)
+	}
+	sort.Ints(resources)
+	var lines []string
+	for _, resource := range resources {
+		r := d.resources[resource]
+		switch {
+		case r.flapping:
+			lines = append(lines, "r"+strconv.Itoa(resource)+" flapping since: "+StateDiff(r.current, r.flapFrom.Old))
+		case r.pending != nil:
+			lines = append(lines, "r"+strconv.Itoa(resource)+" settling: "+StateDiff(r.pending.New, r.pending.Old))
+		}
+	}
+	return lines
+}
+
+// stop cancels the timers and returns the changes that were still
+// settling, or that a flapping resource made without settling back
+func (d *debouncer) stop() []Delta {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var held []Delta
+	for _, r := range d.resources {
+		r.stopTimer()
+		switch {
+		case r.flapping && !r.current.Equal(r.flapFrom.Old):
+			held = append(held, r.lastDelta.since(r.flapFrom))
+		case r.pending != nil:
+			held = append(held, *r.pending)
+		}
+	}
+	d.resources = make(map[int]*settling)
+	return held
+}
+
+// callback is suitable for passing to React
+func (d *debouncer) callback(delta Delta) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.settle == 0 && d.flapCount == 0 && len(d.resources) == 0 {
+		d.next(delta)
+		return nil
+	}
+	r, ok := d.resources[delta.Resource]
+	if !ok {
+		r = &settling{}
+		d.resources[delta.Resource] = r
+	}
+	seen := delta
+	now := d.clock.Now()
+	r.current = delta.New
+	r.lastDelta = delta
+	if d.flapCount > 0 {
+		r.changes = append(r.changes, now)
+		for len(r.changes) > 0 && now.Sub(r.changes[0]) > d.flapWindow {
+			r.changes = r.changes[1:]
+		}
+	}
+
+	if r.flapping {
+		// stay suppressed until the resource has been quiet for flapWindow
+		d.startTimer(delta.Resource, r, d.flapWindow, d.quiet)
+		d.journal.Suppressed(seen)
+		return nil
+	}
+
+	if d.flapCount > 0 && len(r.changes) >= d.flapCount {
+		r.flapping = true
+		r.flapFrom = delta
+		if r.pending != nil {
+			r.flapFrom = *r.pending
+			r.pending = nil
+		}
+		flap := delta.since(r.flapFrom)
+		flap.Flapping = true
+		d.startTimer(delta.Resource, r, d.flapWindow, d.quiet)
+		d.next(flap)
+		return nil
+	}
+
+	if d.settle == 0 {
+		if r.pending != nil {
+			// settling was turned off by a reload
+			delta = delta.since(*r.pending)
+			r.pending = nil
+			r.stopTimer()
+		}
+		d.next(delta)
+		return nil
+	}
+
+	if r.pending != nil {
+		delta = delta.since(*r.pending)
+	}
+	if delta.unchanged() {
+		// the change reverted before it settled
+		r.pending = nil
+		r.stopTimer()
+		d.journal.Suppressed(seen)
+		return nil
+	}
+	r.pending = &delta
+	d.startTimer(delta.Resource, r, d.settle, d.settled)
+	d.journal.Suppressed(seen)
+	return nil
+}
+
+// startTimer (re)starts the one timer that a resource has.  A
+// generation count guards against a timer that fires after it
+// has been replaced.
+func (d *debouncer) startTimer(resource int, r *settling, wait time.Duration, fire func(int, *settling)) {
+	r.stopTimer()
+	generation := r.generation
+	r.timer = d.clock.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if r.generation != generation {
+			return
+		}
+		r.timer = nil
+		fire(resource, r)
+	})
+}
+
+func (r *settling) stopTimer() {
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// settled is called with d.mu held
+func (d *debouncer) settled(resource int, r *settling) {
+	if r.pending == nil {
+		return
+	}
+	delta := *r.pending
+	r.pending = nil
+	d.next(delta)
+}
+
+// quiet is called with d.mu held, once a flapping resource has
+// stopped changing.  If it ended up somewhere other than where
+// it started, that's a change.
+func (d *debouncer) quiet(resource int, r *settling) {
+	r.flapping = false
+	r.changes = nil
+	if r.current.Equal(r.flapFrom.Old) {
+		return
+	}
+	d.next(r.lastDelta.since(r.flapFrom))
+}
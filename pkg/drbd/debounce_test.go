@@ -0,0 +1,89 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	stateConnected    = State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}
+	stateDisconnected = State{Connection: "WFConnection", SelfRole: "Primary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}
+)
+
+func collectDeltas() (chan Delta, func(Delta)) {
+	c := make(chan Delta, 10)
+	return c, func(d Delta) { c <- d }
+}
+
+func noDelta(t *testing.T, c chan Delta, wait time.Duration) {
+	select {
+	case d := <-c:
+		t.Fatalf("unexpected delta %+v", d)
+	case <-time.After(wait):
+	}
+}
+
+func nextDelta(t *testing.T, c chan Delta, wait time.Duration) Delta {
+	select {
+	case d := <-c:
+		return d
+	case <-time.After(wait):
+		t.Fatalf("no delta after %s", wait)
+	}
+	return Delta{}
+}
+
+func TestSettle(t *testing.T) {
+	c, next := collectDeltas()
+	clock := NewManualClock(testStart)
+	d := newDebouncer(Options{Settle: time.Second, Clock: clock}, next)
+
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateConnected, New: stateDisconnected}))
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateDisconnected, New: stateConnected}))
+	clock.Advance(2 * time.Second)
+	assert.Empty(t, c, "reverted change")
+
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateConnected, New: stateDisconnected}))
+	clock.Advance(time.Second / 2)
+	assert.Empty(t, c, "not settled yet")
+	clock.Advance(time.Second / 2)
+	require.Len(t, c, 1, "settled")
+	got := <-c
+	assert.Equal(t, stateConnected, got.Old, "old")
+	assert.Equal(t, stateDisconnected, got.New, "new")
+	assert.False(t, got.Flapping, "flapping")
+}
+
+func TestFlapping(t *testing.T) {
+	c, next := collectDeltas()
+	clock := NewManualClock(testStart)
+	d := newDebouncer(Options{FlapCount: 3, FlapWindow: time.Second, Clock: clock}, next)
+
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateConnected, New: stateDisconnected}))
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateDisconnected, New: stateConnected}))
+	require.Len(t, c, 2, "first changes")
+	assert.False(t, (<-c).Flapping, "first change")
+	assert.False(t, (<-c).Flapping, "second change")
+
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateConnected, New: stateDisconnected}))
+	require.Len(t, c, 1, "third change")
+	got := <-c
+	assert.True(t, got.Flapping, "third change")
+	assert.Equal(t, stateConnected, got.Old, "old")
+
+	clock.Advance(time.Second / 2)
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateDisconnected, New: stateConnected}))
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateConnected, New: stateDisconnected}))
+	clock.Advance(time.Second / 2)
+	assert.Empty(t, c, "still flapping")
+
+	clock.Advance(time.Second / 2)
+	require.Len(t, c, 1, "quiet")
+	got = <-c
+	assert.False(t, got.Flapping, "after quiet")
+	assert.Equal(t, stateConnected, got.Old, "old after quiet")
+	assert.Equal(t, stateDisconnected, got.New, "new after quiet")
+}
@@ -0,0 +1,216 @@
+package drbd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Expected is the steady state that a resource should be in.  Empty
+// fields aren't checked.
+type Expected struct {
+	Role       string `json:"role"`
+	PeerRole   string `json:"peer_role"`
+	Disk       string `json:"disk"`
+	PeerDisk   string `json:"peer_disk"`
+	Connection string `json:"connection"`
+}
+
+// Diff describes how s differs from what is expected, for example
+// "role is Secondary, not Primary"
+func (e Expected) Diff(s State) []string {
+	var drift []string
+	check := func(name, want, is string) {
+		if want == "" || want == is {
+			return
+		}
+		if is == "" {
+			is = "unknown"
+		}
+		drift = append(drift, name+" is "+is+", not "+want)
+	}
+	check("role", e.Role, s.SelfRole)
+	check("peer role", e.PeerRole, s.RemoteRole)
+	check("disk", e.Disk, s.SelfDisk)
+	check("peer disk", e.PeerDisk, s.RemoteDisk)
+	check("connection", e.Connection, s.Connection)
+	return drift
+}
+
+// driftDetector compares every Delta from React, and every read, with
+// Options.Expected.  A resource that stays away from its expected
+// state, or missing, for DriftGrace is reported with a Drifted Delta,
+// and once it is back, with a Converged Delta.  next is called with
+// the detector locked so it must not block.
+type driftDetector struct {
+	expected map[string]Expected
+	grace    time.Duration
+	next     func(Delta)
+	clock    Clock
+
+	mu        sync.Mutex
+	resources map[int]*drifting
+}
+
+// drifting is the drift state of one resource
+type drifting struct {
+	last       Delta
+	drift      []string
+	reported   bool
+	timer      Timer
+	generation int
+}
+
+func newDriftDetector(o Options, next func(Delta)) *driftDetector {
+	return &driftDetector{
+		expected:  o.Expected,
+		grace:     o.DriftGrace,
+		next:      next,
+		clock:     o.clock(),
+		resources: make(map[int]*drifting),
+	}
+}
+
+// observe is called with every Delta from React
+func (d *driftDetector) observe(delta Delta) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.check(delta)
+}
+
+// polled is called with every read.  It starts tracking the resources
+// that no Delta has been seen for, which is all of them with
+// StartupNone, and the expected resources that don't exist.  A missing
+// resource is numbered by its name, like r3, or else with a negative
+// number.
+func (d *driftDetector) polled(rs Resources) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock.Now()
+	tracked := make(map[string]bool)
+	for resource, r := range d.resources {
+		if _, ok := rs[r.last.Name]; ok && r.last.New.Equal(State{}) && resource < 0 {
+			// missing, and now it's here under its minor
+			r.stopTimer()
+			delete(d.resources, resource)
+			if r.reported {
+				r.drift = nil
+				d.report(r, false)
+			}
+			continue
+		}
+		tracked[r.last.Name] = true
+	}
+	for minor, state := range rs.States() {
+		name, volume, _ := rs.locate(minor)
+		if _, ok := d.resources[minor]; ok {
+			continue
+		}
+		if _, ok := d.expected[name]; !ok {
+			continue
+		}
+		dev, replicas := rs[name].Devices[volume], rs[name].Replicas(volume)
+		d.check(Delta{Resource: minor, Name: name, Volume: volume, Old: state, New: state,
+			OldQuorum: dev.Quorum, NewQuorum: dev.Quorum, OldReplicas: replicas, NewReplicas: replicas, Seen: now})
+	}
+	names := make([]string, 0, len(d.expected))
+	for name := range d.expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if _, ok := rs[name]; ok || tracked[name] {
+			continue
+		}
+		resource, err := ParseResource(name)
+		if err != nil {
+			resource = -1 - i
+		}
+		d.check(Delta{Resource: resource, Name: name, Seen: now})
+	}
+}
+
+// check is observe with d.mu held
+func (d *driftDetector) check(delta Delta) {
+	expected, ok := d.expected[delta.Name]
+	if !ok {
+		return
+	}
+	r, ok := d.resources[delta.Resource]
+	if !ok {
+		r = &drifting{}
+		d.resources[delta.Resource] = r
+	}
+	r.last = delta
+	r.drift = expected.Diff(delta.New)
+	if delta.New.Equal(State{}) {
+		r.drift = []string{"resource is missing"}
+	}
+	switch {
+	case len(r.drift) == 0:
+		r.stopTimer()
+		if r.reported {
+			r.reported = false
+			d.report(r, false)
+		}
+	case r.reported || r.timer != nil:
+		// already reported, or waiting for the grace period
+	case d.grace <= 0:
+		r.reported = true
+		d.report(r, true)
+	default:
+		generation := r.generation
+		r.timer = d.clock.AfterFunc(d.grace, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if r.generation != generation {
+				return
+			}
+			r.timer = nil
+			r.reported = true
+			d.report(r, true)
+		})
+	}
+}
+
+// configure replaces the expected states and the grace period.
+// Resources that are no longer expected to be in any state are
+// forgotten without being reported as Converged.
+func (d *driftDetector) configure(o Options) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expected = o.Expected
+	d.grace = o.DriftGrace
+	for resource, r := range d.resources {
+		if _, ok := d.expected[r.last.Name]; !ok {
+			r.stopTimer()
+			delete(d.resources, resource)
+		}
+	}
+}
+
+func (r *drifting) stopTimer() {
+	r.generation++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+// report sends a Delta without a state change.  It is called with
+// d.mu held.
+func (d *driftDetector) report(r *drifting, drifted bool) {
+	now := d.clock.Now()
+	delta := r.last
+	delta.Old = delta.New
+	delta.OldQuorum = delta.NewQuorum
+	delta.OldReplicas = delta.NewReplicas
+	delta.Changes = nil
+	delta.UnchangedFor = now.Sub(delta.Seen)
+	delta.Seen = now
+	delta.Flapping = false
+	delta.Drifted = drifted
+	delta.Converged = !drifted
+	delta.Drift = r.drift
+	d.next(delta)
+}
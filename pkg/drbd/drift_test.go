@@ -0,0 +1,145 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectedDiff(t *testing.T) {
+	e := Expected{Role: "Primary", PeerRole: "Secondary", Disk: "UpToDate", PeerDisk: "UpToDate", Connection: "Connected"}
+	assert.Empty(t, e.Diff(stateConnected), "as expected")
+	assert.Equal(t, []string{"peer role is Unknown, not Secondary", "peer disk is DUnknown, not UpToDate", "connection is WFConnection, not Connected"},
+		e.Diff(stateDisconnected), "disconnected")
+	assert.Equal(t, []string{"role is unknown, not Primary"}, Expected{Role: "Primary"}.Diff(State{}), "gone")
+}
+
+func TestDriftDetector(t *testing.T) {
+	clock := NewManualClock(testStart)
+	var got []Delta
+	d := newDriftDetector(Options{
+		Expected:   map[string]Expected{"pgdata": {Role: "Primary", Connection: "Connected"}},
+		DriftGrace: time.Minute,
+		Clock:      clock,
+	}, func(delta Delta) {
+		got = append(got, delta)
+	})
+	observe := func(old, new State) {
+		d.observe(Delta{Resource: 3, Name: "pgdata", Old: old, New: new, Seen: clock.Now()})
+	}
+
+	observe(State{}, stateConnected)
+	d.observe(Delta{Resource: 4, Name: "other", New: stateDisconnected})
+	clock.Advance(time.Hour)
+	assert.Empty(t, got, "as expected")
+
+	// a blip shorter than the grace period isn't reported
+	observe(stateConnected, stateDisconnected)
+	clock.Advance(time.Minute / 2)
+	observe(stateDisconnected, stateConnected)
+	clock.Advance(time.Minute)
+	assert.Empty(t, got, "blip")
+
+	observe(stateConnected, stateDisconnected)
+	clock.Advance(time.Minute / 2)
+	secondary := stateDisconnected
+	secondary.SelfRole = "Secondary"
+	observe(stateDisconnected, secondary)
+	clock.Advance(time.Minute / 2)
+	require.Len(t, got, 1, "drifted")
+	assert.True(t, got[0].Drifted, "drifted")
+	assert.Equal(t, secondary, got[0].Old, "no state change")
+	assert.Equal(t, secondary, got[0].New, "current state")
+	assert.Equal(t, []string{"role is Secondary, not Primary", "connection is WFConnection, not Connected"}, got[0].Drift, "drift")
+	assert.Equal(t, []Event{EventDrifted}, Classify(got[0]), "event")
+
+	// still drifting, but already reported
+	observe(secondary, stateDisconnected)
+	clock.Advance(time.Hour)
+	assert.Len(t, got, 1, "reported once")
+
+	observe(stateDisconnected, stateConnected)
+	require.Len(t, got, 2, "converged")
+	assert.True(t, got[1].Converged, "converged")
+	assert.Empty(t, got[1].Drift, "no drift")
+	assert.Equal(t, []Event{EventConverged}, Classify(got[1]), "event")
+}
+
+func TestDriftPolled(t *testing.T) {
+	clock := NewManualClock(testStart)
+	var got []Delta
+	d := newDriftDetector(Options{
+		Expected:   map[string]Expected{"r3": {Role: "Primary"}, "r4": {Role: "Primary"}, "pgdata": {}},
+		DriftGrace: time.Minute,
+		Clock:      clock,
+	}, func(delta Delta) {
+		got = append(got, delta)
+	})
+	secondary := stateConnected
+	secondary.SelfRole = "Secondary"
+
+	// wrong from the start, and never changing
+	d.polled(statesToResources(States{3: secondary, 4: stateConnected}, nil))
+	clock.Advance(time.Minute / 2)
+	d.polled(statesToResources(States{3: secondary, 4: stateConnected}, nil))
+	assert.Empty(t, got, "grace period")
+	clock.Advance(time.Minute / 2)
+	require.Len(t, got, 2, "drifted and missing")
+	byName := make(map[string]Delta)
+	for _, delta := range got {
+		byName[delta.Name] = delta
+	}
+	assert.True(t, byName["r3"].Drifted, "drifted")
+	assert.Equal(t, 3, byName["r3"].Resource, "minor")
+	assert.Equal(t, []string{"role is Secondary, not Primary"}, byName["r3"].Drift, "drift")
+	assert.True(t, byName["pgdata"].Drifted, "missing")
+	assert.True(t, byName["pgdata"].Resource < 0, "no minor")
+	assert.Equal(t, []string{"resource is missing"}, byName["pgdata"].Drift, "missing")
+
+	// pgdata appears, as expected
+	rs := statesToResources(States{3: secondary, 4: stateConnected}, nil)
+	rs["pgdata"] = Resource{Name: "pgdata", Devices: map[int]Device{0: {Minor: 5, Disk: "UpToDate"}}}
+	d.polled(rs)
+	require.Len(t, got, 3, "converged")
+	assert.True(t, got[2].Converged, "converged")
+	assert.Equal(t, "pgdata", got[2].Name, "converged")
+	clock.Advance(time.Hour)
+	d.polled(rs)
+	assert.Len(t, got, 3, "reported once")
+}
+
+// TestDriftStartupNone reports a resource that is wrong from the start
+// even though nothing is dispatched for it
+func TestDriftStartupNone(t *testing.T) {
+	secondary := stateConnected
+	secondary.SelfRole = "Secondary"
+	got := make(chan Delta, 10)
+	w := newMemWatcher(Options{
+		Startup:  StartupNone,
+		Expected: map[string]Expected{"r0": {Role: "Primary"}, "r9": {}},
+	}, map[string]string{
+		"/proc/drbd": RenderProcDRBD(States{0: secondary}),
+	}, func(o Options) error {
+		return o.Invoke(func(delta Delta) error {
+			got <- delta
+			return nil
+		})
+	})
+	drifted := make(map[string][]string)
+	for len(drifted) < 2 {
+		select {
+		case delta := <-got:
+			assert.True(t, delta.Drifted, "drifted %s", delta.Name)
+			drifted[delta.Name] = delta.Drift
+		case <-time.After(napTime * 10):
+			t.Fatalf("drift not reported: %v", drifted)
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"r0": {"role is Secondary, not Primary"},
+		"r9": {"resource is missing"},
+	}, drifted, "drift")
+	w.stop(t)
+}
@@ -0,0 +1,121 @@
+package drbd
+
+import (
+	"strings"
+)
+
+// Event is a classification of a Delta
+type Event string
+
+const (
+	EventAppeared     Event = "Appeared"     // the resource is new
+	EventDisappeared  Event = "Disappeared"  // the resource is gone
+	EventConnected    Event = "Connected"    // connected to the peer
+	EventDisconnected Event = "Disconnected" // no longer connected to the peer
+	EventSyncStarted  Event = "SyncStarted"  // resync started
+	EventSyncFinished Event = "SyncFinished" // resync finished
+	EventPromoted     Event = "Promoted"     // this node became Primary
+	EventDemoted      Event = "Demoted"      // this node is no longer Primary
+	EventPeerPromoted Event = "PeerPromoted" // the peer became Primary
+	EventPeerDemoted  Event = "PeerDemoted"  // the peer is no longer Primary
+	EventDiskDegraded Event = "DiskDegraded" // the local disk is no longer UpToDate
+	EventDiskUpToDate Event = "DiskUpToDate" // the local disk became UpToDate
+	EventPeerDegraded Event = "PeerDegraded" // the peer's disk is no longer UpToDate
+	EventPeerUpToDate Event = "PeerUpToDate" // the peer's disk became UpToDate
+	EventStandAlone   Event = "StandAlone"   // not trying to connect, often after a split brain
+	EventFlapping     Event = "Flapping"     // see Delta.Flapping
+
+	EventResourceConfigured   Event = "ResourceConfigured"   // an unconfigured minor became a resource
+	EventResourceUnconfigured Event = "ResourceUnconfigured" // the resource was taken down, leaving the minor
+	EventDetached             Event = "Detached"             // the local disk was detached
+	EventAttached             Event = "Attached"             // a disk was attached to a diskless device
+	EventQuorumLost           Event = "QuorumLost"           // this node lost quorum (DRBD 9)
+	EventQuorumRegained       Event = "QuorumRegained"       // this node has quorum again (DRBD 9)
+	EventReplicaCountBelow    Event = "ReplicaCountBelow"    // fewer than Delta.MinReplicas UpToDate copies
+	EventDrifted              Event = "Drifted"              // away from the expected state for longer than the grace period
+	EventConverged            Event = "Converged"            // back in the expected state after drifting
+)
+
+// connected returns true for connection states where the peers
+// are talking to each other
+func connected(cs string) bool {
+	return cs == "Connected" || syncing(cs) || strings.HasPrefix(cs, "Verify") ||
+		cs == "Ahead" || cs == "Behind" || strings.HasPrefix(cs, "WFBitMap") ||
+		cs == "WFSyncUUID" || strings.HasPrefix(cs, "StartingSync")
+}
+
+func syncing(cs string) bool {
+	return strings.HasPrefix(cs, "Sync") || strings.HasPrefix(cs, "PausedSync")
+}
+
+// eventList separates events with spaces, as in $EVENTS
+func eventList(events []Event) string {
+	names := make([]string, len(events))
+	for i, e := range events {
+		names[i] = string(e)
+	}
+	return strings.Join(names, " ")
+}
+
+// Classify describes a Delta as a list of events
+func Classify(d Delta) []Event {
+	var events []Event
+	add := func(e Event) {
+		events = append(events, e)
+	}
+	empty := State{}
+	switch {
+	case d.Old.Equal(empty) && !d.New.Equal(empty):
+		add(EventAppeared)
+	case !d.Old.Equal(empty) && d.New.Equal(empty):
+		add(EventDisappeared)
+		return events
+	case d.New.Unconfigured() && !d.Old.Unconfigured():
+		add(EventResourceUnconfigured)
+		return events
+	case d.Old.Unconfigured() && !d.New.Unconfigured():
+		add(EventResourceConfigured)
+	}
+	if d.Flapping {
+		add(EventFlapping)
+	}
+	if d.Drifted {
+		add(EventDrifted)
+	}
+	if d.Converged {
+		add(EventConverged)
+	}
+	transition := func(was, is bool, on, off Event) {
+		switch {
+		case !was && is:
+			add(on)
+		case was && !is:
+			add(off)
+		}
+	}
+	transition(connected(d.Old.Connection), connected(d.New.Connection), EventConnected, EventDisconnected)
+	transition(syncing(d.Old.Connection), syncing(d.New.Connection), EventSyncStarted, EventSyncFinished)
+	if d.New.Connection == "StandAlone" && d.Old.Connection != "StandAlone" {
+		add(EventStandAlone)
+	}
+	transition(d.Old.SelfRole == "Primary", d.New.SelfRole == "Primary", EventPromoted, EventDemoted)
+	transition(d.Old.RemoteRole == "Primary", d.New.RemoteRole == "Primary", EventPeerPromoted, EventPeerDemoted)
+	transition(d.Old.SelfDisk == "UpToDate", d.New.SelfDisk == "UpToDate", EventDiskUpToDate, EventDiskDegraded)
+	transition(d.Old.RemoteDisk == "UpToDate", d.New.RemoteDisk == "UpToDate", EventPeerUpToDate, EventPeerDegraded)
+	switch {
+	case d.Old.attached() && d.New.Diskless() && !d.New.Client:
+		add(EventDetached)
+	case d.Old.Diskless() && !d.Old.Client && d.New.attached():
+		add(EventAttached)
+	}
+	switch {
+	case d.OldQuorum == "yes" && d.NewQuorum == "no":
+		add(EventQuorumLost)
+	case d.OldQuorum == "no" && d.NewQuorum == "yes":
+		add(EventQuorumRegained)
+	}
+	if d.NewReplicas < d.MinReplicas && (d.OldReplicas >= d.MinReplicas || d.Old.Equal(empty)) {
+		add(EventReplicaCountBelow)
+	}
+	return events
+}
@@ -0,0 +1,202 @@
+package drbd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// This is example output from "drbdsetup events2 --timestamps" (DRBD 9)
+// 2019-05-14T11:56:21.378817+02:00 exists resource name:r0 role:Secondary suspended:no
+// 2019-05-14T11:56:21.378817+02:00 exists connection name:r0 peer-node-id:1 conn-name:alpha connection:Connected role:Primary
+// 2019-05-14T11:56:21.378817+02:00 exists device name:r0 volume:0 minor:0 disk:UpToDate client:no quorum:yes
+// 2019-05-14T11:56:21.378817+02:00 exists peer-device name:r0 peer-node-id:1 conn-name:alpha volume:0 replication:Established peer-disk:UpToDate
+// 2019-05-14T11:56:21.378817+02:00 exists -
+// 2019-05-14T11:57:02.120317+02:00 change resource name:r0 role:Primary
+
+// Events2 tracks DRBD state from "drbdsetup events2" lines
+type Events2 struct {
+	resources Resources
+}
+
+// NewEvents2 returns an empty Events2
+func NewEvents2() *Events2 {
+	return &Events2{resources: make(Resources)}
+}
+
+// Apply updates the state with one line of "drbdsetup events2" output.
+// The timestamp, if the line has one, is returned.  changed is true
+// when the line completes a change: a create, change, or destroy, or
+// the end of the initial state ("exists -").
+func (e *Events2) Apply(line string) (ts time.Time, changed bool, err error) {
+	words := strings.Fields(line)
+	if len(words) > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, words[0]); err == nil {
+			ts = t
+			words = words[1:]
+		}
+	}
+	if len(words) < 2 {
+		return ts, false, nil
+	}
+	verb, object := words[0], words[1]
+	switch verb {
+	case "exists":
+		changed = object == "-"
+	case "create", "change", "destroy":
+		changed = true
+	case "call", "response":
+		return ts, false, nil
+	default:
+		return ts, false, errors.Errorf("unexpected events2 line: %s", line)
+	}
+	fields := make(map[string]string)
+	for _, w := range words[2:] {
+		kv := strings.SplitN(w, ":", 2)
+		if len(kv) != 2 {
+			return ts, false, errors.Errorf("unexpected events2 field '%s' in: %s", w, line)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	name := fields["name"]
+	if name == "" {
+		if object == "-" {
+			return ts, changed, nil
+		}
+		return ts, false, errors.Errorf("events2 line without a name: %s", line)
+	}
+	r, ok := e.resources[name]
+	if !ok {
+		if verb == "destroy" {
+			return ts, changed, nil
+		}
+		r = Resource{
+			Name:        name,
+			Devices:     make(map[int]Device),
+			Connections: make(map[int]Connection),
+		}
+		e.resources[name] = r
+	}
+	number := func(key string) (int, error) {
+		n, err := strconv.Atoi(fields[key])
+		return n, errors.Wrapf(err, "events2 %s in: %s", key, line)
+	}
+	switch object {
+	case "resource":
+		if verb == "destroy" {
+			delete(e.resources, name)
+			return ts, changed, nil
+		}
+		set(&r.Role, fields, "role")
+		e.resources[name] = r
+	case "connection":
+		id, err := number("peer-node-id")
+		if err != nil {
+			return ts, false, err
+		}
+		if verb == "destroy" {
+			delete(r.Connections, id)
+			return ts, changed, nil
+		}
+		c, ok := r.Connections[id]
+		if !ok {
+			c = Connection{PeerRole: "Unknown", PeerDevices: make(map[int]PeerDevice)}
+		}
+		set(&c.Name, fields, "conn-name")
+		set(&c.Connection, fields, "connection")
+		set(&c.PeerRole, fields, "role")
+		r.Connections[id] = c
+	case "device":
+		volume, err := number("volume")
+		if err != nil {
+			return ts, false, err
+		}
+		if verb == "destroy" {
+			delete(r.Devices, volume)
+			return ts, changed, nil
+		}
+		d, ok := r.Devices[volume]
+		if !ok {
+			d = Device{Minor: -1}
+		}
+		if _, ok := fields["minor"]; ok {
+			d.Minor, err = number("minor")
+			if err != nil {
+				return ts, false, err
+			}
+		}
+		set(&d.Disk, fields, "disk")
+		set(&d.Quorum, fields, "quorum")
+		if client, ok := fields["client"]; ok {
+			d.Client = client == "yes"
+		}
+		r.Devices[volume] = d
+	case "peer-device":
+		id, err := number("peer-node-id")
+		if err != nil {
+			return ts, false, err
+		}
+		volume, err := number("volume")
+		if err != nil {
+			return ts, false, err
+		}
+		c, ok := r.Connections[id]
+		if !ok {
+			// peer devices are created after, and destroyed
+			// before, their connection
+			return ts, changed, nil
+		}
+		if verb == "destroy" {
+			delete(c.PeerDevices, volume)
+			return ts, changed, nil
+		}
+		pd, ok := c.PeerDevices[volume]
+		if !ok {
+			pd = PeerDevice{PeerDisk: "DUnknown"}
+		}
+		set(&pd.Replication, fields, "replication")
+		set(&pd.PeerDisk, fields, "peer-disk")
+		c.PeerDevices[volume] = pd
+	}
+	// other objects, eg "path" or "helper", are ignored
+	return ts, changed, nil
+}
+
+// set copies fields[key], if present, to *into
+func set(into *string, fields map[string]string, key string) {
+	if v, ok := fields[key]; ok {
+		*into = v
+	}
+}
+
+// connectionNames maps DRBD 9 names to the DRBD 8.4 names used in /proc/drbd
+var connectionNames = map[string]string{
+	"Connecting":  "WFConnection",
+	"Established": "Connected",
+	"Off":         "Connected",
+}
+
+func connectionName(s string) string {
+	if n, ok := connectionNames[s]; ok {
+		return n
+	}
+	return s
+}
+
+// Resources returns a copy of the current state
+func (e *Events2) Resources() Resources {
+	rs := make(Resources, len(e.resources))
+	for name, r := range e.resources {
+		rs[name] = r.copy()
+	}
+	return rs
+}
+
+// States returns the state of each device, by minor number, as
+// /proc/drbd would show it.  DRBD 9 can have more than one peer:
+// only the peer with the lowest node id is used.
+func (e *Events2) States() States {
+	return e.resources.States()
+}
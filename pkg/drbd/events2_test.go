@@ -0,0 +1,56 @@
+package drbd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exampleEvents2 = `2019-05-14T11:56:21.378817+02:00 exists resource name:r0 role:Secondary suspended:no
+2019-05-14T11:56:21.378817+02:00 exists connection name:r0 peer-node-id:2 conn-name:beta connection:Connecting role:Unknown
+2019-05-14T11:56:21.378817+02:00 exists connection name:r0 peer-node-id:1 conn-name:alpha connection:Connected role:Primary
+2019-05-14T11:56:21.378817+02:00 exists device name:r0 volume:0 minor:0 disk:UpToDate client:no quorum:yes
+2019-05-14T11:56:21.378817+02:00 exists peer-device name:r0 peer-node-id:1 conn-name:alpha volume:0 replication:Established peer-disk:UpToDate
+2019-05-14T11:56:21.378817+02:00 exists -
+2019-05-14T11:57:02.120317+02:00 change connection name:r0 peer-node-id:1 conn-name:alpha role:Secondary
+2019-05-14T11:57:02.220317+02:00 change resource name:r0 role:Primary
+2019-05-14T11:58:00.000000+02:00 change peer-device name:r0 peer-node-id:1 conn-name:alpha volume:0 replication:SyncSource peer-disk:Inconsistent
+2019-05-14T11:59:00.000000+02:00 destroy connection name:r0 peer-node-id:1 conn-name:alpha
+2019-05-14T11:59:00.000000+02:00 call helper name:r0 helper:before-resync-target
+`
+
+func TestEvents2(t *testing.T) {
+	e := NewEvents2()
+	var changes []States
+	for _, line := range strings.Split(strings.TrimSpace(exampleEvents2), "\n") {
+		_, changed, err := e.Apply(line)
+		require.NoError(t, err, line)
+		if changed {
+			changes = append(changes, e.States())
+		}
+	}
+	require.Len(t, changes, 5, "changes")
+	assert.Equal(t, State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}, changes[0][0], "initial")
+	assert.Equal(t, State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}, changes[2][0], "failover")
+	assert.Equal(t, "SyncSource", changes[3][0].Connection, "sync")
+	assert.Equal(t, "Inconsistent", changes[3][0].RemoteDisk, "sync")
+	assert.Equal(t, State{Connection: "WFConnection", SelfRole: "Primary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}, changes[4][0], "lost alpha, beta remains")
+
+	rs := e.Resources()
+	require.Contains(t, rs, "r0", "resources")
+	assert.Equal(t, Resource{
+		Name:    "r0",
+		Role:    "Primary",
+		Devices: map[int]Device{0: {Minor: 0, Disk: "UpToDate", Quorum: "yes"}},
+		Connections: map[int]Connection{
+			2: {Name: "beta", Connection: "Connecting", PeerRole: "Unknown", PeerDevices: map[int]PeerDevice{}},
+		},
+	}, rs["r0"], "resources")
+	rs["r0"].Devices[0] = Device{Disk: "Diskless"}
+	assert.Equal(t, "UpToDate", e.Resources()["r0"].Devices[0].Disk, "copied")
+
+	_, _, err := e.Apply("frobnicate resource name:r0")
+	assert.Error(t, err, "bad verb")
+}
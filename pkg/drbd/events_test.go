@@ -0,0 +1,59 @@
+package drbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	syncSource := State{Connection: "SyncSource", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "Inconsistent"}
+	secondary := State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}
+	standAlone := State{Connection: "StandAlone", SelfRole: "Primary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}
+	unconfigured := State{Connection: "Unconfigured"}
+	diskless := State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "Diskless", RemoteDisk: "UpToDate"}
+	client := diskless
+	client.Client = true
+
+	cases := []struct {
+		name  string
+		delta Delta
+		want  []Event
+	}{
+		{"new", Delta{New: stateConnected}, []Event{EventAppeared, EventConnected, EventPromoted, EventDiskUpToDate, EventPeerUpToDate}},
+		{"gone", Delta{Old: stateConnected}, []Event{EventDisappeared}},
+		{"disconnect", Delta{Old: stateConnected, New: stateDisconnected}, []Event{EventDisconnected, EventPeerDegraded}},
+		{"sync", Delta{Old: stateDisconnected, New: syncSource}, []Event{EventConnected, EventSyncStarted}},
+		{"synced", Delta{Old: syncSource, New: stateConnected}, []Event{EventSyncFinished, EventPeerUpToDate}},
+		{"failover", Delta{Old: stateConnected, New: secondary}, []Event{EventDemoted, EventPeerPromoted}},
+		{"split brain", Delta{Old: stateDisconnected, New: standAlone}, []Event{EventStandAlone}},
+		{"unconfigured", Delta{Old: stateConnected, New: unconfigured}, []Event{EventResourceUnconfigured}},
+		{"configured", Delta{Old: unconfigured, New: secondary}, []Event{EventResourceConfigured, EventConnected, EventPeerPromoted, EventDiskUpToDate, EventPeerUpToDate}},
+		{"new minor", Delta{New: unconfigured}, []Event{EventAppeared}},
+		{"diskless client", Delta{New: diskless}, []Event{EventAppeared, EventConnected, EventPromoted, EventPeerUpToDate}},
+		{"detached", Delta{Old: stateConnected, New: diskless}, []Event{EventDiskDegraded, EventDetached}},
+		{"attached", Delta{Old: diskless, New: stateConnected}, []Event{EventDiskUpToDate, EventAttached}},
+		{"made a client", Delta{Old: stateConnected, New: client}, []Event{EventDiskDegraded}},
+		{"client given a disk", Delta{Old: client, New: stateConnected}, []Event{EventDiskUpToDate}},
+		{"quorum lost", Delta{Old: stateConnected, New: stateConnected, OldQuorum: "yes", NewQuorum: "no"}, []Event{EventQuorumLost}},
+		{"quorum regained", Delta{Old: stateConnected, New: stateConnected, OldQuorum: "no", NewQuorum: "yes"}, []Event{EventQuorumRegained}},
+		{"quorum unknown", Delta{Old: stateConnected, New: stateConnected, NewQuorum: "yes"}, nil},
+		{"replicas below", Delta{Old: stateConnected, New: stateDisconnected, OldReplicas: 2, NewReplicas: 1, MinReplicas: 2}, []Event{EventDisconnected, EventPeerDegraded, EventReplicaCountBelow}},
+		{"replicas still below", Delta{Old: stateDisconnected, New: stateDisconnected, OldReplicas: 1, NewReplicas: 1, MinReplicas: 2}, nil},
+		{"new, replicas below", Delta{New: unconfigured, MinReplicas: 2}, []Event{EventAppeared, EventReplicaCountBelow}},
+		{"flapping", Delta{Old: stateConnected, New: stateDisconnected, Flapping: true}, []Event{EventFlapping, EventDisconnected, EventPeerDegraded}},
+		{"drifted", Delta{Old: secondary, New: secondary, Drifted: true}, []Event{EventDrifted}},
+		{"converged", Delta{Old: stateConnected, New: stateConnected, Converged: true}, []Event{EventConverged}},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, Classify(tc.delta), tc.name)
+	}
+}
+
+func TestStateKinds(t *testing.T) {
+	assert.True(t, State{Connection: "Unconfigured"}.Unconfigured(), "unconfigured")
+	assert.False(t, stateConnected.Unconfigured(), "configured")
+	assert.True(t, State{SelfDisk: "Diskless"}.Diskless(), "diskless")
+	assert.False(t, stateConnected.Diskless(), "attached")
+	assert.True(t, State{RemoteDisk: "Diskless"}.PeerDiskless(), "peer diskless")
+}
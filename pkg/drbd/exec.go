@@ -30,20 +30,57 @@ import (
 //	OLD_REMOTE_DISK="DUnknown" # prior remote disk sate
 //	ALL_MOUNTS="/my/file/system" # all filesystems, mounted or not that mount on /dev/drbd0
 //	STABLE_SECONDS="9999" # seconds since last change in this resource state
+//	CONNECTION_STABLE_SECONDS="9999" # seconds the prior connection state lasted
+//	ROLE_STABLE_SECONDS="9999" # seconds the prior roles lasted
+//	DISK_STABLE_SECONDS="9999" # seconds the prior disk states lasted
+//	FLAPPING="false" # true if the resource is changing too often
+//	RESOURCE_NAME="r0" # the DRBD resource
+//	VOLUME="0" # the volume of the resource
+//	CHANGED_PEERS="alpha beta" # peers whose connection or peer disk changed
+//	CHANGED_VOLUMES="0" # volumes whose disk or peer disk changed
+//	CHANGES="r0 alpha connection:Connected->Connecting" # everything that changed, separated by "; "
+//	QUORUM="yes" # whether this node has quorum, empty before DRBD 9
+//	OLD_QUORUM="yes" # prior quorum
+//	UP_TO_DATE_REPLICAS="2" # UpToDate copies of the volume, here and on peers
+//	OLD_UP_TO_DATE_REPLICAS="3" # prior UpToDate copies
+//	MAYBE_MISSED="false" # true if the state was read late; false doesn't mean nothing was missed
+//	DRIFTED="false" # true if the resource has been away from its expected state for the grace period
+//	CONVERGED="false" # true if the resource is back in its expected state
+//	DRIFT="role is Secondary, not Primary" # how it differs from the expected state, separated by "; "
+//	EVENTS="QuorumLost ReplicaCountBelow" # what the change is classified as, separated by spaces
+//	CLIENT="false" # true for an intentionally diskless DRBD 9 client
 //
 // nap is how long to wait between checking for changes in state
 // if bailOnError is true, then errors returned by commands or parsing /etc/fstab
 // will cause RunCommandOnChange to return.
 func RunCommandOnChange(nap time.Duration, bailOnError bool, command []string) error {
-	return runCommandOnChange("/proc/drbd", nap, bailOnError, command, "/etc/fstab", "/proc/mounts")
+	return Options{Nap: nap}.RunCommandOnChange(bailOnError, command)
 }
 
-func runCommandOnChange(filename string, nap time.Duration, bailOnError bool, command []string, fstab string, procMounts string) error {
+// RunCommandOnChange is like the RunCommandOnChange function but
+// uses Options.Invoke.
+func (o Options) RunCommandOnChange(bailOnError bool, command []string) error {
 	if len(command) == 0 {
 		return errors.New("a command is required")
 	}
-	return Invoke(filename, nap, func(delta Delta) error {
-		fsMounts, err := GetMounts(delta.Resource, fstab)
+	f := &Failover{Run: o.Run, IgnoreErrors: !bailOnError}
+	rebuild := func(n Options, newCommand []string) func(Delta) error {
+		if len(newCommand) > 0 {
+			command = newCommand
+		}
+		f.setGroups(n.Failover)
+		return n.commandCallback(bailOnError, command, f)
+	}
+	return o.invoke(rebuild(o, nil), rebuild)
+}
+
+// commandCallback runs command and, if there are Failover groups,
+// has f handle them first
+func (o Options) commandCallback(bailOnError bool, command []string, f *Failover) func(Delta) error {
+	fstab := o.fstab()
+	procMounts := o.procMounts()
+	callback := func(delta Delta) error {
+		fsMounts, err := o.GetMounts(delta.Resource, fstab)
 		var mountPoint string
 		if err != nil {
 			if bailOnError {
@@ -55,7 +92,7 @@ func runCommandOnChange(filename string, nap time.Duration, bailOnError bool, co
 			sort.Strings(fsMounts)
 			mountPoint = fsMounts[0]
 		}
-		liveMounts, _ := GetMounts(delta.Resource, procMounts)
+		liveMounts, _ := o.GetMounts(delta.Resource, procMounts)
 		allMounts := make(map[string]struct{})
 		for _, m := range fsMounts {
 			allMounts[m] = struct{}{}
@@ -69,10 +106,20 @@ func runCommandOnChange(filename string, nap time.Duration, bailOnError bool, co
 		}
 		sort.Strings(mountList)
 
+		name := delta.Name
+		if name == "" {
+			name = "r" + strconv.Itoa(delta.Resource)
+		}
+		volumes := delta.ChangedVolumes()
+		changedVolumes := make([]string, len(volumes))
+		for i, v := range volumes {
+			changedVolumes[i] = strconv.Itoa(v)
+		}
+
 		args := make([]string, len(command)-1, len(command)+6)
 		copy(args, command[1:])
 		args = append(args,
-			"r"+strconv.Itoa(delta.Resource),
+			name,
 			delta.New.Connection,
 			delta.New.SelfRole,
 			delta.New.RemoteRole,
@@ -94,8 +141,32 @@ func runCommandOnChange(filename string, nap time.Duration, bailOnError bool, co
 			"OLD_REMOTE_DISK="+delta.Old.RemoteDisk,
 			"ALL_MOUNTS="+strings.Join(mountList, " "),
 			"STABLE_SECONDS="+strconv.Itoa(int(delta.UnchangedFor.Seconds())),
+			"CONNECTION_STABLE_SECONDS="+strconv.Itoa(int(delta.ConnectionStable().Seconds())),
+			"ROLE_STABLE_SECONDS="+strconv.Itoa(int(delta.RoleStable().Seconds())),
+			"DISK_STABLE_SECONDS="+strconv.Itoa(int(delta.DiskStable().Seconds())),
+			"FLAPPING="+strconv.FormatBool(delta.Flapping),
+			"RESOURCE_NAME="+name,
+			"VOLUME="+strconv.Itoa(delta.Volume),
+			"CHANGED_PEERS="+strings.Join(delta.ChangedPeers(), " "),
+			"CHANGED_VOLUMES="+strings.Join(changedVolumes, " "),
+			"CHANGES="+describeChanges(delta.Changes),
+			"QUORUM="+delta.NewQuorum,
+			"OLD_QUORUM="+delta.OldQuorum,
+			"UP_TO_DATE_REPLICAS="+strconv.Itoa(delta.NewReplicas),
+			"OLD_UP_TO_DATE_REPLICAS="+strconv.Itoa(delta.OldReplicas),
+			"MAYBE_MISSED="+strconv.FormatBool(delta.MaybeMissed),
+			"DRIFTED="+strconv.FormatBool(delta.Drifted),
+			"CONVERGED="+strconv.FormatBool(delta.Converged),
+			"DRIFT="+strings.Join(delta.Drift, "; "),
+			"EVENTS="+eventList(Classify(delta)),
+			"CLIENT="+strconv.FormatBool(delta.New.Client),
 		)
+		started := o.clock().Now()
 		err = cmd.Run()
+		o.journalHook(delta, cmd, o.clock().Now().Sub(started), err)
+		if o.CommandDone != nil {
+			o.CommandDone(delta, cmd, err)
+		}
 		if err != nil {
 			log.Printf("exec %s failed: %s", cmd.String(), err)
 			if bailOnError {
@@ -103,5 +174,29 @@ func runCommandOnChange(filename string, nap time.Duration, bailOnError bool, co
 			}
 		}
 		return nil
-	})
+	}
+	if len(o.Failover) > 0 {
+		callback = f.Callback(callback)
+	}
+	return callback
+}
+
+func (o Options) journalHook(delta Delta, cmd *exec.Cmd, duration time.Duration, err error) {
+	if o.Journal == nil {
+		return
+	}
+	r := Record{
+		Time:     o.clock().Now(),
+		Type:     RecordHook,
+		Resource: delta.Resource,
+		Command:  cmd.Args,
+		Seconds:  duration.Seconds(),
+	}
+	if cmd.ProcessState != nil {
+		r.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	o.Journal.log(o.Journal.Write(r))
 }
@@ -2,10 +2,12 @@ package drbd
 
 import (
 	"os"
+	"os/exec"
 	"testing"
 	"time"
 
 	"github.com/Flaque/filet"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -20,31 +22,105 @@ func TestTransitions(t *testing.T) {
 
 	dir := filet.TmpDir(t, "")
 
-	procDRBD := dir + "/proc-drbd"
-
-	fstab := dir + "/etc-fstab"
-	writeFile(t, fstab, exampleFstab)
-
-	procMounts := dir + "/proc-mounts"
-	writeFile(t, procMounts, exampleProcMounts)
-
 	shellOut := dir + "/shell.env"
 
 	require.NoError(t, os.Setenv("DRBD_TEST_OUTPUT", shellOut))
 
-	go runCommandOnChange(procDRBD, napTime/20, true, []string{cwd + "/test.sh", "foo"}, fstab, procMounts)
-
-	noFile(t, shellOut, napTime)
-
-	writeFile(t, procDRBD, exampleProcDRBD1)
-
-	waitForFile(t, shellOut, napTime)
+	done := make(chan error, 10)
+	w := newMemWatcher(Options{
+		CommandDone: func(_ Delta, _ *exec.Cmd, err error) {
+			done <- err
+		},
+	}, map[string]string{
+		"/etc/fstab":   exampleFstab,
+		"/proc/mounts": exampleProcMounts,
+	}, func(o Options) error {
+		return o.RunCommandOnChange(true, []string{cwd + "/test.sh", "foo"})
+	})
+
+	// noCommand gives the watcher another nap and a moment to run a
+	// command that it shouldn't
+	noCommand := func(what string) {
+		w.clock.Advance(w.o.Nap)
+		w.clock.BlockUntil(1)
+		select {
+		case err := <-done:
+			t.Fatalf("command ran %s: %v", what, err)
+		case <-time.After(napTime):
+		}
+	}
+	noCommand("without /proc/drbd")
+
+	w.change(exampleProcDRBD1)
+
+	select {
+	case err := <-done:
+		require.NoError(t, err, "command")
+	case <-time.After(napTime * 10):
+		t.Fatal("command did not run")
+	}
 	firstLine, env := readOutput(t, shellOut)
 
 	assert.Equal(t, "foo r0 WFConnection Secondary Unknown UpToDate DUnknown /r0", firstLine, "summary line")
 	envValue(t, env, "OLD_CONNECTED_STATE", "")
+	envValue(t, env, "FLAPPING", "false")
+	envValue(t, env, "STABLE_SECONDS", "2")
+	envValue(t, env, "ROLE_STABLE_SECONDS", "2")
+	envValue(t, env, "RESOURCE_NAME", "r0")
+	envValue(t, env, "VOLUME", "0")
+	envValue(t, env, "CHANGED_PEERS", "1")
+	envValue(t, env, "CHANGED_VOLUMES", "0")
+	envValue(t, env, "QUORUM", "")
+	envValue(t, env, "UP_TO_DATE_REPLICAS", "1")
+	envValue(t, env, "MAYBE_MISSED", "false")
+	envValue(t, env, "DRIFTED", "false")
+	envValue(t, env, "EVENTS", "Appeared DiskUpToDate")
+	envValue(t, env, "CLIENT", "false")
+
+	w.change(exampleProcDRBD1)
+	noCommand("without a change")
+	w.stop(t)
+}
 
-	remove(t, shellOut)
-	noFile(t, shellOut, napTime)
-
+func TestFailoverErrors(t *testing.T) {
+	secondary := stateConnected
+	secondary.SelfRole = "Secondary"
+	primary := stateConnected
+	primary.SelfRole = "Primary"
+	for _, bail := range []bool{false, true} {
+		done := make(chan error, 10)
+		w := newMemWatcher(Options{
+			Run:      func(string, ...string) error { return errors.New("no mount") },
+			Failover: []FailoverGroup{{Name: "web", Units: []Unit{{Name: "r0", Resource: "r0", Mount: "/r0"}}}},
+			CommandDone: func(_ Delta, _ *exec.Cmd, err error) {
+				done <- err
+			},
+		}, map[string]string{
+			"/proc/drbd":   RenderProcDRBD(States{0: secondary}),
+			"/etc/fstab":   exampleFstab,
+			"/proc/mounts": exampleProcMounts,
+		}, func(o Options) error {
+			return o.RunCommandOnChange(bail, []string{"true"})
+		})
+		for _, what := range []string{"startup", "promoted"} {
+			select {
+			case err := <-done:
+				require.NoError(t, err, "command after %s", what)
+			case <-time.After(napTime * 10):
+				t.Fatalf("command did not run after %s", what)
+			}
+			// the resource was promoted by someone else
+			w.change(RenderProcDRBD(States{0: primary}))
+		}
+		if !bail {
+			w.stop(t)
+			continue
+		}
+		select {
+		case err := <-w.errs:
+			assert.Error(t, err, "failover failed")
+		case <-time.After(napTime * 10):
+			t.Fatal("watcher did not stop")
+		}
+	}
 }
@@ -0,0 +1,437 @@
+package drbd
+
+import (
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Runner runs an external command.  It's a parameter so that
+// tests do not need drbdadm, mount, or systemctl.
+type Runner func(name string, args ...string) error
+
+// ExecRunner runs commands with os/exec
+func ExecRunner(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Unit is one member of a FailoverGroup: a DRBD resource to promote
+// and perhaps mount, or a service to start, or both.
+type Unit struct {
+	Name string
+	// Resource is the DRBD resource name, eg "r0"
+	Resource string
+	// Mount is a mount point listed in /etc/fstab
+	Mount string
+	// Service is a systemd service
+	Service string
+	// After lists the names of units that must be up before this one
+	After []string
+}
+
+// FailoverGroup is a set of units that are brought up, in dependency
+// order, when any of its resources becomes Primary and torn down, in
+// reverse order, when any of its resources becomes Secondary.
+type FailoverGroup struct {
+	Name  string
+	Units []Unit
+}
+
+// Plan returns the units in the order they should be brought up
+func (g FailoverGroup) Plan() ([]Unit, error) {
+	byName := make(map[string]Unit)
+	for _, u := range g.Units {
+		if _, ok := byName[u.Name]; ok {
+			return nil, errors.Errorf("group %s: unit %s is listed twice", g.Name, u.Name)
+		}
+		byName[u.Name] = u
+	}
+	for _, u := range g.Units {
+		for _, a := range u.After {
+			if _, ok := byName[a]; !ok {
+				return nil, errors.Errorf("group %s: unit %s is after %s, which is not in the group", g.Name, u.Name, a)
+			}
+		}
+	}
+	done := make(map[string]bool)
+	plan := make([]Unit, 0, len(g.Units))
+	for len(plan) < len(g.Units) {
+		progress := false
+		for _, u := range g.Units {
+			if done[u.Name] {
+				continue
+			}
+			ready := true
+			for _, a := range u.After {
+				if !done[a] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[u.Name] = true
+				plan = append(plan, u)
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, errors.Errorf("group %s has a dependency cycle", g.Name)
+		}
+	}
+	return plan, nil
+}
+
+// Step is one action taken on a unit
+type Step struct {
+	Unit    string
+	Command []string
+	Err     error
+}
+
+// Report describes what happened when a group was brought up or torn down
+type Report struct {
+	Group string
+	Up    bool
+	Steps []Step
+	// RolledBack are the steps taken to undo a failed bring-up
+	RolledBack []Step
+}
+
+// Err returns an error describing the failed steps, if any
+func (r Report) Err() error {
+	var failed []string
+	for _, s := range append(r.Steps, r.RolledBack...) {
+		if s.Err != nil {
+			failed = append(failed, s.Err.Error())
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	direction := "down"
+	if r.Up {
+		direction = "up"
+	}
+	return errors.Errorf("group %s %s: %s", r.Group, direction, strings.Join(failed, "; "))
+}
+
+// Failover orchestrates FailoverGroups
+type Failover struct {
+	Groups []FailoverGroup
+	Run    Runner
+	// IgnoreErrors makes Callback log a group's failures rather than
+	// return them
+	IgnoreErrors bool
+
+	// mu is only held while the fields below are read or updated,
+	// never while commands run
+	mu     sync.Mutex
+	up     map[string]bool        // group name -> currently up
+	roles  map[int]string         // resource -> role, as last seen
+	groups map[string]*sync.Mutex // group name -> held while its commands run
+}
+
+// change is one step of bringing a unit up, and how to undo it
+type change struct {
+	up, down []string
+	// resource is set for promotions, which are checked against the
+	// roles that have been seen
+	resource string
+	// check succeeds if the unit is already up
+	check []string
+}
+
+func changes(u Unit) []change {
+	var c []change
+	if u.Resource != "" {
+		c = append(c, change{
+			up:       []string{"drbdadm", "primary", u.Resource},
+			down:     []string{"drbdadm", "secondary", u.Resource},
+			resource: u.Resource,
+		})
+	}
+	if u.Mount != "" {
+		c = append(c, change{
+			up:    []string{"mount", u.Mount},
+			down:  []string{"umount", u.Mount},
+			check: []string{"mountpoint", "-q", u.Mount},
+		})
+	}
+	if u.Service != "" {
+		c = append(c, change{
+			up:    []string{"systemctl", "start", u.Service},
+			down:  []string{"systemctl", "stop", u.Service},
+			check: []string{"systemctl", "is-active", "--quiet", u.Service},
+		})
+	}
+	return c
+}
+
+func (f *Failover) run(unit string, command []string) Step {
+	return Step{
+		Unit:    unit,
+		Command: command,
+		Err:     f.runner()(command[0], command[1:]...),
+	}
+}
+
+func (f *Failover) runner() Runner {
+	if f.Run == nil {
+		return ExecRunner
+	}
+	return f.Run
+}
+
+// done reports whether c has already been made, or undone if up is
+// false.  A resource whose role hasn't been seen is neither.
+func (f *Failover) done(c change, up bool) bool {
+	if c.resource != "" {
+		want := "Secondary"
+		if up {
+			want = "Primary"
+		}
+		r, err := ParseResource(c.resource)
+		if err != nil {
+			return false
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.roles[r] == want
+	}
+	return (f.runner()(c.check[0], c.check[1:]...) == nil) == up
+}
+
+// setRole records a resource's role after it has been changed
+func (f *Failover) setRole(c change, role string) {
+	if r, err := ParseResource(c.resource); err == nil {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.roles == nil {
+			f.roles = make(map[int]string)
+		}
+		f.roles[r] = role
+	}
+}
+
+// Up brings a group up in dependency order, skipping the steps that
+// have already been taken: resources that are Primary, mount points
+// that are mounted ("mountpoint -q"), and services that are active
+// ("systemctl is-active").  If a step fails, the steps taken so far
+// are undone in reverse order.
+func (f *Failover) Up(g FailoverGroup) Report {
+	defer f.lockGroup(g.Name)()
+	return f.bringUp(g)
+}
+
+func (f *Failover) bringUp(g FailoverGroup) Report {
+	report := Report{Group: g.Name, Up: true}
+	plan, err := g.Plan()
+	if err != nil {
+		report.Steps = append(report.Steps, Step{Err: err})
+		return report
+	}
+	var undo []change
+	var undoUnits []string
+	for _, u := range plan {
+		for _, c := range changes(u) {
+			if f.done(c, true) {
+				// not ours to undo
+				continue
+			}
+			step := f.run(u.Name, c.up)
+			report.Steps = append(report.Steps, step)
+			if step.Err != nil {
+				for j := len(undo) - 1; j >= 0; j-- {
+					step := f.run(undoUnits[j], undo[j].down)
+					if step.Err == nil {
+						f.setRole(undo[j], "Secondary")
+					}
+					report.RolledBack = append(report.RolledBack, step)
+				}
+				return report
+			}
+			f.setRole(c, "Primary")
+			undo = append(undo, c)
+			undoUnits = append(undoUnits, u.Name)
+		}
+	}
+	return report
+}
+
+// Down tears a group down in reverse dependency order, skipping
+// what is already down.  Failures do not stop the tear down: as much
+// as possible is stopped.
+func (f *Failover) Down(g FailoverGroup) Report {
+	defer f.lockGroup(g.Name)()
+	return f.tearDown(g)
+}
+
+// lockGroup waits until no commands are running for a group and
+// returns the function that lets the next caller in.  Other groups
+// aren't held up.
+func (f *Failover) lockGroup(name string) func() {
+	f.mu.Lock()
+	if f.groups == nil {
+		f.groups = make(map[string]*sync.Mutex)
+	}
+	l, ok := f.groups[name]
+	if !ok {
+		l = &sync.Mutex{}
+		f.groups[name] = l
+	}
+	f.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (f *Failover) tearDown(g FailoverGroup) Report {
+	report := Report{Group: g.Name}
+	plan, err := g.Plan()
+	if err != nil {
+		report.Steps = append(report.Steps, Step{Err: err})
+		return report
+	}
+	for i := len(plan) - 1; i >= 0; i-- {
+		c := changes(plan[i])
+		for j := len(c) - 1; j >= 0; j-- {
+			if f.done(c[j], false) {
+				continue
+			}
+			step := f.run(plan[i].Name, c[j].down)
+			if step.Err == nil {
+				f.setRole(c[j], "Secondary")
+			}
+			report.Steps = append(report.Steps, step)
+		}
+	}
+	return report
+}
+
+// Callback wraps a callback (for Invoke) so that when a resource in
+// a group changes role, the whole group is brought up or torn down
+// before next is called.  Unless IgnoreErrors is set, it returns the
+// group's error, if any, after calling next.
+//
+// The first state seen for a resource, when its old role is unknown,
+// only records whether its group is up: restarting the watcher on a
+// Primary doesn't bring the group up again.
+func (f *Failover) Callback(next func(Delta) error) func(Delta) error {
+	return func(delta Delta) error {
+		report, acted := f.react(delta)
+		err := next(delta)
+		if acted {
+			if rerr := report.Err(); rerr != nil {
+				log.Println(rerr)
+				if err == nil && !f.IgnoreErrors {
+					err = rerr
+				}
+			}
+		}
+		return err
+	}
+}
+
+func (f *Failover) react(delta Delta) (Report, bool) {
+	g, ok := f.group(delta.Resource)
+	if !ok {
+		return Report{}, false
+	}
+	up, ok := f.wanted(g, delta)
+	if !ok {
+		return Report{}, false
+	}
+	defer f.lockGroup(g.Name)()
+	f.mu.Lock()
+	current, ok := f.up[g.Name]
+	f.mu.Unlock()
+	if ok && current == up {
+		// another change did it while this one waited
+		return Report{}, false
+	}
+	var report Report
+	if up {
+		report = f.bringUp(g)
+	} else {
+		report = f.tearDown(g)
+	}
+	f.mu.Lock()
+	f.up[g.Name] = up && report.Err() == nil
+	f.mu.Unlock()
+	return report, true
+}
+
+// wanted records the role in delta and returns whether g should be
+// brought up or torn down.  It returns false if nothing is to be done.
+func (f *Failover) wanted(g FailoverGroup, delta Delta) (bool, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.up == nil {
+		f.up = make(map[string]bool)
+	}
+	if f.roles == nil {
+		f.roles = make(map[int]string)
+	}
+	f.roles[delta.Resource] = delta.New.SelfRole
+	if delta.Old.SelfRole == "" {
+		// the first time the resource has been seen
+		if _, ok := f.up[g.Name]; !ok || delta.New.SelfRole == "Primary" {
+			f.up[g.Name] = delta.New.SelfRole == "Primary"
+		}
+		return false, false
+	}
+	if delta.Old.SelfRole == delta.New.SelfRole {
+		return false, false
+	}
+	var up bool
+	switch delta.New.SelfRole {
+	case "Primary":
+		up = true
+	case "Secondary":
+		up = false
+	default:
+		return false, false
+	}
+	if current, ok := f.up[g.Name]; ok && current == up {
+		// promoting the rest of the group causes more role changes
+		return false, false
+	}
+	return up, true
+}
+
+// setGroups replaces the groups.  Groups that are kept remember
+// whether they are up.
+func (f *Failover) setGroups(groups []FailoverGroup) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Groups = groups
+	kept := make(map[string]bool)
+	for _, g := range groups {
+		if up, ok := f.up[g.Name]; ok {
+			kept[g.Name] = up
+		}
+	}
+	f.up = kept
+}
+
+func (f *Failover) group(resource int) (FailoverGroup, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, g := range f.Groups {
+		for _, u := range g.Units {
+			if u.Resource == "" {
+				continue
+			}
+			if r, err := ParseResource(u.Resource); err == nil && r == resource {
+				return g, true
+			}
+		}
+	}
+	return FailoverGroup{}, false
+}
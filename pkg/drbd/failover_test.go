@@ -0,0 +1,243 @@
+package drbd
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunner records commands and fails the ones listed in fail.
+// It keeps track of what is mounted and started so that "mountpoint"
+// and "systemctl is-active", which aren't recorded, can answer.
+type fakeRunner struct {
+	mu   sync.Mutex
+	ran  []string
+	fail map[string]bool
+	up   map[string]bool // mount point or service -> mounted or active
+}
+
+func (f *fakeRunner) run(name string, args ...string) error {
+	c := strings.Join(append([]string{name}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	last := args[len(args)-1]
+	if name == "mountpoint" || (name == "systemctl" && args[0] == "is-active") {
+		if !f.up[last] {
+			return errors.New("inactive: " + last)
+		}
+		return nil
+	}
+	f.ran = append(f.ran, c)
+	if f.fail[c] {
+		return errors.New("failed: " + c)
+	}
+	if f.up == nil {
+		f.up = make(map[string]bool)
+	}
+	switch {
+	case name == "mount" || (name == "systemctl" && args[0] == "start"):
+		f.up[last] = true
+	case name == "umount" || (name == "systemctl" && args[0] == "stop"):
+		f.up[last] = false
+	}
+	return nil
+}
+
+var exampleFailoverGroup = FailoverGroup{
+	Name: "pg",
+	Units: []Unit{
+		{Name: "app", Service: "myapp", After: []string{"postgresql"}},
+		{Name: "postgresql", Service: "postgresql", After: []string{"pgdata", "pgwal"}},
+		{Name: "pgdata", Resource: "r0", Mount: "/pgdata"},
+		{Name: "pgwal", Resource: "r1", Mount: "/pgwal"},
+	},
+}
+
+func TestFailoverPlan(t *testing.T) {
+	plan, err := exampleFailoverGroup.Plan()
+	require.NoError(t, err, "plan")
+	var names []string
+	for _, u := range plan {
+		names = append(names, u.Name)
+	}
+	assert.Equal(t, []string{"pgdata", "pgwal", "postgresql", "app"}, names, "plan order")
+
+	_, err = FailoverGroup{Name: "loop", Units: []Unit{
+		{Name: "a", After: []string{"b"}},
+		{Name: "b", After: []string{"a"}},
+	}}.Plan()
+	assert.Error(t, err, "cycle")
+
+	_, err = FailoverGroup{Name: "missing", Units: []Unit{{Name: "a", After: []string{"b"}}}}.Plan()
+	assert.Error(t, err, "missing dependency")
+}
+
+func TestFailoverUpDown(t *testing.T) {
+	r := &fakeRunner{}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	report := f.Up(exampleFailoverGroup)
+	require.NoError(t, report.Err(), "up")
+	assert.Equal(t, []string{
+		"drbdadm primary r0",
+		"mount /pgdata",
+		"drbdadm primary r1",
+		"mount /pgwal",
+		"systemctl start postgresql",
+		"systemctl start myapp",
+	}, r.ran, "up commands")
+
+	r.ran = nil
+	r.fail = map[string]bool{"umount /pgwal": true}
+	report = f.Down(exampleFailoverGroup)
+	assert.Error(t, report.Err(), "down with failure")
+	assert.Equal(t, []string{
+		"systemctl stop myapp",
+		"systemctl stop postgresql",
+		"umount /pgwal",
+		"drbdadm secondary r1",
+		"umount /pgdata",
+		"drbdadm secondary r0",
+	}, r.ran, "down continues after failure")
+}
+
+func TestFailoverRollback(t *testing.T) {
+	r := &fakeRunner{fail: map[string]bool{"systemctl start postgresql": true}}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	report := f.Up(exampleFailoverGroup)
+	assert.Error(t, report.Err(), "up fails")
+	assert.Equal(t, []string{
+		"drbdadm primary r0",
+		"mount /pgdata",
+		"drbdadm primary r1",
+		"mount /pgwal",
+		"systemctl start postgresql",
+		"umount /pgwal",
+		"drbdadm secondary r1",
+		"umount /pgdata",
+		"drbdadm secondary r0",
+	}, r.ran, "rolled back")
+	assert.Len(t, report.RolledBack, 4, "rollback steps")
+}
+
+func TestFailoverCallback(t *testing.T) {
+	r := &fakeRunner{}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	var called []int
+	callback := f.Callback(func(delta Delta) error {
+		called = append(called, delta.Resource)
+		return nil
+	})
+	secondary := State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary"}
+	primary := State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary"}
+
+	require.NoError(t, callback(Delta{Resource: 1, Old: secondary, New: primary}), "promote r1")
+	assert.Len(t, r.ran, 5, "group brought up, r1 already primary")
+	require.NoError(t, callback(Delta{Resource: 0, Old: secondary, New: primary}), "r0 promoted by group")
+	assert.Len(t, r.ran, 5, "group already up")
+	require.NoError(t, callback(Delta{Resource: 2, Old: secondary, New: primary}), "not in a group")
+	assert.Len(t, r.ran, 5, "no group")
+	require.NoError(t, callback(Delta{Resource: 0, Old: primary, New: secondary}), "demote r0")
+	assert.Len(t, r.ran, 10, "group torn down, r0 already secondary")
+	assert.Equal(t, []int{1, 0, 2, 0}, called, "callback always called")
+}
+
+func TestFailoverStartup(t *testing.T) {
+	r := &fakeRunner{up: map[string]bool{"/pgdata": true, "/pgwal": true, "postgresql": true, "myapp": true}}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	callback := f.Callback(func(Delta) error { return nil })
+	primary := State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary"}
+
+	// restarting the watcher on a primary that is already up
+	require.NoError(t, callback(Delta{Resource: 0, New: primary}), "r0 first seen")
+	require.NoError(t, callback(Delta{Resource: 1, New: primary}), "r1 first seen")
+	assert.Empty(t, r.ran, "nothing done for the first states")
+
+	// a later promotion only does what hasn't been done
+	r.up["myapp"] = false
+	secondary := State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary"}
+	require.NoError(t, callback(Delta{Resource: 1, Old: primary, New: secondary}), "demote r1")
+	require.NoError(t, callback(Delta{Resource: 1, Old: secondary, New: primary}), "promote r1")
+	assert.Equal(t, []string{
+		"systemctl stop postgresql",
+		"umount /pgwal",
+		"umount /pgdata",
+		"drbdadm secondary r0",
+		"drbdadm primary r0",
+		"mount /pgdata",
+		"mount /pgwal",
+		"systemctl start postgresql",
+		"systemctl start myapp",
+	}, r.ran, "r1 already changed role and myapp was already stopped")
+
+	// a mount that fails is rolled back without touching what was
+	// already up before
+	r = &fakeRunner{up: map[string]bool{"/pgdata": true}, fail: map[string]bool{"mount /pgwal": true}}
+	f = &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	f.roles = map[int]string{0: "Primary"}
+	report := f.Up(exampleFailoverGroup)
+	assert.Error(t, report.Err(), "up fails")
+	assert.Equal(t, []string{
+		"drbdadm primary r1",
+		"mount /pgwal",
+		"drbdadm secondary r1",
+	}, r.ran, "only r1 rolled back")
+}
+
+func TestFailoverIgnoreErrors(t *testing.T) {
+	r := &fakeRunner{fail: map[string]bool{"mount /pgwal": true}}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run}
+	secondary := State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary"}
+	primary := State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary"}
+	callback := f.Callback(func(Delta) error { return nil })
+	assert.Error(t, callback(Delta{Resource: 0, Old: secondary, New: primary}), "group error returned")
+
+	r.ran = nil
+	f = &Failover{Groups: []FailoverGroup{exampleFailoverGroup}, Run: r.run, IgnoreErrors: true}
+	callback = f.Callback(func(Delta) error { return nil })
+	assert.NoError(t, callback(Delta{Resource: 0, Old: secondary, New: primary}), "group error ignored")
+	assert.Contains(t, r.ran, "umount /pgdata", "still rolled back")
+}
+
+func TestFailoverGroupsInParallel(t *testing.T) {
+	r := &fakeRunner{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	run := func(name string, args ...string) error {
+		if name == "mount" && args[0] == "/pgdata" {
+			close(started)
+			<-release
+		}
+		return r.run(name, args...)
+	}
+	other := FailoverGroup{Name: "web", Units: []Unit{{Name: "www", Resource: "r2", Mount: "/www"}}}
+	f := &Failover{Groups: []FailoverGroup{exampleFailoverGroup, other}, Run: run}
+	callback := f.Callback(func(Delta) error { return nil })
+	secondary := State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary"}
+	primary := State{Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary"}
+
+	done := make(chan error, 2)
+	go func() {
+		done <- callback(Delta{Resource: 0, Old: secondary, New: primary})
+	}()
+	<-started
+	go func() {
+		done <- callback(Delta{Resource: 2, Old: secondary, New: primary})
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "other group")
+	case <-time.After(napTime):
+		t.Fatal("a hung command in one group held up another group")
+	}
+	close(release)
+	require.NoError(t, <-done, "first group")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.True(t, r.up["/www"], "other group up")
+	assert.True(t, r.up["myapp"], "first group up")
+}
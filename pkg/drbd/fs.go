@@ -0,0 +1,58 @@
+package drbd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FS is how the watcher reads /proc/drbd, /etc/fstab, and /proc/mounts.
+// It is an interface so that tests can use a MemFS.
+type FS interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// MemFS is an in-memory FS
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// NewMemFS returns an empty MemFS
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]string)}
+}
+
+// WriteFile creates or replaces a file
+func (m *MemFS) WriteFile(name string, contents string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = contents
+}
+
+// Remove removes a file
+func (m *MemFS) Remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+}
+
+// Open returns a reader of the file's contents at the time it was opened.
+// Missing files return an error for which os.IsNotExist is true.
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	contents, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), nil
+}
@@ -9,9 +9,19 @@ import (
 // GetMounts find the mounted and unmounted mount points for
 // a drbd resource if called with "/etc/fstab" and "/proc/mounts"
 func GetMounts(resource int, files ...string) ([]string, error) {
+	return Options{}.GetMounts(resource, files...)
+}
+
+// GetMounts is like the GetMounts function but it reads the files from FS
+func (o Options) GetMounts(resource int, files ...string) ([]string, error) {
 	mountPoints := make(map[string]struct{})
 	for _, file := range files {
-		mounts, err := fstab.ParseFile(file)
+		fh, err := o.fs().Open(file)
+		if err != nil {
+			return nil, err
+		}
+		mounts, err := fstab.Parse(fh)
+		fh.Close()
 		if err != nil {
 			return nil, err
 		}
@@ -17,3 +17,15 @@ func TestReadMounts(t *testing.T) {
 	require.NoError(t, err, "fstab")
 	assert.Equal(t, []string{"/r0"}, got, "list of mounts")
 }
+
+func TestReadMountsMemFS(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("/etc/fstab", exampleFstab)
+	o := Options{FS: fs}
+	got, err := o.GetMounts(0, "/etc/fstab")
+	require.NoError(t, err, "fstab")
+	assert.Equal(t, []string{"/r0"}, got, "list of mounts")
+
+	_, err = o.GetMounts(0, "/proc/mounts")
+	assert.Error(t, err, "missing file")
+}
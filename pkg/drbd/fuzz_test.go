@@ -0,0 +1,55 @@
+//go:build go1.18
+// +build go1.18
+
+// The module supports Go 1.13, but fuzzing needs Go 1.18 or later.
+// Older toolchains skip this file.
+
+package drbd
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// FuzzParseStates checks that parsing never panics, that lenient
+// parsing only fails without a version line, and that whatever is
+// parsed renders back into the same states.
+func FuzzParseStates(f *testing.F) {
+	files, _ := filepath.Glob("testdata/proc-drbd/*.txt")
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte(exampleProcDRBD2))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		states, _, err := parseStates(bytes.NewReader(b), "fuzz", true)
+		if err != nil {
+			if bytes.HasPrefix(b, []byte("version:")) && errors.Cause(err) != bufio.ErrTooLong {
+				t.Fatalf("lenient parse failed: %s", err)
+			}
+			return
+		}
+		rendered := RenderProcDRBD(states)
+		again, _, err := parseStates(strings.NewReader(rendered), "rendered", false)
+		if err != nil {
+			t.Fatalf("rendered states did not parse: %s\n%s", err, rendered)
+		}
+		if len(again) != len(states) {
+			t.Fatalf("rendered %d states, parsed %d\n%s", len(states), len(again), rendered)
+		}
+		for r, s := range states {
+			if !again[r].Equal(s) {
+				t.Fatalf("r%d rendered as %+v, parsed as %+v\n%s", r, s, again[r], rendered)
+			}
+		}
+	})
+}
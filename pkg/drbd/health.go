@@ -0,0 +1,110 @@
+package drbd
+
+import (
+	"strconv"
+	"time"
+)
+
+// Health is how a running watcher is doing
+type Health struct {
+	// At is when the health was taken
+	At time.Time `json:"at" yaml:"at"`
+	// Ready is set once the state has been read, until the watcher
+	// is stopped
+	Ready    bool `json:"ready" yaml:"ready"`
+	Stopping bool `json:"stopping" yaml:"stopping"`
+	// LastRead is when the Source was last read successfully.
+	// ReadErrors counts the failed reads since then and LastError
+	// is the most recent.
+	LastRead   time.Time `json:"last_read" yaml:"last_read"`
+	ReadErrors int       `json:"read_errors" yaml:"read_errors"`
+	LastError  string    `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	// Running is how many callbacks are running and OldestRunning
+	// is how long the oldest of them has been running
+	Running              int     `json:"running" yaml:"running"`
+	OldestRunningSeconds float64 `json:"oldest_running_seconds" yaml:"oldest_running_seconds"`
+	// Queued is, by minor, how many deltas are waiting for the
+	// callback.  Deltas that wait are merged into one.
+	Queued map[int]int `json:"queued" yaml:"queued"`
+	// Problems says why the watcher is unhealthy.  It is empty when
+	// the watcher is healthy.
+	Problems []string `json:"problems" yaml:"problems"`
+}
+
+// Healthy is true when there are no Problems
+func (h Health) Healthy() bool {
+	return len(h.Problems) == 0
+}
+
+// Health reports how the watcher is doing.  It is unhealthy when it
+// isn't running, when reads of the Source are failing, when it hasn't
+// read the Source successfully for stale, and when a callback has
+// been running for longer than stuck.  stale and stuck are not
+// checked when they are zero.
+func (c *Control) Health(stale, stuck time.Duration) Health {
+	c.mu.Lock()
+	h := Health{
+		LastRead:   c.lastRead,
+		ReadErrors: c.readErrors,
+		LastError:  c.lastError,
+		Stopping:   c.isStopped(),
+		Queued:     map[int]int{},
+		Problems:   []string{},
+	}
+	clock, started, health := c.clock, c.started, c.health
+	c.mu.Unlock()
+	if clock == nil {
+		h.Problems = append(h.Problems, "the watcher has not started")
+		return h
+	}
+	h.At = clock.Now()
+	h.Ready = !h.LastRead.IsZero() && !h.Stopping
+	if health != nil {
+		health(&h)
+	}
+	if h.Stopping {
+		h.Problems = append(h.Problems, "the watcher is stopping")
+	}
+	if h.ReadErrors > 0 {
+		h.Problems = append(h.Problems, strconv.Itoa(h.ReadErrors)+" consecutive read errors, the last: "+h.LastError)
+	}
+	since := started
+	if !h.LastRead.IsZero() {
+		since = h.LastRead
+	}
+	if unread := h.At.Sub(since); stale > 0 && unread > stale {
+		h.Problems = append(h.Problems, "no successful read for "+unread.String())
+	}
+	if oldest := time.Duration(h.OldestRunningSeconds * float64(time.Second)); stuck > 0 && oldest > stuck {
+		h.Problems = append(h.Problems, "a command has been running for "+oldest.String())
+	}
+	return h
+}
+
+// start records when the watcher started, for Health
+func (c *Control) start(clock Clock) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+	c.started = clock.Now()
+}
+
+// read records the outcome of a read of the Source, for Health
+func (c *Control) read(at time.Time, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.readErrors++
+		c.lastError = err.Error()
+		return
+	}
+	c.lastRead = at
+	c.readErrors = 0
+	c.lastError = ""
+}
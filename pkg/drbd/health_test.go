@@ -0,0 +1,60 @@
+package drbd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	assert.Equal(t, []string{"the watcher has not started"}, NewControl().Health(0, 0).Problems, "not started")
+
+	b := newBlockingCallback()
+	c := NewControl()
+	w := newMemWatcher(Options{Control: c, MaxParallel: 1, ReadRetries: 2}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.Invoke(b.callback)
+	})
+	assert.Equal(t, []int{0}, b.startedAfter(1), "initial")
+	h := c.Health(time.Minute, time.Minute)
+	assert.True(t, h.Healthy(), "healthy")
+	assert.True(t, h.Ready, "ready")
+	assert.Equal(t, testStart, h.LastRead, "last read")
+	assert.Equal(t, 1, h.Running, "running")
+
+	w.change("version: 8.4.10\nsrcversion: 0\nunparsable\n")
+	h = c.Health(time.Second/2, 0)
+	assert.Equal(t, 1, h.ReadErrors, "read error")
+	require.Len(t, h.Problems, 2, "problems")
+	assert.True(t, strings.HasPrefix(h.Problems[0], "1 consecutive read errors, the last: "), h.Problems[0])
+	assert.Equal(t, "no successful read for 1s", h.Problems[1], "stale")
+
+	w.change(exampleProcDRBD2)
+	for i := 0; i < 50 && len(h.Queued) < 3; i++ {
+		time.Sleep(napTime / 10)
+		h = c.Health(0, 0)
+	}
+	assert.Equal(t, 0, h.ReadErrors, "recovered")
+	assert.Equal(t, map[int]int{0: 1, 1: 1, 2: 1}, h.Queued, "queued")
+
+	w.clock.Advance(2 * time.Minute)
+	h = c.Health(0, time.Minute)
+	require.Len(t, h.Problems, 1, "stuck")
+	assert.True(t, strings.HasPrefix(h.Problems[0], "a command has been running for "), h.Problems[0])
+
+	c.Stop()
+	close(b.release)
+	select {
+	case err := <-w.errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+	h = c.Health(0, 0)
+	assert.False(t, h.Ready, "not ready once stopped")
+	assert.Equal(t, []string{"the watcher is stopping"}, h.Problems, "stopping")
+}
@@ -1,8 +1,13 @@
 package drbd
 
 import (
+	"log"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // Invoke watches /proc/drbd for changes.
@@ -11,46 +16,323 @@ import (
 // until the prior callback for that resource has
 // returned.
 func Invoke(filename string, nap time.Duration, callback func(Delta) error) error {
-	var mu sync.Mutex
-	dataWaiting := make(map[int]Delta)
-	currentlyRunning := make(map[int]struct{})
-	echan := make(chan error, 1)
-	var invoke func(delta Delta)
-	invoke = func(delta Delta) {
-		err := callback(delta)
-		if err != nil {
-			echan <- err
-		}
-		mu.Lock()
-		defer mu.Unlock()
-		if waiting, ok := dataWaiting[delta.Resource]; ok {
-			delete(dataWaiting, delta.Resource)
-			go invoke(waiting)
-			return
-		}
-		delete(currentlyRunning, delta.Resource)
-	}
+	return Options{ProcDRBD: filename, Nap: nap}.Invoke(callback)
+}
+
+// Invoke is like the Invoke function but changes are first
+// filtered according to the Settle and Flap options and
+// callbacks are limited by MaxParallel and Groups.
+func (o Options) Invoke(callback func(Delta) error) error {
+	return o.invoke(callback, nil)
+}
+
+// invoke is Invoke with rebuild, if set, making the callback after
+// a Control.Reload
+func (o Options) invoke(callback func(Delta) error, rebuild func(Options, []string) func(Delta) error) error {
+	s := newScheduler(o, callback)
+	debouncer := newDebouncer(o, s.dispatch)
+	drift := newDriftDetector(o, s.dispatch)
+	o.Control.running(func(n Options, command []string) {
+		n = o.withRules(n)
+		var callback func(Delta) error
+		if rebuild != nil {
+			callback = rebuild(n, command)
+		}
+		debouncer.configure(n)
+		drift.configure(n)
+		s.configure(n, callback)
+		log.Println("reloaded the configuration")
+	}, func() []string {
+		return append(debouncer.pending(), s.pending()...)
+	}, s.health)
+	defer o.Control.running(nil, nil, nil)
 	go func() {
-		echan <- React(filename, nap, func(delta Delta) error {
-			mu.Lock()
-			defer mu.Unlock()
-			if alreadyWaiting, ok := dataWaiting[delta.Resource]; ok {
-				dataWaiting[delta.Resource] = Delta{
-					Resource:     delta.Resource,
-					Old:          alreadyWaiting.Old,
-					New:          delta.New,
-					UnchangedFor: delta.UnchangedFor,
-				}
-				return nil
-			}
-			if _, ok := currentlyRunning[delta.Resource]; ok {
-				dataWaiting[delta.Resource] = delta
-				return nil
+		react := o
+		react.Polled = func(rs Resources) {
+			drift.polled(rs)
+			if o.Polled != nil {
+				o.Polled(rs)
 			}
-			currentlyRunning[delta.Resource] = struct{}{}
-			go invoke(delta)
-			return nil
-		})
+		}
+		s.fail(react.React(func(delta Delta) error {
+			drift.observe(delta)
+			return debouncer.callback(delta)
+		}))
 	}()
-	return <-echan
+	err := <-s.errors
+	if err == ErrStopped {
+		err = s.drain(o.clock(), o.StopTimeout)
+		o.unsave(s.dropAll(debouncer.stop()))
+	}
+	return err
+}
+
+// scheduler decides when callbacks may run.  A resource only has one
+// callback running at a time: deltas that arrive while it is running
+// are merged and wait.  Beyond that, MaxParallel limits the total
+// number of callbacks and each Group runs only one callback at a time,
+// preferring resources that are listed earlier in the group.
+type scheduler struct {
+	errors  chan error
+	journal *Journal
+	clock   Clock
+
+	mu          sync.Mutex
+	callback    func(Delta) error
+	maxParallel int
+	groupOf     map[int]int // resource -> index into groups
+	groups      []Group
+	waiting     map[int]Delta
+	queued      map[int]int // resource -> deltas merged into waiting
+	running     map[int]time.Time
+	groupBusy   map[int]bool
+	stopping    bool
+	idle        chan struct{} // closed when stopping and nothing is running
+	dropped     map[int]Delta // the changes that were not dispatched
+}
+
+func newScheduler(o Options, callback func(Delta) error) *scheduler {
+	s := &scheduler{
+		callback:  callback,
+		errors:    make(chan error, 1),
+		journal:   o.Journal,
+		clock:     o.clock(),
+		waiting:   make(map[int]Delta),
+		queued:    make(map[int]int),
+		running:   make(map[int]time.Time),
+		groupBusy: make(map[int]bool),
+		dropped:   make(map[int]Delta),
+	}
+	s.setRules(o)
+	return s
+}
+
+// setRules must be called with s.mu held or before s is used
+func (s *scheduler) setRules(o Options) {
+	s.maxParallel = o.MaxParallel
+	s.groups = o.Groups
+	s.groupOf = make(map[int]int)
+	for i, g := range o.Groups {
+		for _, r := range g.Resources {
+			s.groupOf[r] = i
+		}
+	}
+	// a group that is busy now may not be the same group any more
+	s.groupBusy = make(map[int]bool)
+	for r := range s.running {
+		if g, ok := s.groupOf[r]; ok {
+			s.groupBusy[g] = true
+		}
+	}
+}
+
+// configure replaces the rules and, if it isn't nil, the callback
+func (s *scheduler) configure(o Options, callback func(Delta) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRules(o)
+	if callback != nil {
+		s.callback = callback
+	}
+	s.start()
+}
+
+// fail records the first error, later ones are dropped
+func (s *scheduler) fail(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+// dispatch records delta in the journal and queues it, unless the
+// scheduler is stopping
+func (s *scheduler) dispatch(delta Delta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		s.drop(delta)
+		return
+	}
+	s.journal.Delta(delta)
+	if alreadyWaiting, ok := s.waiting[delta.Resource]; ok {
+		delta = delta.since(alreadyWaiting)
+		delta.Flapping = delta.Flapping || alreadyWaiting.Flapping
+	}
+	s.waiting[delta.Resource] = delta
+	s.queued[delta.Resource]++
+	s.start()
+}
+
+// start launches whatever can run.  It must be called with s.mu held.
+func (s *scheduler) start() {
+	for _, r := range s.sortedWaiting() {
+		if !s.runnable(r) {
+			continue
+		}
+		delta := s.waiting[r]
+		delete(s.waiting, r)
+		delete(s.queued, r)
+		s.running[r] = s.clock.Now()
+		if g, ok := s.groupOf[r]; ok {
+			s.groupBusy[g] = true
+		}
+		go s.run(s.callback, delta)
+	}
+}
+
+func (s *scheduler) runnable(r int) bool {
+	if _, ok := s.running[r]; ok {
+		return false
+	}
+	if s.maxParallel > 0 && len(s.running) >= s.maxParallel {
+		return false
+	}
+	g, ok := s.groupOf[r]
+	if !ok {
+		return true
+	}
+	if s.groupBusy[g] {
+		return false
+	}
+	for _, earlier := range s.groups[g].Resources {
+		if earlier == r {
+			break
+		}
+		if _, ok := s.waiting[earlier]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scheduler) run(callback func(Delta) error, delta Delta) {
+	err := callback(delta)
+	if err != nil {
+		s.fail(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, delta.Resource)
+	if g, ok := s.groupOf[delta.Resource]; ok {
+		s.groupBusy[g] = false
+	}
+	if s.stopping {
+		if len(s.running) == 0 {
+			close(s.idle)
+		}
+		return
+	}
+	s.start()
+}
+
+// drain drops the deltas that are waiting and waits up to timeout,
+// or without a limit if timeout is zero, for the callbacks that are
+// running.  It returns ErrStopped if they all finished.
+func (s *scheduler) drain(clock Clock, timeout time.Duration) error {
+	s.mu.Lock()
+	s.stopping = true
+	for _, r := range s.sortedWaiting() {
+		s.drop(s.waiting[r])
+	}
+	s.waiting = make(map[int]Delta)
+	s.queued = make(map[int]int)
+	s.idle = make(chan struct{})
+	if len(s.running) == 0 {
+		close(s.idle)
+	} else {
+		log.Printf("stopping, waiting for %d commands\n", len(s.running))
+	}
+	s.mu.Unlock()
+	if timeout == 0 {
+		<-s.idle
+		return ErrStopped
+	}
+	expired := make(chan struct{})
+	timer := clock.AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+	select {
+	case <-s.idle:
+		return ErrStopped
+	case <-expired:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return errors.Errorf("stopped with %d commands still running after %s", len(s.running), timeout)
+	}
+}
+
+// drop records a change that won't be dispatched because the
+// scheduler is stopping.  It must be called with s.mu held.
+func (s *scheduler) drop(delta Delta) {
+	log.Printf("r%d: stopping, dropped change: %s\n", delta.Resource, StateDiff(delta.New, delta.Old))
+	if earlier, ok := s.dropped[delta.Resource]; ok {
+		delta = delta.since(earlier)
+	}
+	s.dropped[delta.Resource] = delta
+}
+
+// dropAll drops deltas too and returns all the changes that were
+// dropped
+func (s *scheduler) dropAll(deltas []Delta) []Delta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, delta := range deltas {
+		s.drop(delta)
+	}
+	dropped := make([]Delta, 0, len(s.dropped))
+	for _, delta := range s.dropped {
+		dropped = append(dropped, delta)
+	}
+	sort.Slice(dropped, func(i, j int) bool {
+		return dropped[i].Resource < dropped[j].Resource
+	})
+	return dropped
+}
+
+// pending describes what is running and waiting, for Control.Dump
+func (s *scheduler) pending() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running := make([]int, 0, len(s.running))
+	for r := range s.running {
+		running = append(running, r)
+	}
+	sort.Ints(running)
+	var lines []string
+	for _, r := range running {
+		lines = append(lines, "r"+strconv.Itoa(r)+" running")
+	}
+	for _, r := range s.sortedWaiting() {
+		delta := s.waiting[r]
+		lines = append(lines, "r"+strconv.Itoa(r)+" queued: "+StateDiff(delta.New, delta.Old))
+	}
+	return lines
+}
+
+// health adds what is running and waiting to h
+func (s *scheduler) health(h *Health) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.Running = len(s.running)
+	var oldest time.Duration
+	for _, started := range s.running {
+		if running := h.At.Sub(started); running > oldest {
+			oldest = running
+		}
+	}
+	h.OldestRunningSeconds = oldest.Seconds()
+	h.Queued = make(map[int]int, len(s.queued))
+	for r, n := range s.queued {
+		h.Queued[r] = n
+	}
+}
+
+// sortedWaiting must be called with s.mu held
+func (s *scheduler) sortedWaiting() []int {
+	resources := make([]int, 0, len(s.waiting))
+	for r := range s.waiting {
+		resources = append(resources, r)
+	}
+	sort.Ints(resources)
+	return resources
 }
@@ -0,0 +1,92 @@
+package drbd
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingCallback records the order callbacks start and holds
+// each one until it is released
+type blockingCallback struct {
+	mu      sync.Mutex
+	started []int
+	release chan struct{}
+}
+
+func newBlockingCallback() *blockingCallback {
+	return &blockingCallback{release: make(chan struct{})}
+}
+
+func (b *blockingCallback) callback(delta Delta) error {
+	b.mu.Lock()
+	b.started = append(b.started, delta.Resource)
+	b.mu.Unlock()
+	<-b.release
+	return nil
+}
+
+// startedAfter waits for at least n callbacks to start and then
+// a little longer to catch any that shouldn't have
+func (b *blockingCallback) startedAfter(n int) []int {
+	for i := 0; i < 50; i++ {
+		b.mu.Lock()
+		count := len(b.started)
+		b.mu.Unlock()
+		if count >= n {
+			break
+		}
+		time.Sleep(napTime / 10)
+	}
+	time.Sleep(napTime / 10)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]int{}, b.started...)
+}
+
+func TestSchedulerMaxParallel(t *testing.T) {
+	b := newBlockingCallback()
+	s := newScheduler(Options{MaxParallel: 2}, b.callback)
+	s.dispatch(Delta{Resource: 3})
+	s.dispatch(Delta{Resource: 1})
+	s.dispatch(Delta{Resource: 2})
+	assert.Len(t, b.startedAfter(2), 2, "limited to two")
+	b.release <- struct{}{}
+	assert.Len(t, b.startedAfter(3), 3, "third after one finishes")
+	close(b.release)
+}
+
+func TestSchedulerGroups(t *testing.T) {
+	b := newBlockingCallback()
+	s := newScheduler(Options{Groups: []Group{{Name: "pg", Resources: []int{2, 0}}}}, b.callback)
+	s.mu.Lock()
+	s.waiting[0] = Delta{Resource: 0}
+	s.waiting[1] = Delta{Resource: 1}
+	s.waiting[2] = Delta{Resource: 2}
+	s.start()
+	s.mu.Unlock()
+	assert.ElementsMatch(t, []int{1, 2}, b.startedAfter(2), "r0 waits for r2")
+	close(b.release)
+	started := b.startedAfter(3)
+	if assert.Len(t, started, 3, "all started") {
+		assert.Equal(t, 0, started[2], "r0 after r2")
+	}
+}
+
+func TestSchedulerMerge(t *testing.T) {
+	b := newBlockingCallback()
+	s := newScheduler(Options{}, b.callback)
+	s.dispatch(Delta{Resource: 0, Old: State{}, New: stateConnected})
+	s.dispatch(Delta{Resource: 0, Old: stateConnected, New: stateDisconnected})
+	s.dispatch(Delta{Resource: 0, Old: stateDisconnected, New: stateConnected, Flapping: true})
+	assert.Equal(t, []int{0}, b.startedAfter(1), "one at a time")
+	s.mu.Lock()
+	waiting := s.waiting[0]
+	s.mu.Unlock()
+	assert.Equal(t, stateConnected, waiting.Old, "merged old")
+	assert.Equal(t, stateConnected, waiting.New, "merged new")
+	assert.True(t, waiting.Flapping, "merged flapping")
+	close(b.release)
+}
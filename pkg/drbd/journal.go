@@ -0,0 +1,318 @@
+package drbd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Record types
+const (
+	RecordDelta = "delta"
+	RecordEvent = "event"
+	RecordHook  = "hook"
+)
+
+// Record is one line in a Journal
+type Record struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Resource int       `json:"resource"`
+	// for RecordDelta
+	Old         *State   `json:"old,omitempty"`
+	New         *State   `json:"new,omitempty"`
+	Changes     []Change `json:"changes,omitempty"`
+	MaybeMissed bool     `json:"maybe_missed,omitempty"`
+	Drift       []string `json:"drift,omitempty"`
+	// Suppressed is set for a change that wasn't dispatched when it
+	// was seen: it was settling, it reverted before it settled, or
+	// the resource was flapping.  A change that settles is recorded
+	// again when it is dispatched.
+	Suppressed bool `json:"suppressed,omitempty"`
+	// for RecordEvent
+	Event Event `json:"event,omitempty"`
+	// for RecordHook
+	Command  []string `json:"command,omitempty"`
+	Seconds  float64  `json:"seconds,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+func (r Record) String() string {
+	s := r.Time.Format(time.RFC3339) + " r" + strconv.Itoa(r.Resource) + " " + r.Type
+	switch r.Type {
+	case RecordDelta:
+		var o, n State
+		if r.Old != nil {
+			o = *r.Old
+		}
+		if r.New != nil {
+			n = *r.New
+		}
+		s += " " + StateDiff(n, o)
+		if r.MaybeMissed {
+			s += " (maybe missed changes)"
+		}
+		if r.Suppressed {
+			s += " (suppressed)"
+		}
+		if len(r.Drift) > 0 {
+			s += " drift: " + strings.Join(r.Drift, "; ")
+		}
+	case RecordEvent:
+		s += " " + string(r.Event)
+	case RecordHook:
+		s += fmt.Sprintf(" %s exit=%d %.1fs", strings.Join(r.Command, " "), r.ExitCode, r.Seconds)
+		if r.Error != "" {
+			s += " " + r.Error
+		}
+	}
+	return s
+}
+
+// Journal is an append-only log of deltas, events, and hook results.
+// When it grows beyond its maximum size, it is rotated: filename
+// becomes filename.1, filename.1 becomes filename.2, and so on.  Only
+// a limited number of rotated files are kept.  A nil *Journal
+// discards everything.
+type Journal struct {
+	filename string
+	maxSize  int64
+	keep     int
+
+	mu   sync.Mutex
+	fh   *os.File
+	size int64
+}
+
+// OpenJournal opens a journal for appending.  A maxSize of zero
+// means the journal is never rotated.
+func OpenJournal(filename string, maxSize int64, keep int) (*Journal, error) {
+	j := &Journal{
+		filename: filename,
+		maxSize:  maxSize,
+		keep:     keep,
+	}
+	return j, j.open()
+}
+
+func (j *Journal) open() error {
+	fh, err := os.OpenFile(j.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open journal %s", j.filename)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return errors.Wrapf(err, "stat journal %s", j.filename)
+	}
+	j.fh = fh
+	j.size = fi.Size()
+	return nil
+}
+
+// Close closes the journal
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fh.Close()
+}
+
+// Write appends a record to the journal
+func (j *Journal) Write(r Record) error {
+	if j == nil {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "encode journal record")
+	}
+	b = append(b, '\n')
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.maxSize > 0 && j.size > 0 && j.size+int64(len(b)) > j.maxSize {
+		err = j.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := j.fh.Write(b)
+	j.size += int64(n)
+	if err != nil {
+		return errors.Wrapf(err, "write journal %s", j.filename)
+	}
+	return nil
+}
+
+// rotate is called with j.mu held
+func (j *Journal) rotate() error {
+	err := j.fh.Close()
+	if err != nil {
+		return errors.Wrapf(err, "close journal %s", j.filename)
+	}
+	if j.keep > 0 {
+		_ = os.Remove(rotatedName(j.filename, j.keep))
+		for i := j.keep - 1; i >= 1; i-- {
+			_ = os.Rename(rotatedName(j.filename, i), rotatedName(j.filename, i+1))
+		}
+		err = os.Rename(j.filename, rotatedName(j.filename, 1))
+	} else {
+		err = os.Remove(j.filename)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "rotate journal %s", j.filename)
+	}
+	return j.open()
+}
+
+func rotatedName(filename string, i int) string {
+	return filename + "." + strconv.Itoa(i)
+}
+
+// Delta records a delta and its classification
+func (j *Journal) Delta(d Delta) {
+	if j == nil {
+		return
+	}
+	j.log(j.Write(deltaRecord(d)))
+	for _, e := range Classify(d) {
+		j.log(j.Write(Record{
+			Time:     d.Seen,
+			Type:     RecordEvent,
+			Resource: d.Resource,
+			Event:    e,
+		}))
+	}
+}
+
+// Suppressed records a delta that the debouncer held back.  It isn't
+// classified because no command is run for it.
+func (j *Journal) Suppressed(d Delta) {
+	if j == nil {
+		return
+	}
+	r := deltaRecord(d)
+	r.Suppressed = true
+	j.log(j.Write(r))
+}
+
+func deltaRecord(d Delta) Record {
+	old, new := d.Old, d.New
+	return Record{
+		Time:        d.Seen,
+		Type:        RecordDelta,
+		Resource:    d.Resource,
+		Old:         &old,
+		New:         &new,
+		Changes:     d.Changes,
+		MaybeMissed: d.MaybeMissed,
+		Drift:       d.Drift,
+	}
+}
+
+func (j *Journal) log(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// JournalFilter selects records from a journal.  Empty fields
+// match everything.
+type JournalFilter struct {
+	Resources []int
+	Since     time.Time
+	Until     time.Time
+	// Types matches either Record.Type or Record.Event
+	Types []string
+}
+
+// Match returns true if the record is selected by the filter
+func (f JournalFilter) Match(r Record) bool {
+	if len(f.Resources) > 0 {
+		found := false
+		for _, res := range f.Resources {
+			if res == r.Resource {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && r.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.Time.After(f.Until) {
+		return false
+	}
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == r.Type || Event(t) == r.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadJournal calls fn for each record that matches the filter,
+// oldest first, including records in rotated files.
+func ReadJournal(filename string, filter JournalFilter, fn func(Record) error) error {
+	files := []string{filename}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedName(filename, i)); err != nil {
+			break
+		}
+		files = append([]string{rotatedName(filename, i)}, files...)
+	}
+	for _, file := range files {
+		err := readJournalFile(file, filter, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJournalFile(filename string, filter JournalFilter, fn func(Record) error) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "open journal %s", filename)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var r Record
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			return errors.Wrapf(err, "%s line %d", filename, line)
+		}
+		if !filter.Match(r) {
+			continue
+		}
+		err = fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "read %s", filename)
+}
@@ -0,0 +1,97 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, filename string, filter JournalFilter) []Record {
+	var got []Record
+	require.NoError(t, ReadJournal(filename, filter, func(r Record) error {
+		got = append(got, r)
+		return nil
+	}), "read journal")
+	return got
+}
+
+func TestJournal(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	filename := dir + "/journal"
+
+	j, err := OpenJournal(filename, 600, 2)
+	require.NoError(t, err, "open")
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		j.Delta(Delta{
+			Resource: i % 2,
+			Old:      stateConnected,
+			New:      stateDisconnected,
+			Seen:     start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	require.NoError(t, j.Write(Record{Time: start.Add(time.Hour), Type: RecordHook, Resource: 1, Command: []string{"true"}}), "hook")
+	require.NoError(t, j.Close(), "close")
+
+	all := readAll(t, filename, JournalFilter{})
+	require.NotEmpty(t, all, "records")
+	assert.Equal(t, RecordHook, all[len(all)-1].Type, "newest last")
+	for i := 1; i < len(all); i++ {
+		assert.False(t, all[i].Time.Before(all[i-1].Time), "in order")
+	}
+	assert.True(t, start.Add(time.Minute*4).Before(all[0].Time), "oldest rotated away")
+	assert.NoFileExists(t, filename+".3", "only two kept")
+
+	got := readAll(t, filename, JournalFilter{Resources: []int{1}, Types: []string{string(EventDisconnected), RecordHook}})
+	if assert.NotEmpty(t, got, "filtered") {
+		for _, r := range got {
+			assert.Equal(t, 1, r.Resource, "resource")
+		}
+		assert.Equal(t, EventDisconnected, got[0].Event, "event")
+		assert.Equal(t, RecordHook, got[len(got)-1].Type, "hook")
+	}
+
+	got = readAll(t, filename, JournalFilter{Since: start.Add(30 * time.Minute)})
+	if assert.Len(t, got, 1, "since") {
+		assert.Equal(t, "2020-03-01T13:00:00Z r1 hook true exit=0 0.0s", got[0].String(), "string")
+	}
+}
+
+func TestJournalSuppressed(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	filename := dir + "/journal"
+	j, err := OpenJournal(filename, 0, 0)
+	require.NoError(t, err, "open")
+
+	c, next := collectDeltas()
+	clock := NewManualClock(testStart)
+	d := newDebouncer(Options{Settle: time.Second, Clock: clock, Journal: j}, next)
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateConnected, New: stateDisconnected, Seen: clock.Now()}))
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateDisconnected, New: stateConnected, Seen: clock.Now()}))
+	clock.Advance(2 * time.Second)
+	assert.Empty(t, c, "reverted change")
+	require.NoError(t, d.callback(Delta{Resource: 0, Old: stateConnected, New: stateDisconnected, Seen: clock.Now()}))
+	clock.Advance(2 * time.Second)
+	assert.Len(t, c, 1, "settled")
+
+	d = newDebouncer(Options{Clock: clock, Journal: j}, next)
+	require.NoError(t, d.callback(Delta{Resource: 1, Old: stateConnected, New: stateDisconnected, Seen: clock.Now()}))
+	assert.Len(t, c, 2, "passed through")
+	require.NoError(t, j.Close(), "close")
+
+	got := readAll(t, filename, JournalFilter{})
+	if assert.Len(t, got, 3, "records") {
+		for i, r := range got {
+			assert.Equal(t, 0, r.Resource, "resource")
+			assert.Equal(t, RecordDelta, r.Type, "type")
+			assert.True(t, r.Suppressed, "suppressed")
+			assert.Equal(t, i%2 == 1, r.New.Equal(stateConnected), "in order")
+		}
+		assert.Contains(t, got[0].String(), "(suppressed)", "string")
+	}
+}
@@ -0,0 +1,445 @@
+package drbd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resource is the DRBD 9 view of a resource: a device for each
+// volume and a connection to each peer.  DRBD 8.4 resources have
+// one volume and one peer.
+type Resource struct {
+	Name        string             `json:"name"`
+	Role        string             `json:"role"`
+	Devices     map[int]Device     `json:"devices"`     // by volume
+	Connections map[int]Connection `json:"connections"` // by peer node id
+}
+
+// Device is one volume of a resource on this node
+type Device struct {
+	Minor  int    `json:"minor"`
+	Disk   string `json:"disk"`
+	Client bool   `json:"client"` // intentionally diskless
+	// Quorum is "yes" or "no", or "" when it isn't known (DRBD 8)
+	Quorum string `json:"quorum,omitempty"`
+}
+
+// Connection is this node's view of one peer
+type Connection struct {
+	Name        string             `json:"name"`
+	Connection  string             `json:"connection"`
+	PeerRole    string             `json:"peer_role"`
+	PeerDevices map[int]PeerDevice `json:"peer_devices"` // by volume
+}
+
+// PeerDevice is one volume of a resource as seen on a peer.
+// The statistics are only known from "drbdsetup status" and are not
+// compared by DiffResources.
+type PeerDevice struct {
+	Replication string `json:"replication"`
+	PeerDisk    string `json:"peer_disk"`
+	// OutOfSync is in KiB
+	OutOfSync     int64   `json:"out_of_sync,omitempty"`
+	PercentInSync float64 `json:"percent_in_sync,omitempty"`
+}
+
+// Resources maps resource name to resource
+type Resources map[string]Resource
+
+// Change is one difference between two Resources.  When an object
+// appears, each of its fields changes from ""; when it goes away,
+// each changes to "".
+type Change struct {
+	// Object is "resource", "device", "connection", or "peer-device"
+	Object   string `json:"object"`
+	Resource string `json:"resource"`
+	// Volume is set for devices and peer devices
+	Volume int `json:"volume,omitempty"`
+	// PeerNodeID and Peer are set for connections and peer devices
+	PeerNodeID int    `json:"peer_node_id,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Field      string `json:"field"`
+	Old        string `json:"old"`
+	New        string `json:"new"`
+}
+
+func (c Change) String() string {
+	var where string
+	switch c.Object {
+	case "device":
+		where = "/" + strconv.Itoa(c.Volume)
+	case "connection":
+		where = " " + c.peer()
+	case "peer-device":
+		where = " " + c.peer() + "/" + strconv.Itoa(c.Volume)
+	}
+	return c.Resource + where + " " + c.Field + ":" + c.Old + "->" + c.New
+}
+
+// peer is the peer's name, or its node id if it doesn't have one
+func (c Change) peer() string {
+	if c.Peer != "" {
+		return c.Peer
+	}
+	return strconv.Itoa(c.PeerNodeID)
+}
+
+func (r Resource) copy() Resource {
+	c := r
+	c.Devices = make(map[int]Device, len(r.Devices))
+	for v, d := range r.Devices {
+		c.Devices[v] = d
+	}
+	c.Connections = make(map[int]Connection, len(r.Connections))
+	for id, conn := range r.Connections {
+		pds := make(map[int]PeerDevice, len(conn.PeerDevices))
+		for v, pd := range conn.PeerDevices {
+			pds[v] = pd
+		}
+		conn.PeerDevices = pds
+		c.Connections[id] = conn
+	}
+	return c
+}
+
+// Replicas counts the UpToDate copies of a volume, here and on peers
+func (r Resource) Replicas(volume int) int {
+	var n int
+	if d, ok := r.Devices[volume]; ok && d.Disk == "UpToDate" {
+		n++
+	}
+	for _, c := range r.Connections {
+		if pd, ok := c.PeerDevices[volume]; ok && pd.PeerDisk == "UpToDate" {
+			n++
+		}
+	}
+	return n
+}
+
+// steadyDisks are the disk states that aren't expected to change soon
+var steadyDisks = map[string]bool{"": true, "UpToDate": true, "Diskless": true}
+
+// unsettled is true if any disk, peer disk, or connection is still
+// changing, as during a resync or a reconnect
+func (rs Resources) unsettled() bool {
+	for _, r := range rs {
+		for _, d := range r.Devices {
+			if !steadyDisks[d.Disk] {
+				return true
+			}
+		}
+		for _, c := range r.Connections {
+			if cs := connectionName(c.Connection); cs != "Connected" && cs != "Unconfigured" {
+				return true
+			}
+			for _, pd := range c.PeerDevices {
+				if pd.Replication != "" && connectionName(pd.Replication) != "Connected" {
+					return true
+				}
+				if !steadyDisks[pd.PeerDisk] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[int]bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// States projects resources onto minors, as /proc/drbd would show them.
+// Only the peer with the lowest node id is used.
+func (rs Resources) States() States {
+	states := make(States)
+	for _, r := range rs {
+		ids := r.peers()
+		for volume, d := range r.Devices {
+			if d.Minor < 0 {
+				continue
+			}
+			s := State{
+				Connection: "StandAlone",
+				SelfRole:   r.Role,
+				RemoteRole: "Unknown",
+				SelfDisk:   d.Disk,
+				RemoteDisk: "DUnknown",
+				Client:     d.Client,
+			}
+			if len(ids) > 0 {
+				c := r.Connections[ids[0]]
+				s.Connection = connectionName(c.Connection)
+				s.RemoteRole = c.PeerRole
+				if pd, ok := c.PeerDevices[volume]; ok {
+					if s.Connection == "Connected" && pd.Replication != "" {
+						s.Connection = connectionName(pd.Replication)
+					}
+					s.RemoteDisk = pd.PeerDisk
+				}
+			}
+			states[d.Minor] = s
+		}
+	}
+	return states
+}
+
+// statesToResources is the DRBD 8.4 view of /proc/drbd: a resource for
+// each minor with one volume and one peer.  Minors are named, and their
+// peer numbered, like the same minor in like, or else "r0", "r1", etc
+// with peer node id 1.
+func statesToResources(states States, like Resources) Resources {
+	rs := make(Resources)
+	for minor, s := range states {
+		name, volume, peer, peerName := "r"+strconv.Itoa(minor), 0, 1, ""
+		if n, v, ok := like.locate(minor); ok {
+			name, volume = n, v
+			if ids := like[n].peers(); len(ids) > 0 {
+				peer, peerName = ids[0], like[n].Connections[ids[0]].Name
+			}
+		}
+		r, ok := rs[name]
+		if !ok {
+			r = Resource{
+				Name:    name,
+				Role:    s.SelfRole,
+				Devices: make(map[int]Device),
+				Connections: map[int]Connection{peer: {
+					Name:        peerName,
+					Connection:  s.Connection,
+					PeerRole:    s.RemoteRole,
+					PeerDevices: make(map[int]PeerDevice),
+				}},
+			}
+			rs[name] = r
+		}
+		r.Devices[volume] = Device{Minor: minor, Disk: s.SelfDisk, Client: s.Client}
+		r.Connections[peer].PeerDevices[volume] = PeerDevice{PeerDisk: s.RemoteDisk}
+	}
+	return rs
+}
+
+// locate finds the resource and volume of a minor
+func (rs Resources) locate(minor int) (string, int, bool) {
+	for name, r := range rs {
+		for volume, d := range r.Devices {
+			if d.Minor == minor {
+				return name, volume, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// peers returns the peer node ids in order
+func (r Resource) peers() []int {
+	ids := make(map[int]bool)
+	for id := range r.Connections {
+		ids[id] = true
+	}
+	return sortedKeys(ids)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// DiffResources lists the changes from old to new, ordered by resource,
+// then resource, device, connection, and peer device changes.
+func DiffResources(old, new Resources) []Change {
+	names := make([]string, 0, len(old)+len(new))
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []Change
+	for _, name := range names {
+		o, n := old[name], new[name]
+		add := func(c Change, fields ...string) {
+			for i := 0; i < len(fields); i += 3 {
+				if fields[i+1] != fields[i+2] {
+					c.Resource = name
+					c.Field, c.Old, c.New = fields[i], fields[i+1], fields[i+2]
+					changes = append(changes, c)
+				}
+			}
+		}
+		add(Change{Object: "resource"}, "role", o.Role, n.Role)
+
+		volumes := make(map[int]bool)
+		for v := range o.Devices {
+			volumes[v] = true
+		}
+		for v := range n.Devices {
+			volumes[v] = true
+		}
+		for _, v := range sortedKeys(volumes) {
+			od, oOK := o.Devices[v]
+			nd, nOK := n.Devices[v]
+			oc, nc := "", ""
+			if oOK {
+				oc = yesNo(od.Client)
+			}
+			if nOK {
+				nc = yesNo(nd.Client)
+			}
+			add(Change{Object: "device", Volume: v}, "disk", od.Disk, nd.Disk, "client", oc, nc, "quorum", od.Quorum, nd.Quorum)
+		}
+
+		peers := make(map[int]bool)
+		for id := range o.Connections {
+			peers[id] = true
+		}
+		for id := range n.Connections {
+			peers[id] = true
+		}
+		ids := sortedKeys(peers)
+		for _, id := range ids {
+			oc, nc := o.Connections[id], n.Connections[id]
+			peer := nc.Name
+			if peer == "" {
+				peer = oc.Name
+			}
+			add(Change{Object: "connection", PeerNodeID: id, Peer: peer},
+				"connection", oc.Connection, nc.Connection, "peer-role", oc.PeerRole, nc.PeerRole)
+		}
+		for _, id := range ids {
+			oc, nc := o.Connections[id], n.Connections[id]
+			peer := nc.Name
+			if peer == "" {
+				peer = oc.Name
+			}
+			volumes := make(map[int]bool)
+			for v := range oc.PeerDevices {
+				volumes[v] = true
+			}
+			for v := range nc.PeerDevices {
+				volumes[v] = true
+			}
+			for _, v := range sortedKeys(volumes) {
+				opd, npd := oc.PeerDevices[v], nc.PeerDevices[v]
+				add(Change{Object: "peer-device", Volume: v, PeerNodeID: id, Peer: peer},
+					"replication", opd.Replication, npd.Replication, "peer-disk", opd.PeerDisk, npd.PeerDisk)
+			}
+		}
+	}
+	return changes
+}
+
+// minorChanges is what changed for one minor
+type minorChanges struct {
+	name    string
+	volume  int
+	changes []Change
+}
+
+// byMinor sorts changes out by the minors they affect.  Resource and
+// connection changes affect every volume of the resource.
+func byMinor(old, new Resources, changes []Change) map[int]*minorChanges {
+	m := make(map[int]*minorChanges)
+	for _, c := range changes {
+		for _, rs := range []Resources{new, old} {
+			r, ok := rs[c.Resource]
+			if !ok {
+				continue
+			}
+			for volume, d := range r.Devices {
+				if d.Minor < 0 {
+					continue
+				}
+				if (c.Object == "device" || c.Object == "peer-device") && c.Volume != volume {
+					continue
+				}
+				mc, ok := m[d.Minor]
+				if !ok {
+					mc = &minorChanges{name: c.Resource, volume: volume}
+					m[d.Minor] = mc
+				}
+				if len(mc.changes) == 0 || mc.changes[len(mc.changes)-1] != c {
+					mc.changes = append(mc.changes, c)
+				}
+			}
+		}
+	}
+	return m
+}
+
+// ChangedPeers returns the peers (by name, or node id if they don't
+// have a name) whose connection or peer devices changed
+func (d Delta) ChangedPeers() []string {
+	seen := make(map[string]bool)
+	var peers []string
+	for _, c := range d.Changes {
+		if c.Object != "connection" && c.Object != "peer-device" {
+			continue
+		}
+		if p := c.peer(); !seen[p] {
+			seen[p] = true
+			peers = append(peers, p)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// ChangedVolumes returns the volumes whose device or peer devices changed
+func (d Delta) ChangedVolumes() []int {
+	volumes := make(map[int]bool)
+	for _, c := range d.Changes {
+		if c.Object == "device" || c.Object == "peer-device" {
+			volumes[c.Volume] = true
+		}
+	}
+	return sortedKeys(volumes)
+}
+
+// mergeChanges combines the changes to each field of each object, in
+// the order they were first changed, from the first Old to the last
+// New.  Fields that are back where they started are left out.
+func mergeChanges(earlier, later []Change) []Change {
+	type key struct {
+		object, resource, field string
+		volume, peer            int
+	}
+	merged := make([]Change, 0, len(earlier)+len(later))
+	index := make(map[key]int)
+	for _, c := range append(append([]Change{}, earlier...), later...) {
+		k := key{c.Object, c.Resource, c.Field, c.Volume, c.PeerNodeID}
+		if i, ok := index[k]; ok {
+			merged[i].New = c.New
+			merged[i].Peer = c.Peer
+			continue
+		}
+		index[k] = len(merged)
+		merged = append(merged, c)
+	}
+	kept := merged[:0]
+	for _, c := range merged {
+		if c.Old != c.New {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+func describeChanges(changes []Change) string {
+	s := make([]string, len(changes))
+	for i, c := range changes {
+		s[i] = c.String()
+	}
+	return strings.Join(s, "; ")
+}
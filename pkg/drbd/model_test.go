@@ -0,0 +1,93 @@
+package drbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatesToResources(t *testing.T) {
+	client := stateConnected
+	client.SelfDisk, client.Client = "Diskless", true
+	states := States{0: stateConnected, 3: stateDisconnected, 5: client, 12: {Connection: "Unconfigured"}}
+	assert.Equal(t, states, statesToResources(states, nil).States(), "round trip")
+}
+
+func TestStatesToResourcesLike(t *testing.T) {
+	like := Resources{"data": {
+		Name:        "data",
+		Devices:     map[int]Device{1: {Minor: 7}},
+		Connections: map[int]Connection{2: {Name: "beta"}},
+	}}
+	rs := statesToResources(States{7: stateConnected, 8: stateConnected}, like)
+	assert.Contains(t, rs, "r8", "not like anything")
+	if assert.Contains(t, rs, "data", "named like") {
+		assert.Equal(t, 7, rs["data"].Devices[1].Minor, "volume")
+		assert.Equal(t, "beta", rs["data"].Connections[2].Name, "peer")
+	}
+}
+
+func TestUnsettled(t *testing.T) {
+	assert.False(t, Resources(nil).unsettled(), "nothing")
+	assert.False(t, statesToResources(States{0: stateConnected, 1: {Connection: "Unconfigured"}}, nil).unsettled(), "connected")
+	assert.True(t, statesToResources(States{0: stateDisconnected}, nil).unsettled(), "disconnected")
+	syncing := stateConnected
+	syncing.Connection, syncing.RemoteDisk = "SyncSource", "Inconsistent"
+	assert.True(t, statesToResources(States{0: syncing}, nil).unsettled(), "syncing")
+}
+
+func TestDiffResources(t *testing.T) {
+	old := Resources{"r0": {
+		Name:    "r0",
+		Role:    "Primary",
+		Devices: map[int]Device{0: {Minor: 0, Disk: "UpToDate"}, 1: {Minor: 1, Disk: "UpToDate"}},
+		Connections: map[int]Connection{
+			1: {Name: "alpha", Connection: "Connected", PeerRole: "Secondary", PeerDevices: map[int]PeerDevice{
+				0: {Replication: "Established", PeerDisk: "UpToDate"},
+				1: {Replication: "Established", PeerDisk: "UpToDate"},
+			}},
+			2: {Name: "beta", Connection: "Connected", PeerRole: "Secondary", PeerDevices: map[int]PeerDevice{
+				0: {Replication: "Established", PeerDisk: "UpToDate"},
+				1: {Replication: "Established", PeerDisk: "UpToDate"},
+			}},
+		},
+	}}
+	new := Resources{"r0": old["r0"].copy()}
+	new["r0"].Connections[2] = Connection{Name: "beta", Connection: "Connecting", PeerRole: "Unknown", PeerDevices: map[int]PeerDevice{}}
+	pd := new["r0"].Connections[1].PeerDevices
+	pd[1] = PeerDevice{Replication: "SyncSource", PeerDisk: "Inconsistent"}
+
+	changes := DiffResources(old, new)
+	assert.Equal(t, []string{
+		"r0 beta connection:Connected->Connecting",
+		"r0 beta peer-role:Secondary->Unknown",
+		"r0 alpha/1 replication:Established->SyncSource",
+		"r0 alpha/1 peer-disk:UpToDate->Inconsistent",
+		"r0 beta/0 replication:Established->",
+		"r0 beta/0 peer-disk:UpToDate->",
+		"r0 beta/1 replication:Established->",
+		"r0 beta/1 peer-disk:UpToDate->",
+	}, changeStrings(changes), "changes")
+	assert.Empty(t, DiffResources(old, old), "no changes")
+
+	minors := byMinor(old, new, changes)
+	assert.Len(t, minors[0].changes, 4, "minor 0: beta")
+	assert.Len(t, minors[1].changes, 6, "minor 1: beta and alpha")
+	d := Delta{Changes: minors[1].changes}
+	assert.Equal(t, []string{"alpha", "beta"}, d.ChangedPeers(), "peers")
+	assert.Equal(t, []int{1}, d.ChangedVolumes(), "volumes")
+
+	assert.Equal(t, 3, old["r0"].Replicas(1), "replicas")
+	assert.Equal(t, 1, new["r0"].Replicas(1), "replicas after")
+
+	gone := DiffResources(old, Resources{})
+	assert.Equal(t, "r0 role:Primary->", gone[0].String(), "gone")
+}
+
+func changeStrings(changes []Change) []string {
+	s := make([]string, len(changes))
+	for i, c := range changes {
+		s[i] = c.String()
+	}
+	return s
+}
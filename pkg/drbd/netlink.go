@@ -0,0 +1,357 @@
+package drbd
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// NetlinkConn receives messages from the "events" multicast group
+// of the "drbd" generic netlink family.  Each message starts with
+// its netlink header.  It's an interface so that decoding can be
+// tested without a kernel.
+type NetlinkConn interface {
+	// Receive returns no messages, and no error, if nothing arrives
+	// within timeout.  A timeout of zero waits forever.  Close wakes
+	// a blocked Receive.
+	Receive(timeout time.Duration) ([][]byte, error)
+	Close() error
+}
+
+// nativeEndian is the byte order of netlink headers and attributes
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Sizes of the headers at the start of a DRBD notification: the
+// netlink header, the generic netlink header, and the DRBD header
+// (minor and flags).
+const (
+	nlmsgHeaderLen = 16
+	genlHeaderLen  = 4
+	drbdHeaderLen  = 8
+)
+
+// Generic netlink commands and attributes from drbd_genl.h
+const (
+	drbdResourceState     = 34
+	drbdDeviceState       = 35
+	drbdConnectionState   = 36
+	drbdPeerDeviceState   = 37
+	drbdInitialStateDone  = 41
+	drbdNLACfgContext     = 2
+	drbdNLAResourceInfo   = 15
+	drbdNLADeviceInfo     = 16
+	drbdNLAConnectionInfo = 17
+	drbdNLAPeerDeviceInfo = 18
+	drbdNLANotification   = 23
+
+	ctxVolume       = 1
+	ctxResourceName = 2
+	ctxPeerNodeID   = 5
+	ctxConnName     = 6
+
+	nlaTypeMask     = 0x3fff
+	notifyContinues = 0x8000
+
+	// replicationOff is L_OFF from drbd.h.  It is C_CONNECTED so
+	// that replication states follow on from connection states.
+	replicationOff = 9
+)
+
+var notifyVerbs = []string{"exists", "create", "change", "destroy", "call", "response"}
+var roleNames = []string{"Unknown", "Primary", "Secondary"}
+var diskNames = []string{"Diskless", "Attaching", "Detaching", "Failed", "Negotiating",
+	"Inconsistent", "Outdated", "DUnknown", "Consistent", "UpToDate"}
+var connectionStateNames = []string{"StandAlone", "Disconnecting", "Unconnected", "Timeout",
+	"BrokenPipe", "NetworkFailure", "ProtocolError", "TearDown", "Connecting", "Connected"}
+
+// replicationNames start at replicationOff
+var replicationNames = []string{"Off", "Established", "StartingSyncS", "StartingSyncT",
+	"WFBitMapS", "WFBitMapT", "WFSyncUUID", "SyncSource", "SyncTarget", "VerifyS", "VerifyT",
+	"PausedSyncS", "PausedSyncT", "Ahead", "Behind"}
+
+func enumName(names []string, v uint32) string {
+	if int(v) < len(names) {
+		return names[v]
+	}
+	return strconv.Itoa(int(v))
+}
+
+// splitNetlink splits a datagram into netlink messages
+func splitNetlink(b []byte) ([][]byte, error) {
+	var msgs [][]byte
+	for len(b) >= nlmsgHeaderLen {
+		n := int(nativeEndian.Uint32(b))
+		if n < nlmsgHeaderLen || n > len(b) {
+			return nil, errors.Errorf("netlink message length %d with %d bytes left", n, len(b))
+		}
+		msgs = append(msgs, b[:n])
+		if align(n) >= len(b) {
+			break
+		}
+		b = b[align(n):]
+	}
+	return msgs, nil
+}
+
+func align(n int) int {
+	return (n + 3) &^ 3
+}
+
+// attributes splits netlink attributes by type
+func attributes(b []byte) (map[int][]byte, error) {
+	attrs := make(map[int][]byte)
+	for len(b) >= 4 {
+		n := int(nativeEndian.Uint16(b))
+		if n < 4 || n > len(b) {
+			return nil, errors.Errorf("netlink attribute length %d with %d bytes left", n, len(b))
+		}
+		attrs[int(nativeEndian.Uint16(b[2:])&nlaTypeMask)] = b[4:n]
+		if align(n) >= len(b) {
+			break
+		}
+		b = b[align(n):]
+	}
+	return attrs, nil
+}
+
+func attrUint32(attrs map[int][]byte, t int) (uint32, bool) {
+	if b, ok := attrs[t]; ok && len(b) >= 4 {
+		return nativeEndian.Uint32(b), true
+	}
+	return 0, false
+}
+
+func attrString(attrs map[int][]byte, t int) (string, bool) {
+	b, ok := attrs[t]
+	return strings.TrimRight(string(b), "\x00"), ok
+}
+
+// decodeNetlink turns a DRBD notification into the line that
+// "drbdsetup events2" would print for it.  Messages that aren't
+// notifications return "".  continues is true when more messages
+// belong to the same state change.
+func decodeNetlink(msg []byte) (line string, continues bool, err error) {
+	const headers = nlmsgHeaderLen + genlHeaderLen + drbdHeaderLen
+	if len(msg) < headers {
+		return "", false, errors.Errorf("netlink message of %d bytes is too short", len(msg))
+	}
+	command := msg[nlmsgHeaderLen]
+	minor := nativeEndian.Uint32(msg[nlmsgHeaderLen+genlHeaderLen:])
+	var object string
+	switch command {
+	case drbdResourceState:
+		object = "resource"
+	case drbdDeviceState:
+		object = "device"
+	case drbdConnectionState:
+		object = "connection"
+	case drbdPeerDeviceState:
+		object = "peer-device"
+	case drbdInitialStateDone:
+		return "exists -", false, nil
+	default:
+		return "", false, nil
+	}
+	attrs, err := attributes(msg[headers:])
+	if err != nil {
+		return "", false, err
+	}
+	nested := func(t int) (map[int][]byte, error) {
+		return attributes(attrs[t])
+	}
+	header, err := nested(drbdNLANotification)
+	if err != nil {
+		return "", false, err
+	}
+	nh, ok := attrUint32(header, 1)
+	if !ok {
+		return "", false, errors.New("DRBD notification without a type")
+	}
+	continues = nh&notifyContinues != 0
+	nh &^= notifyContinues
+	if int(nh) >= len(notifyVerbs) {
+		return "", false, errors.Errorf("unknown DRBD notification type %d", nh)
+	}
+	verb := notifyVerbs[nh]
+	ctx, err := nested(drbdNLACfgContext)
+	if err != nil {
+		return "", false, err
+	}
+	name, ok := attrString(ctx, ctxResourceName)
+	if !ok {
+		return "", false, errors.Errorf("DRBD %s notification without a resource name", object)
+	}
+	fields := []string{verb, object, "name:" + name}
+	add := func(key, value string) {
+		fields = append(fields, key+":"+value)
+	}
+	if object == "connection" || object == "peer-device" {
+		if id, ok := attrUint32(ctx, ctxPeerNodeID); ok {
+			add("peer-node-id", strconv.Itoa(int(id)))
+		}
+		if c, ok := attrString(ctx, ctxConnName); ok {
+			add("conn-name", c)
+		}
+	}
+	if object == "device" || object == "peer-device" {
+		if v, ok := attrUint32(ctx, ctxVolume); ok {
+			add("volume", strconv.Itoa(int(v)))
+		}
+	}
+	if verb == "destroy" {
+		return strings.Join(fields, " "), continues, nil
+	}
+	var info map[int][]byte
+	switch object {
+	case "resource":
+		info, err = nested(drbdNLAResourceInfo)
+		if v, ok := attrUint32(info, 1); ok {
+			add("role", enumName(roleNames, v))
+		}
+	case "device":
+		add("minor", strconv.Itoa(int(minor)))
+		info, err = nested(drbdNLADeviceInfo)
+		if v, ok := attrUint32(info, 1); ok {
+			add("disk", enumName(diskNames, v))
+		}
+		if b, ok := info[2]; ok && len(b) > 0 {
+			add("client", yesNo(b[0] != 0))
+		}
+		if b, ok := info[3]; ok && len(b) > 0 {
+			add("quorum", yesNo(b[0] != 0))
+		}
+	case "connection":
+		info, err = nested(drbdNLAConnectionInfo)
+		if v, ok := attrUint32(info, 1); ok {
+			add("connection", enumName(connectionStateNames, v))
+		}
+		if v, ok := attrUint32(info, 2); ok {
+			add("role", enumName(roleNames, v))
+		}
+	case "peer-device":
+		info, err = nested(drbdNLAPeerDeviceInfo)
+		if v, ok := attrUint32(info, 1); ok {
+			if v >= replicationOff {
+				add("replication", enumName(replicationNames, v-replicationOff))
+			} else {
+				add("replication", strconv.Itoa(int(v)))
+			}
+		}
+		if v, ok := attrUint32(info, 2); ok {
+			add("peer-disk", enumName(diskNames, v))
+		}
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.Join(fields, " "), continues, nil
+}
+
+// netlinkSource applies DRBD notifications to an Events2.  Each
+// completed state change is read separately so that short-lived
+// states are not missed.  When nothing changes for a nap, the state
+// is returned anyway so that the watcher can tell the source is alive.
+type netlinkSource struct {
+	conn    NetlinkConn
+	nap     time.Duration
+	events  *Events2
+	queue   [][]byte
+	started bool
+	partial bool // part of a state change has been applied
+}
+
+// openNetlink subscribes to notifications and then reads the current
+// state with "drbdsetup events2 --now"
+func (o Options) openNetlink() (*netlinkSource, error) {
+	dial := o.Netlink
+	if dial == nil {
+		dial = DialNetlink
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	events, err := o.events2Now()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &netlinkSource{conn: conn, nap: o.Nap, events: events}, nil
+}
+
+// events2Now reads the current state with "drbdsetup events2 --now"
+func (o Options) events2Now() (*Events2, error) {
+	out, err := o.output()("drbdsetup", "events2", "--now")
+	if err != nil {
+		return nil, err
+	}
+	events := NewEvents2()
+	for _, line := range strings.Split(string(out), "\n") {
+		_, _, err := events.Apply(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// read returns the current state the first time and after that
+// waits for the next completed state change
+func (s *netlinkSource) read(Resources) (Resources, []string, error) {
+	if !s.started {
+		s.started = true
+		return s.events.Resources(), nil, nil
+	}
+	for {
+		if len(s.queue) == 0 {
+			msgs, err := s.conn.Receive(s.nap)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(msgs) == 0 && !s.partial {
+				return s.events.Resources(), nil, nil
+			}
+			s.queue = msgs
+			continue
+		}
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		line, continues, err := decodeNetlink(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == "" {
+			continue
+		}
+		_, changed, err := s.events.Apply(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		if changed && !continues {
+			s.partial = false
+			return s.events.Resources(), nil, nil
+		}
+		s.partial = s.partial || changed
+	}
+}
+
+func (s *netlinkSource) wait() {}
+
+// maybeMissed is false because every notification is read
+func (s *netlinkSource) maybeMissed() bool {
+	return false
+}
+
+func (s *netlinkSource) close() error {
+	return s.conn.Close()
+}
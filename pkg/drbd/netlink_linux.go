@@ -0,0 +1,200 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Generic netlink controller commands and attributes from
+// linux/genetlink.h
+const (
+	genlIDCtrl             = 0x10
+	ctrlCmdGetFamily       = 3
+	ctrlAttrFamilyID       = 1
+	ctrlAttrFamilyName     = 2
+	ctrlAttrMcastGroups    = 7
+	ctrlAttrMcastGroupName = 1
+	ctrlAttrMcastGroupID   = 2
+
+	solNetlink = 270 // from linux/socket.h
+)
+
+type netlinkSocket struct {
+	fd     int
+	family uint16
+	buf    []byte
+	// file is set once subscribed.  Reading through it lets the Go
+	// poller wake a blocked Receive when the socket is closed or the
+	// timeout passes, and keeps the descriptor from being reused while
+	// it's being read.
+	file *os.File
+	conn syscall.RawConn
+}
+
+// DialNetlink subscribes to the "events" multicast group of the
+// "drbd" generic netlink family.  The DRBD 9 kernel module must
+// be loaded.
+func DialNetlink() (NetlinkConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, errors.Wrap(os.NewSyscallError("socket", err), "netlink")
+	}
+	s := &netlinkSocket{fd: fd, buf: make([]byte, 1<<16)}
+	err = s.subscribe()
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	err = s.poll()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// poll hands the socket to the Go poller.  Afterwards the socket must
+// be closed with Close.
+func (s *netlinkSocket) poll() error {
+	err := syscall.SetNonblock(s.fd, true)
+	if err != nil {
+		_ = syscall.Close(s.fd)
+		return errors.Wrap(os.NewSyscallError("setnonblock", err), "netlink")
+	}
+	s.file = os.NewFile(uintptr(s.fd), "netlink")
+	s.conn, err = s.file.SyscallConn()
+	if err != nil {
+		_ = s.file.Close()
+		return errors.Wrap(err, "netlink")
+	}
+	return nil
+}
+
+func (s *netlinkSocket) subscribe() error {
+	err := syscall.Bind(s.fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return errors.Wrap(os.NewSyscallError("bind", err), "netlink")
+	}
+	name := append([]byte("drbd"), 0)
+	attr := make([]byte, align(4+len(name)))
+	nativeEndian.PutUint16(attr, uint16(4+len(name)))
+	nativeEndian.PutUint16(attr[2:], ctrlAttrFamilyName)
+	copy(attr[4:], name)
+	msg := make([]byte, nlmsgHeaderLen+genlHeaderLen, nlmsgHeaderLen+genlHeaderLen+len(attr))
+	msg = append(msg, attr...)
+	nativeEndian.PutUint32(msg, uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], genlIDCtrl)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(msg[8:], 1) // sequence
+	msg[nlmsgHeaderLen] = ctrlCmdGetFamily
+	msg[nlmsgHeaderLen+1] = 1 // version
+	err = syscall.Sendto(s.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return errors.Wrap(os.NewSyscallError("sendto", err), "netlink")
+	}
+	msgs, err := s.receive()
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if nativeEndian.Uint16(m[4:]) == syscall.NLMSG_ERROR {
+			return errors.New("netlink: no drbd generic netlink family, is the DRBD 9 module loaded?")
+		}
+		if len(m) < nlmsgHeaderLen+genlHeaderLen {
+			continue
+		}
+		attrs, err := attributes(m[nlmsgHeaderLen+genlHeaderLen:])
+		if err != nil {
+			return errors.Wrap(err, "netlink family")
+		}
+		if b := attrs[ctrlAttrFamilyID]; len(b) >= 2 {
+			s.family = nativeEndian.Uint16(b)
+		}
+		groups, err := attributes(attrs[ctrlAttrMcastGroups])
+		if err != nil {
+			return errors.Wrap(err, "netlink multicast groups")
+		}
+		for _, g := range groups {
+			group, err := attributes(g)
+			if err != nil {
+				return errors.Wrap(err, "netlink multicast group")
+			}
+			if n, _ := attrString(group, ctrlAttrMcastGroupName); n != "events" {
+				continue
+			}
+			id, ok := attrUint32(group, ctrlAttrMcastGroupID)
+			if !ok {
+				break
+			}
+			err = syscall.SetsockoptInt(s.fd, solNetlink, syscall.NETLINK_ADD_MEMBERSHIP, int(id))
+			if err != nil {
+				return errors.Wrap(os.NewSyscallError("setsockopt", err), "netlink")
+			}
+			return nil
+		}
+	}
+	return errors.New("netlink: drbd has no events multicast group")
+}
+
+func (s *netlinkSocket) receive() ([][]byte, error) {
+	n, _, err := syscall.Recvfrom(s.fd, s.buf, 0)
+	if err != nil {
+		// ENOBUFS means that notifications were lost
+		return nil, errors.Wrap(os.NewSyscallError("recvfrom", err), "netlink")
+	}
+	b := make([]byte, n)
+	copy(b, s.buf[:n])
+	return splitNetlink(b)
+}
+
+// Receive returns the DRBD messages in the next datagram, or nothing
+// if timeout passes first.  A timeout of zero waits forever.
+func (s *netlinkSocket) Receive(timeout time.Duration) ([][]byte, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	err := s.file.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, errors.Wrap(err, "netlink")
+	}
+	var n int
+	var rerr error
+	err = s.conn.Read(func(fd uintptr) bool {
+		n, _, rerr = syscall.Recvfrom(int(fd), s.buf, 0)
+		return rerr != syscall.EAGAIN
+	})
+	if err != nil {
+		if t, ok := err.(interface{ Timeout() bool }); ok && t.Timeout() {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "netlink")
+	}
+	if rerr != nil {
+		// ENOBUFS means that notifications were lost
+		return nil, errors.Wrap(os.NewSyscallError("recvfrom", rerr), "netlink")
+	}
+	b := make([]byte, n)
+	copy(b, s.buf[:n])
+	msgs, err := splitNetlink(b)
+	if err != nil {
+		return nil, err
+	}
+	drbd := msgs[:0]
+	for _, m := range msgs {
+		if nativeEndian.Uint16(m[4:]) == s.family {
+			drbd = append(drbd, m)
+		}
+	}
+	return drbd, nil
+}
+
+// Close wakes a blocked Receive
+func (s *netlinkSocket) Close() error {
+	return s.file.Close()
+}
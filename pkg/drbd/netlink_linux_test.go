@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package drbd
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetlinkSocketClose(t *testing.T) {
+	// a generic netlink socket that isn't subscribed to anything
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		t.Skipf("no netlink: %s", err)
+	}
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}), "bind")
+	s := &netlinkSocket{fd: fd, buf: make([]byte, 1<<16)}
+	require.NoError(t, s.poll(), "poll")
+
+	msgs, err := s.Receive(napTime)
+	assert.NoError(t, err, "timeout")
+	assert.Empty(t, msgs, "timeout")
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Receive(0)
+		errs <- err
+	}()
+	time.Sleep(napTime)
+	require.NoError(t, s.Close(), "close")
+	select {
+	case err := <-errs:
+		assert.Error(t, err, "closed")
+	case <-time.After(napTime * 10):
+		t.Fatal("Receive was not woken by Close")
+	}
+}
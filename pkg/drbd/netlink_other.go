@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package drbd
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DialNetlink is only supported on Linux
+func DialNetlink() (NetlinkConn, error) {
+	return nil, errors.New("netlink requires linux")
+}
@@ -0,0 +1,291 @@
+package drbd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nlAttr encodes a netlink attribute
+func nlAttr(t uint16, value []byte) []byte {
+	b := make([]byte, align(4+len(value)))
+	nativeEndian.PutUint16(b, uint16(4+len(value)))
+	nativeEndian.PutUint16(b[2:], t)
+	copy(b[4:], value)
+	return b
+}
+
+func nlU32(t uint16, v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return nlAttr(t, b)
+}
+
+func nlString(t uint16, s string) []byte {
+	return nlAttr(t, append([]byte(s), 0))
+}
+
+func nlNested(t uint16, attrs ...[]byte) []byte {
+	var b []byte
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	return nlAttr(t|0x8000, b)
+}
+
+// nlMessage encodes a DRBD notification the way the kernel sends it
+func nlMessage(command uint8, minor uint32, attrs ...[]byte) []byte {
+	b := make([]byte, nlmsgHeaderLen+genlHeaderLen+drbdHeaderLen)
+	nativeEndian.PutUint16(b[4:], 0x1c) // family id
+	b[nlmsgHeaderLen] = command
+	b[nlmsgHeaderLen+1] = 2 // version
+	nativeEndian.PutUint32(b[nlmsgHeaderLen+genlHeaderLen:], minor)
+	for _, a := range attrs {
+		b = append(b, a...)
+	}
+	nativeEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func notification(nh uint32) []byte {
+	return nlNested(drbdNLANotification, nlU32(1, nh))
+}
+
+func cfgContext(resource string, attrs ...[]byte) []byte {
+	return nlNested(drbdNLACfgContext, append([][]byte{nlString(ctxResourceName, resource)}, attrs...)...)
+}
+
+var (
+	nlPrimary = nlMessage(drbdResourceState, 0xffffffff,
+		cfgContext("r0"), notification(2), nlNested(drbdNLAResourceInfo, nlU32(1, 1), nlAttr(2, []byte{0})))
+	nlDevice = nlMessage(drbdDeviceState, 3,
+		cfgContext("r0", nlU32(ctxVolume, 0)), notification(1|notifyContinues),
+		nlNested(drbdNLADeviceInfo, nlU32(1, 9), nlAttr(2, []byte{0}), nlAttr(3, []byte{1})))
+	nlConnection = nlMessage(drbdConnectionState, 0xffffffff,
+		cfgContext("r0", nlU32(ctxPeerNodeID, 1), nlString(ctxConnName, "alpha")), notification(1|notifyContinues),
+		nlNested(drbdNLAConnectionInfo, nlU32(1, 9), nlU32(2, 2)))
+	nlPeerDevice = nlMessage(drbdPeerDeviceState, 3,
+		cfgContext("r0", nlU32(ctxVolume, 0), nlU32(ctxPeerNodeID, 1), nlString(ctxConnName, "alpha")), notification(1),
+		nlNested(drbdNLAPeerDeviceInfo, nlU32(1, 16), nlU32(2, 5)))
+	nlDestroy = nlMessage(drbdConnectionState, 0xffffffff,
+		cfgContext("r0", nlU32(ctxPeerNodeID, 1), nlString(ctxConnName, "alpha")), notification(3))
+	nlDone = nlMessage(drbdInitialStateDone, 0)
+)
+
+func TestDecodeNetlink(t *testing.T) {
+	cases := []struct {
+		name      string
+		msg       []byte
+		line      string
+		continues bool
+	}{
+		{"resource", nlPrimary, "change resource name:r0 role:Primary", false},
+		{"device", nlDevice, "create device name:r0 volume:0 minor:3 disk:UpToDate client:no quorum:yes", true},
+		{"connection", nlConnection, "create connection name:r0 peer-node-id:1 conn-name:alpha connection:Connected role:Secondary", true},
+		{"peer device", nlPeerDevice, "create peer-device name:r0 peer-node-id:1 conn-name:alpha volume:0 replication:SyncSource peer-disk:Inconsistent", false},
+		{"destroy", nlDestroy, "destroy connection name:r0 peer-node-id:1 conn-name:alpha", false},
+		{"initial state done", nlDone, "exists -", false},
+		{"not a notification", nlMessage(1, 0), "", false},
+	}
+	for _, tc := range cases {
+		line, continues, err := decodeNetlink(tc.msg)
+		require.NoError(t, err, tc.name)
+		assert.Equal(t, tc.line, line, tc.name)
+		assert.Equal(t, tc.continues, continues, tc.name)
+	}
+
+	_, _, err := decodeNetlink(nlPrimary[:20])
+	assert.Error(t, err, "short")
+	_, _, err = decodeNetlink(nlMessage(drbdResourceState, 0, notification(2)))
+	assert.Error(t, err, "no resource name")
+	_, _, err = decodeNetlink(nlMessage(drbdResourceState, 0, cfgContext("r0"), notification(9)))
+	assert.Error(t, err, "unknown notification type")
+	truncated := append([]byte(nil), nlPrimary...)
+	nativeEndian.PutUint16(truncated[nlmsgHeaderLen+genlHeaderLen+drbdHeaderLen:], 200)
+	_, _, err = decodeNetlink(truncated)
+	assert.Error(t, err, "bad attribute length")
+
+	datagram := append(append([]byte(nil), nlPrimary...), nlDone...)
+	msgs, err := splitNetlink(datagram)
+	require.NoError(t, err, "split")
+	assert.Equal(t, [][]byte{nlPrimary, nlDone}, msgs, "split")
+	_, err = splitNetlink(datagram[:len(nlPrimary)+4+nlmsgHeaderLen])
+	assert.Error(t, err, "truncated datagram")
+}
+
+// readHex reads bytes written as hex, with # comments
+func readHex(t *testing.T, file string) []byte {
+	contents, err := ioutil.ReadFile(file)
+	require.NoError(t, err, file)
+	var digits []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits = append(digits, strings.Fields(line)...)
+	}
+	b, err := hex.DecodeString(strings.Join(digits, ""))
+	require.NoError(t, err, file)
+	return b
+}
+
+// TestNetlinkFixtures decodes the messages in testdata/netlink.  They
+// were assembled by hand from the DRBD 9 and netlink headers rather
+// than with the encoder above, so that a wrong constant in the decoder
+// doesn't go unnoticed.  The expected lines are what "drbdsetup
+// events2" prints for the same notifications.
+func TestNetlinkFixtures(t *testing.T) {
+	if nativeEndian != binary.LittleEndian {
+		t.Skip("the fixtures are little-endian")
+	}
+	files, err := filepath.Glob("testdata/netlink/*.hex")
+	require.NoError(t, err, "glob")
+	require.NotEmpty(t, files, "fixtures")
+	type decoded struct {
+		Line      string `json:"line"`
+		Continues bool   `json:"continues"`
+	}
+	for _, file := range files {
+		msgs, err := splitNetlink(readHex(t, file))
+		require.NoError(t, err, file)
+		var got []decoded
+		for _, msg := range msgs {
+			line, continues, err := decodeNetlink(msg)
+			require.NoError(t, err, file)
+			got = append(got, decoded{line, continues})
+		}
+		expected := strings.TrimSuffix(file, ".hex") + ".json"
+		b, err := ioutil.ReadFile(expected)
+		require.NoError(t, err, expected)
+		var want []decoded
+		require.NoError(t, json.Unmarshal(b, &want), expected)
+		assert.Equal(t, want, got, file)
+	}
+}
+
+// fakeNetlink delivers datagrams and then fails.  An empty datagram
+// is a timeout.
+type fakeNetlink struct {
+	datagrams [][][]byte
+	closed    bool
+}
+
+func (f *fakeNetlink) Receive(time.Duration) ([][]byte, error) {
+	if len(f.datagrams) == 0 {
+		return nil, errors.New("no more notifications")
+	}
+	d := f.datagrams[0]
+	f.datagrams = f.datagrams[1:]
+	return d, nil
+}
+
+func (f *fakeNetlink) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestNetlinkSource(t *testing.T) {
+	conn := &fakeNetlink{datagrams: [][][]byte{
+		{nlDevice, nlConnection},
+		{},
+		{nlPeerDevice, nlMessage(1, 0)},
+		{},
+		{nlPrimary, nlDestroy},
+	}}
+	now := strings.Join([]string{
+		"exists resource name:r0 role:Secondary",
+		"exists -",
+	}, "\n")
+	o := Options{
+		Source:  SourceNetlink,
+		Netlink: func() (NetlinkConn, error) { return conn, nil },
+		Output: func(name string, args ...string) ([]byte, error) {
+			assert.Equal(t, "drbdsetup events2 --now", name+" "+strings.Join(args, " "), "initial state")
+			return []byte(now), nil
+		},
+	}
+	src, err := o.openSource()
+	require.NoError(t, err, "open")
+	rs, _, err := src.read(nil)
+	require.NoError(t, err, "initial")
+	assert.Empty(t, rs.States(), "no devices yet")
+
+	// the device and connection continue into the peer device, even
+	// after a timeout
+	rs, _, err = src.read(rs)
+	require.NoError(t, err, "created")
+	assert.Equal(t, State{Connection: "SyncSource", SelfRole: "Secondary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "Inconsistent"},
+		rs.States()[3], "created")
+
+	// nothing happened for a nap
+	again, _, err := src.read(rs)
+	require.NoError(t, err, "timed out")
+	assert.Equal(t, rs.States(), again.States(), "unchanged after a timeout")
+
+	// each change is read separately
+	rs, _, err = src.read(rs)
+	require.NoError(t, err, "promoted")
+	assert.Equal(t, "Primary", rs.States()[3].SelfRole, "promoted")
+	assert.Equal(t, "SyncSource", rs.States()[3].Connection, "still connected")
+	rs, _, err = src.read(rs)
+	require.NoError(t, err, "disconnected")
+	assert.Equal(t, "StandAlone", rs.States()[3].Connection, "disconnected")
+
+	_, _, err = src.read(rs)
+	assert.Error(t, err, "connection failed")
+	require.NoError(t, src.close(), "close")
+	assert.True(t, conn.closed, "closed")
+
+	o.Netlink = func() (NetlinkConn, error) { return nil, errors.New("no drbd") }
+	_, err = o.openSource()
+	assert.Error(t, err, "dial failed")
+}
+
+// blockedNetlink never receives anything, and wakes up when closed
+type blockedNetlink struct {
+	closed chan struct{}
+}
+
+func (b *blockedNetlink) Receive(time.Duration) ([][]byte, error) {
+	<-b.closed
+	return nil, errors.New("closed")
+}
+
+func (b *blockedNetlink) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestNetlinkStop(t *testing.T) {
+	c := NewControl()
+	errs := make(chan error, 1)
+	o := Options{
+		Source:  SourceNetlink,
+		Control: c,
+		Netlink: func() (NetlinkConn, error) { return &blockedNetlink{closed: make(chan struct{})}, nil },
+		Output: func(string, ...string) ([]byte, error) {
+			return []byte("exists resource name:r0 role:Secondary\nexists -\n"), nil
+		},
+		ReadRetries: 3,
+	}
+	go func() {
+		errs <- o.React(func(Delta) error { return nil })
+	}()
+	time.Sleep(napTime)
+	c.Stop()
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("netlink source did not stop")
+	}
+}
@@ -0,0 +1,187 @@
+package drbd
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Options controls how changes in /proc/drbd are detected and
+// dispatched.  The zero value behaves like Invoke and RunCommandOnChange
+// always have: every change is dispatched as soon as it is seen.
+type Options struct {
+	// ProcDRBD defaults to "/proc/drbd" -- it can be overridden for testing
+	ProcDRBD string
+	// Fstab defaults to "/etc/fstab"
+	Fstab string
+	// ProcMounts defaults to "/proc/mounts"
+	ProcMounts string
+	// Nap is how long to wait between checks of the Source.
+	// SourceNetlink waits up to Nap for a notification.
+	Nap time.Duration
+	// FastNap, if set, is used instead of Nap while any disk, peer
+	// disk, or connection is not in a steady state, such as during a
+	// resync.
+	FastNap time.Duration
+	// MissedGap is how far apart checks can be before deltas are
+	// marked MaybeMissed.  It defaults to twice the nap.
+	MissedGap time.Duration
+	// Source is where the state is read from.  It defaults to
+	// SourceProcDRBD.
+	Source Source
+	// Output runs drbdsetup for SourceDrbdsetup.  It defaults to
+	// ExecOutput.
+	Output OutputRunner
+	// Netlink opens the connection for SourceNetlink.  It defaults
+	// to DialNetlink.
+	Netlink func() (NetlinkConn, error)
+	// Lenient makes lines in ProcDRBD that can't be parsed into
+	// logged warnings rather than errors that stop the watcher.
+	Lenient bool
+	// ReadRetries is how many consecutive failed reads of the Source
+	// are logged and retried before the watcher stops.  Zero stops
+	// at the first.
+	ReadRetries int
+
+	// Settle is how long a change must persist before it is dispatched.
+	// A change that reverts within Settle is never dispatched at all.
+	Settle time.Duration
+	// FlapCount is the number of transitions within FlapWindow that
+	// mark a resource as flapping.  Zero disables flap detection.
+	FlapCount int
+	// FlapWindow is both the window for counting transitions and how
+	// long a flapping resource must be quiet before it is no longer
+	// considered to be flapping.
+	FlapWindow time.Duration
+
+	// MaxParallel limits the number of callbacks that can be running
+	// at once.  Set it to 1 to handle one resource at a time.  Zero
+	// means no limit.
+	MaxParallel int
+	// Groups are sets of resources that must be handled one at a time,
+	// in dependency order.
+	Groups []Group
+
+	// Failover groups are brought up or torn down when the role
+	// of one of their resources changes.  This happens before the
+	// command is run by RunCommandOnChange.
+	Failover []FailoverGroup
+	// Run runs the commands for Failover.  It defaults to ExecRunner.
+	Run Runner
+
+	// MinReplicas is, by resource name, the fewest UpToDate copies
+	// of each volume before EventReplicaCountBelow.
+	MinReplicas map[string]int
+	// Expected is, by resource name, the state that resources should
+	// be in.  A resource that is in a different state for DriftGrace
+	// is dispatched as Drifted and, once it is back, as Converged.
+	Expected   map[string]Expected
+	DriftGrace time.Duration
+
+	// StateFile, if set, is where the last known states are saved so
+	// that they survive restarts.
+	StateFile string
+	// Startup says what to dispatch when starting.  The default is
+	// StartupInitial.
+	Startup Startup
+
+	// Journal, if set, records every Delta, the events of the ones that
+	// are dispatched, and the results of the commands run by
+	// RunCommandOnChange.
+	Journal *Journal
+	// CommandDone, if set, is called after each command run by
+	// RunCommandOnChange has finished.
+	CommandDone func(delta Delta, cmd *exec.Cmd, err error)
+	// Polled, if set, is called with what was read after each
+	// successful read of the Source.  It must not block.
+	Polled func(Resources)
+
+	// Control, if set, can stop, reload, and inspect the watcher
+	Control *Control
+	// StopTimeout is how long Invoke waits, once stopped, for the
+	// callbacks that are running.  Zero means no limit.
+	StopTimeout time.Duration
+
+	// Clock defaults to the real clock.  Tests can use a ManualClock.
+	Clock Clock
+	// FS is used to read ProcDRBD, Fstab, and ProcMounts.  It defaults
+	// to the real filesystem.  Tests can use a MemFS.
+	FS FS
+}
+
+// Group is a set of resources, in dependency order.  When several
+// resources in a group have changes waiting, the one listed first is
+// handled first.
+type Group struct {
+	Name      string
+	Resources []int
+}
+
+// Validate checks for settings that are inconsistent or that would stop
+// the watcher once it has started
+func (o Options) Validate() error {
+	switch o.Source {
+	case SourceProcDRBD, SourceDrbdsetup, SourceNetlink, "":
+	default:
+		return errors.Errorf("invalid source '%s'", o.Source)
+	}
+	switch o.Startup {
+	case StartupInitial, StartupChanges, StartupNone, "":
+	default:
+		return errors.Errorf("invalid startup policy '%s'", o.Startup)
+	}
+	if o.Nap < 0 || o.FastNap < 0 || o.MissedGap < 0 || o.Settle < 0 || o.DriftGrace < 0 || o.StopTimeout < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if o.FlapCount > 0 && o.FlapWindow <= 0 {
+		return errors.New("flap detection needs a flap window")
+	}
+	if o.Startup == StartupChanges && o.StateFile == "" {
+		return errors.Errorf("startup policy '%s' needs a state file", o.Startup)
+	}
+	if o.ReadRetries < 0 {
+		return errors.New("read retries must not be negative")
+	}
+	for name, n := range o.MinReplicas {
+		if n < 0 {
+			return errors.Errorf("min replicas for %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (o Options) procDRBD() string {
+	if o.ProcDRBD == "" {
+		return "/proc/drbd"
+	}
+	return o.ProcDRBD
+}
+
+func (o Options) fstab() string {
+	if o.Fstab == "" {
+		return "/etc/fstab"
+	}
+	return o.Fstab
+}
+
+func (o Options) procMounts() string {
+	if o.ProcMounts == "" {
+		return "/proc/mounts"
+	}
+	return o.ProcMounts
+}
+
+func (o Options) clock() Clock {
+	if o.Clock == nil {
+		return realClock{}
+	}
+	return o.Clock
+}
+
+func (o Options) fs() FS {
+	if o.FS == nil {
+		return osFS{}
+	}
+	return o.FS
+}
@@ -0,0 +1,27 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Options{}.Validate(), "zero value")
+	assert.NoError(t, Options{Source: SourceNetlink, Startup: StartupChanges, StateFile: "/var/lib/states.json"}.Validate(), "valid")
+	cases := []struct {
+		name string
+		o    Options
+	}{
+		{"source", Options{Source: "kernel"}},
+		{"startup", Options{Startup: "everything"}},
+		{"negative", Options{Settle: -time.Second}},
+		{"flap window", Options{FlapCount: 3}},
+		{"state file", Options{Startup: StartupChanges}},
+		{"min replicas", Options{MinReplicas: map[string]int{"r0": -1}}},
+	}
+	for _, tc := range cases {
+		assert.Error(t, tc.o.Validate(), tc.name)
+	}
+}
@@ -3,15 +3,123 @@ package drbd
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 type Delta struct {
-	Resource     int
-	Old          State
-	New          State
+	// Resource is the minor number.  It is negative for an expected
+	// resource that doesn't exist, when its name isn't like r3.
+	Resource int
+	// Name and Volume identify the device within a DRBD resource
+	Name   string
+	Volume int
+	Old    State
+	New    State
+	// Changes is what changed for each peer and volume
+	Changes []Change
+	// UnchangedFor is how long the resource was in the Old state
 	UnchangedFor time.Duration
+	// Seen is when the New state was first seen
+	Seen time.Time
+	// LastChanged is when each part of the Old state was first seen
+	LastChanged Changes
+	// OldQuorum and NewQuorum are "yes" or "no", or "" when quorum
+	// isn't known (DRBD 8)
+	OldQuorum string
+	NewQuorum string
+	// OldReplicas and NewReplicas count the UpToDate copies of the volume
+	OldReplicas int
+	NewReplicas int
+	// MinReplicas is the configured minimum for NewReplicas, zero if none
+	MinReplicas int
+	// Flapping is set when the resource has changed too often.  Further
+	// changes are suppressed until it stops changing.
+	Flapping bool
+	// MaybeMissed is set when the state was read too long after the
+	// prior read to be sure that nothing came and went in between.
+	// It isn't a promise: changes that last less than a nap can be
+	// missed between reads that are on time.
+	MaybeMissed bool
+	// Drifted is set when the resource has been away from its
+	// Options.Expected state for DriftGrace, and Converged when it is
+	// back.  Drift says how it differs.  These deltas don't change
+	// the state.
+	Drifted   bool
+	Converged bool
+	Drift     []string
+}
+
+// Changes records when parts of a resource's state last changed
+type Changes struct {
+	Any        time.Time `json:"any"`
+	Connection time.Time `json:"connection"`
+	Role       time.Time `json:"role"` // self or remote
+	Disk       time.Time `json:"disk"` // self or remote
+}
+
+// since combines two deltas for the same resource: the earlier
+// one's Old state, and how long it was stable, with d's New state.
+// Changes to the same field are combined the same way.
+func (d Delta) since(earlier Delta) Delta {
+	d.Old = earlier.Old
+	d.OldQuorum = earlier.OldQuorum
+	d.OldReplicas = earlier.OldReplicas
+	d.Changes = mergeChanges(earlier.Changes, d.Changes)
+	d.LastChanged = earlier.LastChanged
+	d.MaybeMissed = d.MaybeMissed || earlier.MaybeMissed
+	if !d.Drifted && !d.Converged {
+		d.Drifted, d.Converged, d.Drift = earlier.Drifted, earlier.Converged, earlier.Drift
+	}
+	d.UnchangedFor = d.Seen.Sub(earlier.LastChanged.Any)
+	return d
+}
+
+// unchanged is true when the state, quorum, and replica count are
+// back where they started
+func (d Delta) unchanged() bool {
+	return d.New.Equal(d.Old) && d.NewQuorum == d.OldQuorum && d.NewReplicas == d.OldReplicas
+}
+
+// ConnectionStable is how long the connection state was unchanged
+func (d Delta) ConnectionStable() time.Duration {
+	return d.Seen.Sub(d.LastChanged.Connection)
+}
+
+// RoleStable is how long the self and remote roles were unchanged
+func (d Delta) RoleStable() time.Duration {
+	return d.Seen.Sub(d.LastChanged.Role)
+}
+
+// DiskStable is how long the self and remote disk states were unchanged
+func (d Delta) DiskStable() time.Duration {
+	return d.Seen.Sub(d.LastChanged.Disk)
+}
+
+// update returns the change times after a change from old to new.
+// Unknown times are assumed to be start.
+func (c Changes) update(old, new State, at time.Time, start time.Time) (Changes, Changes) {
+	for _, t := range []*time.Time{&c.Any, &c.Connection, &c.Role, &c.Disk} {
+		if t.IsZero() {
+			*t = start
+		}
+	}
+	prior := c
+	c.Any = at
+	if old.Connection != new.Connection {
+		c.Connection = at
+	}
+	if old.SelfRole != new.SelfRole || old.RemoteRole != new.RemoteRole {
+		c.Role = at
+	}
+	if old.SelfDisk != new.SelfDisk || old.RemoteDisk != new.RemoteDisk {
+		c.Disk = at
+	}
+	return prior, c
 }
 
 // React watches /proc/drbd and when there has been a change,
@@ -19,23 +127,157 @@ type Delta struct {
 // filename is presumed to be "/proc/drbd" -- it's a parameter for testing
 // purposes.  React does not return except if there is an error.
 func React(filename string, nap time.Duration, callback func(Delta) error) error {
+	return Options{ProcDRBD: filename, Nap: nap}.React(callback)
+}
+
+// React is like the React function but it starts according to
+// the StateFile and Startup options and saves the state after
+// each change.  It returns ErrStopped once Options.Control is stopped.
+func (o Options) React(callback func(Delta) error) error {
+	o.Control.start(o.clock())
 	states := make(States)
+	start := o.clock().Now()
+	changed := make(map[int]Changes)
+	var saved States
+	if o.StateFile != "" {
+		var err error
+		saved, changed, err = loadStateFile(o.StateFile)
+		if err != nil {
+			return err
+		}
+	}
+	src, err := o.openSource()
+	if err != nil {
+		return err
+	}
+	var closeOnce sync.Once
+	closeSource := func() {
+		closeOnce.Do(func() {
+			_ = src.close()
+		})
+	}
+	defer closeSource()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		// a source that is waiting for notifications wakes up
+		// when it is closed
+		select {
+		case <-o.Control.stopped():
+			closeSource()
+		case <-stopped:
+		}
+	}()
+	var initialOld States
+	// resources is nil until the first change has been dispatched
+	var resources Resources
+	switch o.Startup {
+	case StartupChanges:
+		for r, state := range saved {
+			states[r] = state
+		}
+	case StartupNone:
+		current, _, err := src.read(nil)
+		if err != nil {
+			return err
+		}
+		if o.Polled != nil {
+			o.Polled(current)
+		}
+		resources = current
+		states = current.States()
+	case StartupInitial, "":
+		initialOld = saved
+	default:
+		return errors.Errorf("invalid startup policy '%s'", o.Startup)
+	}
 	for {
-		b := time.Now()
-		before, after, err := Watch(filename, states, nap)
-		a := time.Now()
+		o.Control.seen(states)
+		current, err := o.watchResources(src, resources, states)
+		a := o.clock().Now()
+		if o.Control.isStopped() {
+			return ErrStopped
+		}
 		if err != nil {
 			return err
 		}
-		for r, state := range after {
-			log.Printf("r0 changed state: %s\n", StateDiff(state, before[r]))
+		after := current.States()
+		missed := src.maybeMissed()
+		olds := make(States)
+		minors := make(map[int]bool)
+		for r, state := range states {
+			olds[r] = state
+			minors[r] = true
+		}
+		for r := range after {
+			minors[r] = true
+		}
+		// a saved resource that is gone by now disappeared while the
+		// watcher wasn't running
+		for r, s := range initialOld {
+			olds[r] = s
+			minors[r] = true
+		}
+		oldResources := resources
+		if oldResources == nil {
+			oldResources = statesToResources(olds, current)
+		}
+		changes := byMinor(oldResources, current, DiffResources(oldResources, current))
+		for r := range minors {
+			old, state := olds[r], after[r]
+			mc, ok := changes[r]
+			if states[r].Equal(state) && old.Equal(state) && (resources == nil || !ok) {
+				continue
+			}
+			if !ok {
+				mc = &minorChanges{name: "r" + strconv.Itoa(r)}
+				for _, rs := range []Resources{current, oldResources} {
+					if name, volume, found := rs.locate(r); found {
+						mc.name, mc.volume = name, volume
+						break
+					}
+				}
+			}
+			diff := StateDiff(state, old)
+			if old.Equal(state) {
+				diff = describeChanges(mc.changes)
+			}
+			log.Printf("r%d changed state: %s\n", r, diff)
+			prior, now := changed[r].update(old, state, a, start)
+			or, nr := oldResources[mc.name], current[mc.name]
 			go callback(Delta{
 				Resource:     r,
-				Old:          before[r],
+				Name:         mc.name,
+				Volume:       mc.volume,
+				Old:          old,
 				New:          state,
-				UnchangedFor: a.Sub(b),
+				Changes:      mc.changes,
+				OldQuorum:    or.Devices[mc.volume].Quorum,
+				NewQuorum:    nr.Devices[mc.volume].Quorum,
+				OldReplicas:  or.Replicas(mc.volume),
+				NewReplicas:  nr.Replicas(mc.volume),
+				MinReplicas:  o.minReplicasFor(mc.name),
+				UnchangedFor: a.Sub(prior.Any),
+				Seen:         a,
+				LastChanged:  prior,
+				MaybeMissed:  missed,
 			})
+			if state.Equal(State{}) {
+				// the resource went away
+				delete(states, r)
+				delete(changed, r)
+				continue
+			}
 			states[r] = state
+			changed[r] = now
+		}
+		resources = current
+		initialOld = nil
+		if o.StateFile != "" {
+			err := saveStateFile(o.StateFile, states, changed)
+			if err != nil {
+				log.Println(err)
+			}
 		}
 	}
 }
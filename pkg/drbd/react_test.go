@@ -0,0 +1,69 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	t1 := start.Add(time.Minute)
+	t2 := start.Add(time.Hour)
+
+	prior, c := Changes{}.update(State{}, stateConnected, t1, start)
+	assert.Equal(t, Changes{Any: start, Connection: start, Role: start, Disk: start}, prior, "unknown times are start")
+	assert.Equal(t, Changes{Any: t1, Connection: t1, Role: t1, Disk: t1}, c, "everything changed")
+
+	prior, c = c.update(stateConnected, stateDisconnected, t2, start)
+	assert.Equal(t, Changes{Any: t2, Connection: t2, Role: t2, Disk: t2}, c, "connection and remote changed")
+
+	reconnected := stateDisconnected
+	reconnected.Connection = "Connected"
+	_, c = c.update(stateDisconnected, reconnected, t2.Add(time.Second), start)
+	assert.Equal(t, t2.Add(time.Second), c.Connection, "connection changed")
+	assert.Equal(t, t2, c.Role, "role did not change")
+
+	d := Delta{Seen: t2.Add(time.Minute), LastChanged: c}
+	assert.Equal(t, time.Minute-time.Second, d.ConnectionStable(), "connection stable")
+	assert.Equal(t, time.Minute, d.RoleStable(), "role stable")
+	assert.Equal(t, time.Minute, d.DiskStable(), "disk stable")
+}
+
+func TestDeltaSince(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	earlier := Delta{
+		Resource:    0,
+		Old:         stateConnected,
+		New:         stateDisconnected,
+		Seen:        start.Add(time.Hour),
+		LastChanged: Changes{Any: start},
+	}
+	later := Delta{
+		Resource:    0,
+		Old:         stateDisconnected,
+		New:         State{},
+		Seen:        start.Add(2 * time.Hour),
+		LastChanged: Changes{Any: start.Add(time.Hour)},
+	}
+	merged := later.since(earlier)
+	assert.Equal(t, stateConnected, merged.Old, "old")
+	assert.Equal(t, State{}, merged.New, "new")
+	assert.Equal(t, 2*time.Hour, merged.UnchangedFor, "unchanged for")
+
+	flip := func(from, to string) Change {
+		return Change{Object: "connection", Resource: "r0", PeerNodeID: 1, Field: "connection", Old: from, New: to}
+	}
+	role := Change{Object: "resource", Resource: "r0", Field: "role", Old: "Secondary", New: "Primary"}
+	earlier.Changes = []Change{flip("Connected", "Connecting"), role}
+	later.Changes = []Change{flip("Connecting", "Connected")}
+	merged = later.since(earlier)
+	later = Delta{Changes: []Change{flip("Connected", "Connecting")}}
+	merged = later.since(merged)
+	assert.Equal(t, []Change{role, flip("Connected", "Connecting")}, merged.Changes, "first old to last new")
+
+	later.Changes = []Change{flip("Connecting", "Connected")}
+	merged = later.since(merged)
+	assert.Equal(t, []Change{role}, merged.Changes, "back where it started")
+}
@@ -0,0 +1,247 @@
+package drbd
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentPrefix = "drbd-"
+	segmentSuffix = ".jsonl.gz"
+	segmentTime   = "20060102T150405.000000000Z"
+)
+
+// Recorder saves the raw text of /proc/drbd and /proc/mounts each time
+// either changes.  Snapshots are written as gzip compressed JSON lines in
+// segment files in Dir.  A segment is finished when it reaches
+// SegmentSize bytes.  Finished segments are removed when they are older
+// than MaxAge or when all segments together are larger than MaxSize.
+// Zero values mean no limit.  Record also checks for old segments
+// every PruneInterval, or every minute if that is zero, so that they
+// are removed even when nothing changes.
+type Recorder struct {
+	Dir           string
+	SegmentSize   int64
+	MaxSize       int64
+	MaxAge        time.Duration
+	PruneInterval time.Duration
+
+	current string
+	fh      *os.File
+	gz      *gzip.Writer
+}
+
+// Record polls until ctx is done or there is an error
+func (rec *Recorder) Record(ctx context.Context, o Options) error {
+	defer rec.Close()
+	var last Snapshot
+	pruned := time.Now()
+	for {
+		procDRBD, err := readRaw(o.procDRBD())
+		if err != nil {
+			return err
+		}
+		mounts, err := readRaw(o.procMounts())
+		if err != nil {
+			return err
+		}
+		if procDRBD != last.ProcDRBD || mounts != last.Mounts {
+			last = Snapshot{
+				Time:     time.Now(),
+				ProcDRBD: procDRBD,
+				Mounts:   mounts,
+			}
+			err := rec.Write(last)
+			if err != nil {
+				return err
+			}
+		}
+		if time.Since(pruned) >= rec.pruneInterval() {
+			pruned = time.Now()
+			err := rec.prune()
+			if err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.Nap):
+		}
+	}
+}
+
+// readRaw returns the contents of a file, or "" if it doesn't exist
+func readRaw(filename string) (string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "read %s", filename)
+	}
+	return string(b), nil
+}
+
+// Write adds a snapshot to the current segment, starting a new
+// segment if needed
+func (rec *Recorder) Write(s Snapshot) error {
+	if rec.fh != nil && rec.SegmentSize > 0 {
+		fi, err := rec.fh.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "stat %s", rec.current)
+		}
+		if fi.Size() >= rec.SegmentSize {
+			err := rec.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if rec.fh == nil {
+		err := rec.start(s.Time)
+		if err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "encode snapshot")
+	}
+	_, err = rec.gz.Write(append(b, '\n'))
+	if err == nil {
+		// flush so that a crash doesn't lose the snapshot
+		err = rec.gz.Flush()
+	}
+	return errors.Wrapf(err, "write %s", rec.current)
+}
+
+func (rec *Recorder) start(t time.Time) error {
+	err := os.MkdirAll(rec.Dir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", rec.Dir)
+	}
+	rec.current = filepath.Join(rec.Dir, segmentPrefix+t.UTC().Format(segmentTime)+segmentSuffix)
+	rec.fh, err = os.OpenFile(rec.current, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", rec.current)
+	}
+	rec.gz = gzip.NewWriter(rec.fh)
+	return rec.prune()
+}
+
+// Close finishes the current segment
+func (rec *Recorder) Close() error {
+	if rec.fh == nil {
+		return nil
+	}
+	err := rec.gz.Close()
+	if cerr := rec.fh.Close(); err == nil {
+		err = cerr
+	}
+	rec.fh = nil
+	rec.gz = nil
+	return errors.Wrapf(err, "close %s", rec.current)
+}
+
+func (rec *Recorder) pruneInterval() time.Duration {
+	if rec.PruneInterval > 0 {
+		return rec.PruneInterval
+	}
+	return time.Minute
+}
+
+// prune removes old segments, never the current one
+func (rec *Recorder) prune() error {
+	segments, err := listSegments(rec.Dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	keep := make([]os.FileInfo, 0, len(segments))
+	for _, fi := range segments {
+		if filepath.Join(rec.Dir, fi.Name()) == rec.current {
+			continue
+		}
+		if rec.MaxAge > 0 && time.Since(fi.ModTime()) > rec.MaxAge {
+			err := os.Remove(filepath.Join(rec.Dir, fi.Name()))
+			if err != nil {
+				return errors.Wrap(err, "prune recording")
+			}
+			continue
+		}
+		total += fi.Size()
+		keep = append(keep, fi)
+	}
+	for len(keep) > 0 && rec.MaxSize > 0 && total > rec.MaxSize {
+		err := os.Remove(filepath.Join(rec.Dir, keep[0].Name()))
+		if err != nil {
+			return errors.Wrap(err, "prune recording")
+		}
+		total -= keep[0].Size()
+		keep = keep[1:]
+	}
+	return nil
+}
+
+// listSegments returns the segments in a directory, oldest first
+func listSegments(dir string) ([]os.FileInfo, error) {
+	all, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read directory %s", dir)
+	}
+	segments := make([]os.FileInfo, 0, len(all))
+	for _, fi := range all {
+		if strings.HasPrefix(fi.Name(), segmentPrefix) && strings.HasSuffix(fi.Name(), segmentSuffix) {
+			segments = append(segments, fi)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].Name() < segments[j].Name()
+	})
+	return segments, nil
+}
+
+// ReadRecording reads snapshots from a file (see ReadSnapshots) or
+// from a directory written by a Recorder
+func ReadRecording(path string) ([]Snapshot, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "stat %s", path)
+	}
+	files := []string{path}
+	if fi.IsDir() {
+		segments, err := listSegments(path)
+		if err != nil {
+			return nil, err
+		}
+		files = files[:0]
+		for _, s := range segments {
+			files = append(files, filepath.Join(path, s.Name()))
+		}
+	}
+	var snapshots []Snapshot
+	for i, file := range files {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open %s", file)
+		}
+		// only the newest segment can still be being written
+		s, err := readSnapshots(fh, i == len(files)-1)
+		fh.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+		snapshots = append(snapshots, s...)
+	}
+	return snapshots, nil
+}
@@ -0,0 +1,113 @@
+package drbd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecorderSegments(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "") + "/recording"
+	rec := &Recorder{Dir: dir, SegmentSize: 100, MaxSize: 1000}
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, rec.Write(Snapshot{
+			Time:     start.Add(time.Duration(i) * time.Second),
+			ProcDRBD: exampleProcDRBD1 + strings.Repeat("x", i),
+		}), "write")
+	}
+
+	got, err := ReadRecording(dir)
+	require.NoError(t, err, "read unfinished")
+	require.NotEmpty(t, got, "snapshots")
+	assert.Equal(t, exampleProcDRBD1+strings.Repeat("x", 49), got[len(got)-1].ProcDRBD, "last snapshot, unfinished segment")
+	assert.True(t, got[0].Time.After(start), "oldest pruned")
+	for i := 1; i < len(got); i++ {
+		assert.True(t, got[i].Time.After(got[i-1].Time), "in order")
+	}
+	require.NoError(t, rec.Close(), "close")
+
+	segments, err := listSegments(dir)
+	require.NoError(t, err, "list")
+	var total int64
+	for _, s := range segments[:len(segments)-1] {
+		total += s.Size()
+	}
+	assert.True(t, total <= 1000, "max size: "+strconv.FormatInt(total, 10))
+}
+
+func TestRecorderMaxAge(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	old := dir + "/" + segmentPrefix + "20190101T000000.000000000Z" + segmentSuffix
+	require.NoError(t, ioutil.WriteFile(old, nil, 0644), "old segment")
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)), "age")
+	rec := &Recorder{Dir: dir, MaxAge: time.Hour}
+	require.NoError(t, rec.Write(Snapshot{Time: time.Now(), ProcDRBD: exampleProcDRBD1}), "write")
+	require.NoError(t, rec.Close(), "close")
+	assert.NoFileExists(t, old, "pruned")
+}
+
+func TestRecordPrunesWhenQuiet(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	o := Options{
+		ProcDRBD:   dir + "/proc-drbd",
+		ProcMounts: dir + "/proc-mounts",
+		Nap:        napTime / 20,
+	}
+	writeFile(t, o.ProcDRBD, exampleProcDRBD1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- (&Recorder{Dir: dir, MaxAge: time.Hour, PruneInterval: napTime / 10}).Record(ctx, o)
+	}()
+	time.Sleep(napTime / 2)
+	// written after the first segment was started, and nothing changes
+	old := dir + "/" + segmentPrefix + "20190101T000000.000000000Z" + segmentSuffix
+	require.NoError(t, ioutil.WriteFile(old, nil, 0644), "old segment")
+	require.NoError(t, os.Chtimes(old, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)), "age")
+	time.Sleep(napTime / 2)
+	cancel()
+	require.NoError(t, <-done, "record")
+	assert.NoFileExists(t, old, "pruned")
+}
+
+func TestRecord(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	o := Options{
+		ProcDRBD:   dir + "/proc-drbd",
+		ProcMounts: dir + "/proc-mounts",
+		Nap:        napTime / 20,
+	}
+	writeFile(t, o.ProcDRBD, exampleProcDRBD1)
+	writeFile(t, o.ProcMounts, exampleProcMounts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- (&Recorder{Dir: dir + "/recording"}).Record(ctx, o)
+	}()
+	time.Sleep(napTime / 2)
+	writeFile(t, o.ProcDRBD, "garbage")
+	time.Sleep(napTime / 2)
+	cancel()
+	require.NoError(t, <-done, "record")
+
+	got, err := ReadRecording(dir + "/recording")
+	require.NoError(t, err, "read")
+	if assert.Len(t, got, 2, "snapshots") {
+		assert.Equal(t, exampleProcDRBD1, got[0].ProcDRBD, "first")
+		assert.Equal(t, exampleProcMounts, got[0].Mounts, "mounts")
+		assert.Equal(t, "garbage", got[1].ProcDRBD, "unparsable text is kept")
+	}
+}
@@ -0,0 +1,31 @@
+package drbd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RenderProcDRBD produces /proc/drbd text, in the DRBD 8.4 format,
+// that getStates will parse back into states.
+func RenderProcDRBD(states States) string {
+	var b strings.Builder
+	b.WriteString("version: 8.4.11 (api:1/proto:86-101)\n")
+	b.WriteString("srcversion: 0000000000000000000000\n")
+	resources := make([]int, 0, len(states))
+	for r := range states {
+		resources = append(resources, r)
+	}
+	sort.Ints(resources)
+	for _, r := range resources {
+		s := states[r]
+		if s.Unconfigured() {
+			fmt.Fprintf(&b, "%2d: cs:Unconfigured\n", r)
+			continue
+		}
+		fmt.Fprintf(&b, "%2d: cs:%s ro:%s/%s ds:%s/%s C r-----\n",
+			r, s.Connection, s.SelfRole, s.RemoteRole, s.SelfDisk, s.RemoteDisk)
+		b.WriteString("    ns:0 nr:0 dw:0 dr:0 al:0 bm:0 lo:0 pe:0 ua:0 ap:0 ep:1 wo:f oos:0\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,20 @@
+package drbd
+
+import (
+	"testing"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderProcDRBD(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	procDRBD := dir + "/proc-drbd"
+	want := States{0: stateConnected, 3: stateDisconnected, 12: {Connection: "Unconfigured"}}
+	writeFile(t, procDRBD, RenderProcDRBD(want))
+	got, err := getStates(procDRBD)
+	require.NoError(t, err, "parse rendered")
+	assert.Equal(t, want, got, "round trip")
+}
@@ -0,0 +1,176 @@
+package drbd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is the content of /proc/drbd, and optionally /proc/mounts,
+// at a moment in time
+type Snapshot struct {
+	Time     time.Time `json:"time"`
+	ProcDRBD string    `json:"proc_drbd"`
+	Mounts   string    `json:"mounts,omitempty"`
+}
+
+// ReadSnapshots reads a recording, possibly gzip compressed, and
+// returns it as a sequence of snapshots.  The recording can be:
+// JSON lines of Snapshot; a Journal, whose delta records are
+// rendered as /proc/drbd text; or "drbdsetup events2 --timestamps"
+// output.  A gzip recording can be unfinished, as the newest segment
+// written by a Recorder is.
+func ReadSnapshots(r io.Reader) ([]Snapshot, error) {
+	return readSnapshots(r, true)
+}
+
+// readSnapshots is ReadSnapshots, but a gzip stream that ends
+// unexpectedly is only accepted if unfinished is true
+func readSnapshots(r io.Reader, unfinished bool) ([]Snapshot, error) {
+	br := bufio.NewReader(r)
+	compressed := false
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		compressed = true
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	var snapshots []Snapshot
+	states := make(States)
+	events2 := NewEvents2()
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		if b[0] != '{' {
+			ts, changed, err := events2.Apply(string(b))
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			if !changed {
+				continue
+			}
+			snapshots = append(snapshots, Snapshot{
+				Time:     ts,
+				ProcDRBD: RenderProcDRBD(events2.States()),
+			})
+			continue
+		}
+		// a snapshot always has proc_drbd, even when it's empty, and a
+		// record never does
+		var probe struct {
+			ProcDRBD *string `json:"proc_drbd"`
+		}
+		err := json.Unmarshal(b, &probe)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if probe.ProcDRBD != nil {
+			var snapshot Snapshot
+			err := json.Unmarshal(b, &snapshot)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			snapshots = append(snapshots, snapshot)
+			continue
+		}
+		var record Record
+		err = json.Unmarshal(b, &record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		if record.Type != RecordDelta {
+			continue
+		}
+		if record.New == nil || record.New.Equal(State{}) {
+			delete(states, record.Resource)
+		} else {
+			states[record.Resource] = *record.New
+		}
+		snapshots = append(snapshots, Snapshot{
+			Time:     record.Time,
+			ProcDRBD: RenderProcDRBD(states),
+		})
+	}
+	err := scanner.Err()
+	if err == io.ErrUnexpectedEOF && compressed && unfinished {
+		// an unfinished gzip segment ends unexpectedly
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read recording")
+	}
+	return snapshots, nil
+}
+
+// Replayer feeds snapshots to a watcher by writing them to the
+// files named by Options.ProcDRBD and Options.ProcMounts.
+type Replayer struct {
+	Snapshots []Snapshot
+	// Speed is how much faster than real time to replay.  Zero means as
+	// fast as possible.  No matter the speed, each snapshot is left in
+	// place long enough for the watcher to see it.
+	Speed float64
+	// Step, if set, is called before each snapshot is written.  It
+	// can wait for someone to press return.
+	Step func(i int, s Snapshot) error
+}
+
+// Run writes the snapshots
+func (r Replayer) Run(o Options) error {
+	minimum := 3*o.Nap + o.Settle
+	for i, s := range r.Snapshots {
+		if r.Step != nil {
+			err := r.Step(i, s)
+			if err != nil {
+				return err
+			}
+		} else if i > 0 {
+			wait := minimum
+			if r.Speed > 0 {
+				gap := time.Duration(float64(s.Time.Sub(r.Snapshots[i-1].Time)) / r.Speed)
+				if gap > wait {
+					wait = gap
+				}
+			}
+			time.Sleep(wait)
+		}
+		err := replaceFile(o.procDRBD(), s.ProcDRBD)
+		if err != nil {
+			return err
+		}
+		if s.Mounts != "" {
+			err := replaceFile(o.procMounts(), s.Mounts)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceFile replaces a file atomically so that a reader never sees
+// a partial write
+func replaceFile(filename string, contents string) error {
+	tmp := filename + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(contents), 0644)
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	return errors.Wrapf(err, "replace %s", filename)
+}
@@ -0,0 +1,107 @@
+package drbd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSnapshots(t *testing.T) {
+	snapshots, err := ReadSnapshots(strings.NewReader(exampleEvents2))
+	require.NoError(t, err, "events2")
+	assert.Len(t, snapshots, 5, "events2 snapshots")
+	assert.Equal(t, 2019, snapshots[0].Time.Year(), "timestamp")
+
+	journal := `{"time":"2020-03-01T12:00:00Z","type":"delta","resource":1,"old":{},"new":{"connection":"Connected","self_role":"Primary","remote_role":"Secondary","self_disk":"UpToDate","remote_disk":"UpToDate"}}
+{"time":"2020-03-01T12:00:00Z","type":"event","resource":1,"event":"Appeared"}
+{"time":"2020-03-01T12:00:05Z","type":"delta","resource":1,"old":{},"new":{}}
+`
+	snapshots, err = ReadSnapshots(strings.NewReader(journal))
+	require.NoError(t, err, "journal")
+	require.Len(t, snapshots, 2, "journal snapshots")
+	assert.Contains(t, snapshots[0].ProcDRBD, " 1: cs:Connected ro:Primary/Secondary", "rendered")
+	assert.NotContains(t, snapshots[1].ProcDRBD, "cs:", "removed")
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write([]byte(`{"time":"2020-03-01T12:00:00Z","proc_drbd":"version: 8.4.10\n","mounts":"x"}` + "\n"))
+	require.NoError(t, err, "compress")
+	require.NoError(t, gz.Close(), "compress")
+	snapshots, err = ReadSnapshots(&compressed)
+	require.NoError(t, err, "compressed")
+	if assert.Len(t, snapshots, 1, "compressed") {
+		assert.Equal(t, "x", snapshots[0].Mounts, "mounts")
+	}
+
+	snapshots, err = ReadSnapshots(strings.NewReader(`{"time":"2020-03-01T12:00:00Z","proc_drbd":"version: 8.4.10\n"}
+{"time":"2020-03-01T12:00:05Z","proc_drbd":""}
+`))
+	require.NoError(t, err, "empty snapshot")
+	if assert.Len(t, snapshots, 2, "empty snapshot is kept") {
+		assert.Equal(t, "", snapshots[1].ProcDRBD, "module unloaded")
+	}
+}
+
+func TestReadSnapshotsUnfinished(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write([]byte(`{"time":"2020-03-01T12:00:00Z","proc_drbd":"version: 8.4.10\n"}` + "\n"))
+	require.NoError(t, err, "compress")
+	require.NoError(t, gz.Flush(), "flush")
+	unfinished := compressed.Bytes()
+
+	snapshots, err := readSnapshots(bytes.NewReader(unfinished), true)
+	require.NoError(t, err, "newest segment")
+	assert.Len(t, snapshots, 1, "snapshots before the end")
+	_, err = readSnapshots(bytes.NewReader(unfinished), false)
+	assert.Error(t, err, "older segment")
+
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	writeFile(t, dir+"/"+segmentPrefix+"20200301T120000.000000000Z"+segmentSuffix, string(unfinished))
+	writeFile(t, dir+"/"+segmentPrefix+"20200301T130000.000000000Z"+segmentSuffix, string(unfinished))
+	_, err = ReadRecording(dir)
+	assert.Error(t, err, "truncated older segment")
+}
+
+func TestReplay(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	o := Options{
+		ProcDRBD:   dir + "/proc-drbd",
+		ProcMounts: dir + "/proc-mounts",
+		Nap:        napTime / 20,
+	}
+	snapshots, err := ReadSnapshots(strings.NewReader(exampleEvents2))
+	require.NoError(t, err, "events2")
+
+	c, next := collectDeltas()
+	go o.React(func(d Delta) error {
+		next(d)
+		return nil
+	})
+	var steps []int
+	require.NoError(t, Replayer{
+		Snapshots: snapshots,
+		Speed:     1e6,
+		Step: func(i int, s Snapshot) error {
+			steps = append(steps, i)
+			time.Sleep(napTime / 5)
+			return nil
+		},
+	}.Run(o), "replay")
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, steps, "steps")
+	var roles []string
+	for i := 0; i < 5; i++ {
+		roles = append(roles, nextDelta(t, c, napTime).New.RemoteRole)
+	}
+	noDelta(t, c, napTime/5)
+	assert.Equal(t, []string{"Primary", "Secondary", "Secondary", "Secondary", "Unknown"}, roles, "remote roles")
+	stopWatchers(t, o.ProcDRBD)
+}
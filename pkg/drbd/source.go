@@ -0,0 +1,418 @@
+package drbd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source says where the watcher reads DRBD state from
+type Source string
+
+const (
+	// SourceProcDRBD parses Options.ProcDRBD.  DRBD 9 doesn't list
+	// resources there.
+	SourceProcDRBD Source = "proc"
+	// SourceDrbdsetup runs "drbdsetup status --json".  It requires
+	// DRBD 9.
+	SourceDrbdsetup Source = "drbdsetup"
+	// SourceNetlink listens for DRBD 9 notifications rather than
+	// polling.  It requires Linux.
+	SourceNetlink Source = "netlink"
+)
+
+// source is where React reads the state from
+type source interface {
+	// read returns the state.  like is the prior state, for naming
+	// resources that the source doesn't name.
+	read(like Resources) (Resources, []string, error)
+	// wait returns when it's time to read again, or sooner if the
+	// watcher is stopped
+	wait()
+	// maybeMissed is true when changes may have come and gone
+	// before the last read
+	maybeMissed() bool
+	close() error
+}
+
+// pollSource reads ProcDRBD or runs drbdsetup every Nap, or every
+// FastNap while anything is unsettled.  What it reads is only parsed
+// when it has changed other than in its statistics.
+type pollSource struct {
+	o        Options
+	stripped []byte
+	last     Resources
+	warnings []string
+	lastRead time.Time
+	nap      time.Duration
+	missed   bool
+}
+
+func (p *pollSource) read(like Resources) (Resources, []string, error) {
+	now := p.o.clock().Now()
+	p.missed = !p.lastRead.IsZero() && now.Sub(p.lastRead) > p.maxGap()
+	p.lastRead = now
+	raw, err := p.o.readRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+	stripped := p.o.withoutStatistics(raw)
+	if p.last != nil && bytes.Equal(stripped, p.stripped) {
+		return p.last, p.warnings, nil
+	}
+	rs, warnings, err := p.o.parseResources(raw, like)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.stripped, p.last, p.warnings = stripped, rs, warnings
+	return rs, warnings, nil
+}
+
+// counterRE matches a line of "drbdsetup status --json" with a number
+var counterRE = regexp.MustCompile(`(?m)^[ \t]*"([a-z_-]+)": -?[0-9][0-9.]*,?[ \t]*\n`)
+
+// structural are the numbers in "drbdsetup status --json" that aren't
+// statistics
+var structural = map[string]bool{"node-id": true, "peer-node-id": true, "volume": true, "minor": true}
+
+// withoutStatistics removes the counters that change on nearly every
+// read: the lines of ProcDRBD that parseStates skips, and the numbers
+// other than ids in "drbdsetup status --statistics".  The watcher
+// doesn't use them; Status reads them itself.
+func (o Options) withoutStatistics(raw []byte) []byte {
+	if o.Source == SourceDrbdsetup {
+		return counterRE.ReplaceAllFunc(raw, func(line []byte) []byte {
+			if structural[string(counterRE.FindSubmatch(line)[1])] {
+				return line
+			}
+			return nil
+		})
+	}
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	kept := lines[:0]
+	for _, line := range lines {
+		if !skipRE.Match(line) {
+			kept = append(kept, line)
+		}
+	}
+	return bytes.Join(kept, nil)
+}
+
+func (p *pollSource) wait() {
+	p.nap = p.o.Nap
+	if p.o.FastNap > 0 && p.last.unsettled() {
+		p.nap = p.o.FastNap
+	}
+	p.o.sleep(p.nap)
+}
+
+// maxGap is how far apart reads can be before changes may have
+// been missed between them
+func (p *pollSource) maxGap() time.Duration {
+	if p.o.MissedGap > 0 {
+		return p.o.MissedGap
+	}
+	return 2 * p.nap
+}
+
+func (p *pollSource) maybeMissed() bool {
+	return p.missed
+}
+
+func (p *pollSource) close() error {
+	return nil
+}
+
+func (o Options) openSource() (source, error) {
+	switch o.Source {
+	case SourceProcDRBD, SourceDrbdsetup, "":
+		return &pollSource{o: o}, nil
+	case SourceNetlink:
+		return o.openNetlink()
+	default:
+		return nil, errors.Errorf("invalid source '%s'", o.Source)
+	}
+}
+
+// OutputRunner runs an external command and returns what it printed.
+// It's a parameter so that tests can use recorded output.
+type OutputRunner func(name string, args ...string) ([]byte, error)
+
+// ExecOutput runs commands with os/exec
+func ExecOutput(name string, args ...string) ([]byte, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		var stderr string
+		if ee, ok := err.(*exec.ExitError); ok {
+			stderr = strings.TrimSpace(string(ee.Stderr))
+		}
+		return nil, errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), stderr)
+	}
+	return out, nil
+}
+
+// statusArgs are the arguments to drbdsetup for SourceDrbdsetup
+var statusArgs = []string{"status", "--json", "--verbose", "--statistics"}
+
+type statusResource struct {
+	Name        string             `json:"name"`
+	Role        string             `json:"role"`
+	Devices     []statusDevice     `json:"devices"`
+	Connections []statusConnection `json:"connections"`
+}
+
+type statusDevice struct {
+	Volume    int    `json:"volume"`
+	Minor     int    `json:"minor"`
+	DiskState string `json:"disk-state"`
+	Client    bool   `json:"client"`
+	Quorum    *bool  `json:"quorum"`
+}
+
+type statusConnection struct {
+	PeerNodeID      int                `json:"peer-node-id"`
+	Name            string             `json:"name"`
+	ConnectionState string             `json:"connection-state"`
+	PeerRole        string             `json:"peer-role"`
+	PeerDevices     []statusPeerDevice `json:"peer_devices"`
+}
+
+type statusPeerDevice struct {
+	Volume           int     `json:"volume"`
+	ReplicationState string  `json:"replication-state"`
+	PeerDiskState    string  `json:"peer-disk-state"`
+	OutOfSync        int64   `json:"out-of-sync"`
+	PercentInSync    float64 `json:"percent-in-sync"`
+}
+
+// ParseStatusJSON decodes the output of "drbdsetup status --json".
+// With --statistics, it includes how much of each peer device is out
+// of sync.
+func ParseStatusJSON(b []byte) (Resources, error) {
+	var status []statusResource
+	err := json.Unmarshal(b, &status)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode drbdsetup status")
+	}
+	rs := make(Resources)
+	for _, s := range status {
+		if s.Name == "" {
+			return nil, errors.New("drbdsetup status: resource without a name")
+		}
+		r := Resource{
+			Name:        s.Name,
+			Role:        s.Role,
+			Devices:     make(map[int]Device),
+			Connections: make(map[int]Connection),
+		}
+		for _, d := range s.Devices {
+			var quorum string
+			if d.Quorum != nil {
+				quorum = yesNo(*d.Quorum)
+			}
+			r.Devices[d.Volume] = Device{
+				Minor:  d.Minor,
+				Disk:   d.DiskState,
+				Client: d.Client,
+				Quorum: quorum,
+			}
+		}
+		for _, c := range s.Connections {
+			conn := Connection{
+				Name:        c.Name,
+				Connection:  c.ConnectionState,
+				PeerRole:    c.PeerRole,
+				PeerDevices: make(map[int]PeerDevice),
+			}
+			for _, pd := range c.PeerDevices {
+				conn.PeerDevices[pd.Volume] = PeerDevice{
+					Replication:   pd.ReplicationState,
+					PeerDisk:      pd.PeerDiskState,
+					OutOfSync:     pd.OutOfSync,
+					PercentInSync: pd.PercentInSync,
+				}
+			}
+			r.Connections[c.PeerNodeID] = conn
+		}
+		rs[s.Name] = r
+	}
+	return rs, nil
+}
+
+type showResource struct {
+	Resource string `json:"resource"`
+	ThisHost struct {
+		Volumes []struct {
+			Volume int `json:"volume_nr"`
+			Minor  int `json:"device_minor"`
+		} `json:"volumes"`
+	} `json:"_this_host"`
+	Connections []struct {
+		PeerNodeID int `json:"_peer_node_id"`
+		Net        struct {
+			Name string `json:"_name"`
+		} `json:"net"`
+	} `json:"connections"`
+}
+
+// ParseShowJSON decodes the output of "drbdsetup show --json".  It
+// is the configuration, so only names, volumes, minors, and peers
+// are set.
+func ParseShowJSON(b []byte) (Resources, error) {
+	var show []showResource
+	err := json.Unmarshal(b, &show)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode drbdsetup show")
+	}
+	rs := make(Resources)
+	for _, s := range show {
+		r := Resource{
+			Name:        s.Resource,
+			Devices:     make(map[int]Device),
+			Connections: make(map[int]Connection),
+		}
+		for _, v := range s.ThisHost.Volumes {
+			r.Devices[v.Volume] = Device{Minor: v.Minor}
+		}
+		for _, c := range s.Connections {
+			r.Connections[c.PeerNodeID] = Connection{
+				Name:        c.Net.Name,
+				PeerDevices: make(map[int]PeerDevice),
+			}
+		}
+		rs[s.Resource] = r
+	}
+	return rs, nil
+}
+
+func (o Options) output() OutputRunner {
+	if o.Output == nil {
+		return ExecOutput
+	}
+	return o.Output
+}
+
+// parseStatus parses "drbdsetup status".  Peers that status doesn't
+// name are named from "drbdsetup show".
+func (o Options) parseStatus(raw []byte) (Resources, error) {
+	rs, err := ParseStatusJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	var config Resources
+	for name, r := range rs {
+		for id, c := range r.Connections {
+			if c.Name != "" {
+				continue
+			}
+			if config == nil {
+				out, err := o.output()("drbdsetup", "show", "--json")
+				if err != nil {
+					return nil, err
+				}
+				config, err = ParseShowJSON(out)
+				if err != nil {
+					return nil, err
+				}
+			}
+			c.Name = config[name].Connections[id].Name
+			r.Connections[id] = c
+		}
+	}
+	return rs, nil
+}
+
+// readRaw reads ProcDRBD or runs drbdsetup, according to Source
+func (o Options) readRaw() ([]byte, error) {
+	switch o.Source {
+	case SourceProcDRBD, "":
+		return o.readProcDRBD()
+	case SourceDrbdsetup:
+		return o.output()("drbdsetup", statusArgs...)
+	default:
+		return nil, errors.Errorf("invalid source '%s'", o.Source)
+	}
+}
+
+// parseResources parses what readRaw read.  Lines of ProcDRBD that
+// were skipped because of Lenient are returned too.
+func (o Options) parseResources(raw []byte, like Resources) (Resources, []string, error) {
+	if o.Source == SourceDrbdsetup {
+		rs, err := o.parseStatus(raw)
+		return rs, nil, err
+	}
+	states, warnings, err := parseStates(bytes.NewReader(raw), o.procDRBD(), o.Lenient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return statesToResources(states, like), warnings, nil
+}
+
+// readResources reads the state from the configured Source
+func (o Options) readResources(like Resources) (Resources, []string, error) {
+	raw, err := o.readRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+	return o.parseResources(raw, like)
+}
+
+// logWarnings logs each warning once
+func (o Options) logWarnings(warned map[string]bool, warnings []string) {
+	for _, w := range warnings {
+		if !warned[w] {
+			log.Printf("Skipped %s line: %s\n", o.procDRBD(), w)
+			warned[w] = true
+		}
+	}
+}
+
+// watchResources returns once the state differs from old or, if old is
+// nil, once the states of the minors differ from oldStates.
+func (o Options) watchResources(src source, old Resources, oldStates States) (Resources, error) {
+	warned := make(map[string]bool)
+	failures := 0
+	for {
+		current, warnings, err := src.read(old)
+		if err != nil && o.Control.isStopped() {
+			// the source was closed to stop it
+			return nil, ErrStopped
+		}
+		o.Control.read(o.clock().Now(), err)
+		if err != nil {
+			failures++
+			if failures > o.ReadRetries {
+				return nil, err
+			}
+			log.Printf("read failed, retry %d of %d: %s\n", failures, o.ReadRetries, err)
+			src.wait()
+			if o.Control.isStopped() {
+				return nil, ErrStopped
+			}
+			continue
+		}
+		failures = 0
+		if o.Polled != nil {
+			o.Polled(current)
+		}
+		o.logWarnings(warned, warnings)
+		if old == nil {
+			if !current.States().equal(oldStates) {
+				return current, nil
+			}
+			old = current
+		} else if len(DiffResources(old, current)) > 0 {
+			return current, nil
+		}
+		src.wait()
+		if o.Control.isStopped() {
+			return nil, ErrStopped
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package drbd
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile("testdata/drbdsetup/" + name)
+	require.NoErrorf(t, err, "read %s", name)
+	return string(b)
+}
+
+// fakeDrbdsetup serves recorded drbdsetup output
+type fakeDrbdsetup struct {
+	mu       sync.Mutex
+	status   string
+	show     string
+	commands []string
+}
+
+func (f *fakeDrbdsetup) set(status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+func (f *fakeDrbdsetup) output(name string, args ...string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	command := name + " " + strings.Join(args, " ")
+	f.commands = append(f.commands, command)
+	switch {
+	case strings.HasPrefix(command, "drbdsetup status --json") && f.status != "":
+		return []byte(f.status), nil
+	case command == "drbdsetup show --json" && f.show != "":
+		return []byte(f.show), nil
+	}
+	return nil, errors.Errorf("%s: failed", command)
+}
+
+func TestParseStatusJSON(t *testing.T) {
+	rs, err := ParseStatusJSON([]byte(readTestdata(t, "status.json")))
+	require.NoError(t, err, "parse")
+	require.Contains(t, rs, "data", "resource")
+	r := rs["data"]
+	assert.Equal(t, "Primary", r.Role, "role")
+	assert.Equal(t, Device{Minor: 2, Disk: "UpToDate", Quorum: "yes"}, r.Devices[1], "volume 1")
+	assert.Equal(t, PeerDevice{Replication: "SyncSource", PeerDisk: "Inconsistent", OutOfSync: 1572864, PercentInSync: 25},
+		r.Connections[1].PeerDevices[1], "resyncing")
+	assert.Equal(t, "", r.Connections[2].Name, "unnamed peer")
+	assert.Equal(t, States{
+		1: {Connection: "Connected", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"},
+		2: {Connection: "SyncSource", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "Inconsistent"},
+	}, rs.States(), "states")
+
+	_, err = ParseStatusJSON([]byte(`{"name": "r0"}`))
+	assert.Error(t, err, "not a list")
+
+	show, err := ParseShowJSON([]byte(readTestdata(t, "show.json")))
+	require.NoError(t, err, "show")
+	assert.Equal(t, "beta", show["data"].Connections[2].Name, "peer name")
+	assert.Equal(t, 2, show["data"].Devices[1].Minor, "minor")
+}
+
+func TestReadStatus(t *testing.T) {
+	f := &fakeDrbdsetup{status: readTestdata(t, "status.json")}
+	o := Options{Source: SourceDrbdsetup, Output: f.output}
+	_, _, err := o.readResources(nil)
+	assert.Error(t, err, "show fails")
+
+	f.show = readTestdata(t, "show.json")
+	rs, _, err := o.readResources(nil)
+	require.NoError(t, err, "read")
+	assert.Equal(t, "beta", rs["data"].Connections[2].Name, "named from show")
+	assert.Equal(t, "alpha", rs["data"].Connections[1].Name, "named by status")
+	assert.Equal(t, []string{
+		"drbdsetup status --json --verbose --statistics",
+		"drbdsetup show --json",
+		"drbdsetup status --json --verbose --statistics",
+		"drbdsetup show --json",
+	}, f.commands, "show is only run for unnamed peers")
+
+	_, _, err = Options{Source: "kernel"}.readResources(nil)
+	assert.Error(t, err, "invalid source")
+}
+
+func TestPollSource(t *testing.T) {
+	f := &fakeDrbdsetup{
+		status: readTestdata(t, "status.json"),
+		show:   readTestdata(t, "show.json"),
+	}
+	clock := NewManualClock(testStart)
+	src := &pollSource{o: Options{
+		Source:  SourceDrbdsetup,
+		Output:  f.output,
+		Clock:   clock,
+		Nap:     time.Second,
+		FastNap: time.Second / 10,
+	}}
+	first, _, err := src.read(nil)
+	require.NoError(t, err, "first")
+	wait := func(d time.Duration, what string) {
+		done := make(chan struct{})
+		go func() {
+			src.wait()
+			close(done)
+		}()
+		clock.BlockUntil(1)
+		clock.Advance(d)
+		select {
+		case <-done:
+		case <-time.After(napTime * 10):
+			t.Fatal(what)
+		}
+	}
+	wait(time.Second/10, "fast while resyncing")
+	again, _, err := src.read(first)
+	require.NoError(t, err, "again")
+	assert.Equal(t, first, again, "unchanged")
+	assert.Len(t, f.commands, 3, "not parsed again")
+	assert.False(t, src.maybeMissed(), "on time")
+
+	clock.Advance(time.Second / 10)
+	f.set(strings.Replace(f.status, `"sent": 17396`, `"sent": 17400`, 1))
+	again, _, err = src.read(first)
+	require.NoError(t, err, "statistics")
+	assert.Equal(t, first, again, "only statistics changed")
+	assert.Len(t, f.commands, 4, "not parsed for statistics")
+
+	clock.Advance(time.Second)
+	_, _, err = src.read(first)
+	require.NoError(t, err, "late")
+	assert.True(t, src.maybeMissed(), "late")
+}
+
+func TestWithoutStatistics(t *testing.T) {
+	var o Options
+	progressed := strings.NewReplacer("ns:56582812", "ns:56590000", "34.7%", "34.9%", "0:53:57", "0:53:01").Replace(exampleProcDRBD2)
+	assert.Equal(t, string(o.withoutStatistics([]byte(exampleProcDRBD2))), string(o.withoutStatistics([]byte(progressed))), "resync progress")
+	assert.NotEqual(t, string(o.withoutStatistics([]byte(exampleProcDRBD1))), string(o.withoutStatistics([]byte(exampleProcDRBD2))), "state")
+	assert.NotContains(t, string(o.withoutStatistics([]byte(exampleProcDRBD2))), "ns:", "counters")
+}
+
+func TestPolled(t *testing.T) {
+	polled := make(chan Resources, 10)
+	c := NewControl()
+	w := newMemWatcher(Options{
+		Control: c,
+		Polled: func(rs Resources) {
+			polled <- rs
+		},
+	}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.React(func(Delta) error { return nil })
+	})
+	w.change(exampleProcDRBD1)
+	w.change(exampleProcDRBD2)
+	// React reads again after each change, before it waits
+	require.Len(t, polled, 5, "every read")
+	assert.Len(t, (<-polled).States(), 1, "first read")
+	for len(polled) > 1 {
+		<-polled
+	}
+	assert.Len(t, (<-polled).States(), 3, "last read")
+	c.Stop()
+	select {
+	case err := <-w.errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+}
+
+func TestReadRetries(t *testing.T) {
+	w := newMemWatcher(Options{ReadRetries: 1}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.React(func(Delta) error { return nil })
+	})
+	w.change("version: 8.4.10\nsrcversion: 0\nunparsable\n")
+	assert.Empty(t, w.errs, "retried")
+	w.change(exampleProcDRBD1)
+	w.change("version: 8.4.10\nsrcversion: 0\nunparsable\n")
+	assert.Empty(t, w.errs, "retried again after a good read")
+	w.stop(t)
+}
+
+func TestReactDrbdsetup(t *testing.T) {
+	status := readTestdata(t, "status.json")
+	f := &fakeDrbdsetup{
+		status: status,
+		show:   readTestdata(t, "show.json"),
+	}
+	c, next := collectDeltas()
+	w := newMemWatcher(Options{
+		Source:      SourceDrbdsetup,
+		Output:      f.output,
+		MinReplicas: map[string]int{"data": 2},
+	}, nil, func(o Options) error {
+		return o.React(func(d Delta) error {
+			next(d)
+			return nil
+		})
+	})
+	deltas := func() map[int]Delta {
+		deltas := make(map[int]Delta)
+		for len(c) > 0 {
+			d := nextDelta(t, c, napTime)
+			deltas[d.Resource] = d
+		}
+		return deltas
+	}
+	// callbacks are asynchronous
+	time.Sleep(napTime / 5)
+	initial := deltas()
+	require.Len(t, initial, 2, "initial")
+	assert.Equal(t, "data", initial[2].Name, "name")
+	assert.Equal(t, 1, initial[2].Volume, "volume")
+	assert.Equal(t, "SyncSource", initial[2].New.Connection, "state")
+	assert.Equal(t, []string{"alpha", "beta"}, initial[2].ChangedPeers(), "peers")
+	assert.Contains(t, Classify(initial[2]), EventReplicaCountBelow, "one replica of volume 1")
+
+	// only the quorum of volume 0 changes
+	f.set(strings.Replace(status, `"quorum": true,
+      "size": 1048576`, `"quorum": false,
+      "size": 1048576`, 1))
+	w.clock.Advance(w.o.Nap)
+	w.clock.BlockUntil(1)
+	time.Sleep(napTime / 5)
+	quorum := deltas()
+	require.Len(t, quorum, 1, "quorum")
+	assert.Equal(t, []Event{EventQuorumLost}, Classify(quorum[1]), "quorum lost")
+	assert.Equal(t, "data/0 quorum:yes->no", quorum[1].Changes[0].String(), "changes")
+
+	// the peer disk of volume 1 on alpha finishes its resync
+	f.set(strings.Replace(status, `"peer-disk-state": "Inconsistent"`, `"peer-disk-state": "UpToDate"`, 1))
+	w.clock.Advance(w.o.Nap)
+	w.clock.BlockUntil(1)
+	time.Sleep(napTime / 5)
+	synced := deltas()
+	require.Contains(t, synced, 2, "synced")
+	assert.Equal(t, 2, synced[2].NewReplicas, "replicas")
+
+	f.set("")
+	w.clock.Advance(w.o.Nap)
+	select {
+	case err := <-w.errs:
+		assert.Error(t, err, "stopped watcher")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+}
@@ -0,0 +1,131 @@
+package drbd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Startup says which changes are dispatched when React starts
+type Startup string
+
+const (
+	// StartupInitial dispatches every resource when React starts, and
+	// every saved resource that is gone.  The Old state is the last
+	// state saved in Options.StateFile, if any.
+	StartupInitial Startup = "initial"
+	// StartupChanges dispatches only the resources that have changed since
+	// the last state saved in Options.StateFile.
+	StartupChanges Startup = "changes"
+	// StartupNone dispatches nothing when React starts: the current state
+	// is the starting point.
+	StartupNone Startup = "none"
+)
+
+// savedStates is the format of Options.StateFile
+type savedStates struct {
+	Saved     time.Time             `json:"saved"`
+	Resources map[int]savedResource `json:"resources"`
+}
+
+type savedResource struct {
+	State   State   `json:"state"`
+	Changed Changes `json:"changed"`
+}
+
+// loadStateFile returns the states and change times from a state file.
+// A missing file is not an error.
+func loadStateFile(filename string) (States, map[int]Changes, error) {
+	states := make(States)
+	changed := make(map[int]Changes)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return states, changed, nil
+		}
+		return nil, nil, errors.Wrapf(err, "read %s", filename)
+	}
+	var saved savedStates
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "decode %s", filename)
+	}
+	for r, s := range saved.Resources {
+		states[r] = s.State
+		changed[r] = s.Changed
+	}
+	return states, changed, nil
+}
+
+// saveStateFile writes a state file atomically: the new contents are
+// written to a temporary file that is then renamed into place.
+func saveStateFile(filename string, states States, changed map[int]Changes) error {
+	saved := savedStates{
+		Saved:     time.Now(),
+		Resources: make(map[int]savedResource),
+	}
+	for r, s := range states {
+		saved.Resources[r] = savedResource{
+			State:   s,
+			Changed: changed[r],
+		}
+	}
+	b, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "encode states")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return errors.Wrapf(err, "create temporary file for %s", filename)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Wrapf(err, "write %s", filename)
+	}
+	return nil
+}
+
+// unsave puts the old states of changes that were dropped back into
+// the state file, so that with StartupChanges they are dispatched
+// after a restart
+func (o Options) unsave(dropped []Delta) {
+	if o.StateFile == "" || len(dropped) == 0 {
+		return
+	}
+	states, changed, err := loadStateFile(o.StateFile)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, delta := range dropped {
+		if delta.Old.Equal(delta.New) {
+			continue
+		}
+		if delta.Old.Equal(State{}) {
+			delete(states, delta.Resource)
+			delete(changed, delta.Resource)
+			continue
+		}
+		states[delta.Resource] = delta.Old
+		changed[delta.Resource] = delta.LastChanged
+	}
+	err = saveStateFile(o.StateFile, states, changed)
+	if err != nil {
+		log.Println(err)
+	}
+}
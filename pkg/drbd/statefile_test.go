@@ -0,0 +1,160 @@
+package drbd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Flaque/filet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateFile(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	stateFile := dir + "/states.json"
+
+	states, changed, err := loadStateFile(stateFile)
+	require.NoError(t, err, "missing file")
+	assert.Empty(t, states, "missing file")
+
+	when := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, saveStateFile(stateFile, States{0: stateConnected}, map[int]Changes{0: {Any: when, Role: when}}), "save")
+	states, changed, err = loadStateFile(stateFile)
+	require.NoError(t, err, "load")
+	assert.Equal(t, States{0: stateConnected}, states, "states")
+	assert.True(t, when.Equal(changed[0].Any), "changed")
+	assert.True(t, when.Equal(changed[0].Role), "role changed")
+	assert.True(t, changed[0].Disk.IsZero(), "disk not changed")
+}
+
+func startupDeltas(t *testing.T, dir string, startup Startup, procDRBD string) (chan Delta, *memWatcher) {
+	c, next := collectDeltas()
+	w := newMemWatcher(Options{
+		StateFile: dir + "/states.json",
+		Startup:   startup,
+	}, map[string]string{
+		"/proc/drbd": procDRBD,
+	}, func(o Options) error {
+		return o.React(func(d Delta) error {
+			next(d)
+			return nil
+		})
+	})
+	return c, w
+}
+
+func TestStartup(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	current := State{Connection: "WFConnection", SelfRole: "Secondary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}
+
+	c, w := startupDeltas(t, dir, StartupInitial, exampleProcDRBD1)
+	got := nextDelta(t, c, napTime)
+	assert.Equal(t, State{}, got.Old, "no saved state")
+	assert.Equal(t, current, got.New, "initial")
+	w.stop(t)
+
+	c, w = startupDeltas(t, dir, StartupChanges, exampleProcDRBD1)
+	assert.Empty(t, c, "no changes since saved")
+	w.stop(t)
+
+	c, w = startupDeltas(t, dir, StartupInitial, exampleProcDRBD1)
+	got = nextDelta(t, c, napTime)
+	assert.Equal(t, current, got.Old, "saved state")
+	assert.Equal(t, current, got.New, "initial with saved state")
+	w.stop(t)
+
+	require.NoError(t, saveStateFile(dir+"/states.json", States{0: stateConnected}, nil), "save")
+	c, w = startupDeltas(t, dir, StartupChanges, exampleProcDRBD1)
+	got = nextDelta(t, c, napTime)
+	assert.Equal(t, stateConnected, got.Old, "saved state")
+	assert.Equal(t, current, got.New, "changed since saved")
+	w.stop(t)
+
+	c, w = startupDeltas(t, dir, StartupNone, exampleProcDRBD1)
+	assert.Empty(t, c, "no initial changes")
+	w.change(exampleProcDRBD2)
+	for i := 0; i < 3; i++ {
+		got = nextDelta(t, c, napTime)
+		if got.Resource == 0 {
+			assert.Equal(t, current, got.Old, "current state")
+		} else {
+			assert.Equal(t, State{}, got.Old, "new resource")
+		}
+	}
+	w.stop(t)
+}
+
+func TestStartupDisappeared(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	current := State{Connection: "WFConnection", SelfRole: "Secondary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}
+
+	for _, startup := range []Startup{StartupInitial, StartupChanges} {
+		require.NoError(t, saveStateFile(dir+"/states.json", States{0: current, 5: stateConnected}, nil), "save")
+		c, w := startupDeltas(t, dir, startup, exampleProcDRBD1)
+		got := make(map[int]Delta)
+		n := 1
+		if startup == StartupInitial {
+			n = 2
+		}
+		for i := 0; i < n; i++ {
+			d := nextDelta(t, c, napTime)
+			got[d.Resource] = d
+		}
+		noDelta(t, c, napTime/5)
+		assert.Equal(t, stateConnected, got[5].Old, string(startup)+": saved state")
+		assert.Equal(t, State{}, got[5].New, string(startup)+": gone")
+		assert.Equal(t, []Event{EventDisappeared}, Classify(got[5]), string(startup)+": disappeared")
+		w.stop(t)
+
+		states, _, err := loadStateFile(dir + "/states.json")
+		require.NoError(t, err, "load")
+		assert.Equal(t, States{0: current}, states, string(startup)+": forgotten")
+	}
+}
+
+func TestStopKeepsDropped(t *testing.T) {
+	defer filet.CleanUp(t)
+	dir := filet.TmpDir(t, "")
+	b := newBlockingCallback()
+	c := NewControl()
+	w := newMemWatcher(Options{
+		StateFile:   dir + "/states.json",
+		Startup:     StartupChanges,
+		Control:     c,
+		MaxParallel: 1,
+	}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.Invoke(b.callback)
+	})
+	assert.Equal(t, []int{0}, b.startedAfter(1), "initial")
+	w.change(exampleProcDRBD2)
+	c.Stop()
+	// let the watcher drop what's queued before r0 finishes
+	time.Sleep(napTime)
+	close(b.release)
+	select {
+	case err := <-w.errs:
+		assert.Equal(t, ErrStopped, err, "stopped")
+	case <-time.After(napTime * 10):
+		t.Fatal("watcher did not stop")
+	}
+
+	states, _, err := loadStateFile(dir + "/states.json")
+	require.NoError(t, err, "load")
+	assert.Equal(t, States{0: {Connection: "WFConnection", SelfRole: "Secondary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}},
+		states, "the states before the dropped changes")
+
+	deltas, w := startupDeltas(t, dir, StartupChanges, exampleProcDRBD2)
+	got := make(map[int]Delta)
+	for i := 0; i < 3; i++ {
+		d := nextDelta(t, deltas, napTime)
+		got[d.Resource] = d
+	}
+	assert.Equal(t, "WFConnection", got[0].Old.Connection, "r0 dispatched again")
+	assert.Equal(t, State{}, got[2].Old, "r2 dispatched again")
+	w.stop(t)
+}
@@ -0,0 +1,276 @@
+package drbd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is the current state of one device, as shown by
+// "drbd-watcher status".  The connection, roles, and disks are those
+// of the first peer, as in /proc/drbd; Peers has all of them.
+type Status struct {
+	Name       string `json:"name" yaml:"name"`
+	Volume     int    `json:"volume" yaml:"volume"`
+	Minor      int    `json:"minor" yaml:"minor"`
+	Connection string `json:"connection" yaml:"connection"`
+	SelfRole   string `json:"self_role" yaml:"self_role"`
+	RemoteRole string `json:"remote_role" yaml:"remote_role"`
+	SelfDisk   string `json:"self_disk" yaml:"self_disk"`
+	RemoteDisk string `json:"remote_disk" yaml:"remote_disk"`
+	// Client is true for an intentionally diskless DRBD 9 device
+	Client   bool   `json:"client,omitempty" yaml:"client,omitempty"`
+	Quorum   string `json:"quorum,omitempty" yaml:"quorum,omitempty"`
+	Replicas int    `json:"up_to_date_replicas" yaml:"up_to_date_replicas"`
+	// SyncPercent is set while resyncing: the least in sync peer
+	SyncPercent *float64 `json:"sync_percent,omitempty" yaml:"sync_percent,omitempty"`
+	// SyncSpeed is in KiB/s, zero if it isn't known.  drbdsetup
+	// doesn't report it; see MeasureSyncSpeed.
+	SyncSpeed int64 `json:"sync_speed,omitempty" yaml:"sync_speed,omitempty"`
+	// OutOfSync is in KiB: the most of any peer
+	OutOfSync int64        `json:"out_of_sync" yaml:"out_of_sync"`
+	Peers     []PeerStatus `json:"peers,omitempty" yaml:"peers,omitempty"`
+	// Mounts are from Fstab and ProcMounts.  Mounted is true if any
+	// are in ProcMounts.
+	Mounts  []string `json:"mounts" yaml:"mounts"`
+	Mounted bool     `json:"mounted" yaml:"mounted"`
+	// Problems say why the device is Degraded
+	Degraded bool     `json:"degraded" yaml:"degraded"`
+	Problems []string `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// PeerStatus is one peer's view of a device
+type PeerStatus struct {
+	NodeID        int     `json:"node_id" yaml:"node_id"`
+	Name          string  `json:"name,omitempty" yaml:"name,omitempty"`
+	Connection    string  `json:"connection" yaml:"connection"`
+	Role          string  `json:"role" yaml:"role"`
+	Replication   string  `json:"replication,omitempty" yaml:"replication,omitempty"`
+	Disk          string  `json:"disk" yaml:"disk"`
+	OutOfSync     int64   `json:"out_of_sync,omitempty" yaml:"out_of_sync,omitempty"`
+	PercentInSync float64 `json:"percent_in_sync,omitempty" yaml:"percent_in_sync,omitempty"`
+}
+
+// Status reads the current state once from the Source.  Devices are
+// ordered by minor.
+func (o Options) Status() ([]Status, error) {
+	var rs Resources
+	var details map[int]procDetail
+	if o.Source == SourceNetlink {
+		events, err := o.events2Now()
+		if err != nil {
+			return nil, err
+		}
+		rs = events.Resources()
+	} else {
+		raw, err := o.readRaw()
+		if err != nil {
+			return nil, err
+		}
+		var warnings []string
+		rs, warnings, err = o.parseResources(raw, nil)
+		if err != nil {
+			return nil, err
+		}
+		o.logWarnings(make(map[string]bool), warnings)
+		if o.Source != SourceDrbdsetup {
+			details = procDetails(raw)
+		}
+	}
+	states := rs.States()
+	statuses := []Status{}
+	for name, r := range rs {
+		for volume, d := range r.Devices {
+			if d.Minor < 0 {
+				continue
+			}
+			s := states[d.Minor]
+			st := Status{
+				Name:       name,
+				Volume:     volume,
+				Minor:      d.Minor,
+				Connection: s.Connection,
+				SelfRole:   s.SelfRole,
+				RemoteRole: s.RemoteRole,
+				SelfDisk:   s.SelfDisk,
+				RemoteDisk: s.RemoteDisk,
+				Client:     d.Client,
+				Quorum:     d.Quorum,
+				Replicas:   r.Replicas(volume),
+			}
+			if pd, ok := details[d.Minor]; ok {
+				st.SyncPercent, st.SyncSpeed, st.OutOfSync = pd.synced, pd.speed, pd.outOfSync
+			}
+			for _, id := range r.peers() {
+				c := r.Connections[id]
+				pd := c.PeerDevices[volume]
+				st.Peers = append(st.Peers, PeerStatus{
+					NodeID:        id,
+					Name:          c.Name,
+					Connection:    c.Connection,
+					Role:          c.PeerRole,
+					Replication:   pd.Replication,
+					Disk:          pd.PeerDisk,
+					OutOfSync:     pd.OutOfSync,
+					PercentInSync: pd.PercentInSync,
+				})
+				if pd.OutOfSync > st.OutOfSync {
+					st.OutOfSync = pd.OutOfSync
+				}
+				if syncing(pd.Replication) && (st.SyncPercent == nil || pd.PercentInSync < *st.SyncPercent) {
+					p := pd.PercentInSync
+					st.SyncPercent = &p
+				}
+			}
+			err := o.statusMounts(&st)
+			if err != nil {
+				return nil, err
+			}
+			st.Problems = o.problems(r, volume)
+			st.Degraded = len(st.Problems) > 0
+			statuses = append(statuses, st)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Minor < statuses[j].Minor
+	})
+	return statuses, nil
+}
+
+// statusMounts fills in Mounts and Mounted.  Missing files are
+// treated as empty.
+func (o Options) statusMounts(st *Status) error {
+	fsMounts, err := o.GetMounts(st.Minor, o.fstab())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	liveMounts, err := o.GetMounts(st.Minor, o.procMounts())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	all := make(map[string]bool)
+	for _, m := range append(fsMounts, liveMounts...) {
+		all[m] = true
+	}
+	st.Mounts = make([]string, 0, len(all))
+	for m := range all {
+		st.Mounts = append(st.Mounts, m)
+	}
+	sort.Strings(st.Mounts)
+	st.Mounted = len(liveMounts) > 0
+	return nil
+}
+
+// problems lists what is wrong with one volume of a resource.  An
+// unconfigured minor has no problems.
+func (o Options) problems(r Resource, volume int) []string {
+	d := r.Devices[volume]
+	var problems []string
+	add := func(s string) {
+		problems = append(problems, s)
+	}
+	if !d.Client && d.Disk != "UpToDate" && d.Disk != "" {
+		add("disk is " + d.Disk)
+	}
+	if d.Quorum == "no" {
+		add("no quorum")
+	}
+	for _, id := range r.peers() {
+		c := r.Connections[id]
+		if c.Connection == "Unconfigured" {
+			continue
+		}
+		peer := "peer " + Change{PeerNodeID: id, Peer: c.Name}.peer()
+		pd := c.PeerDevices[volume]
+		cs, replication := connectionName(c.Connection), pd.Replication
+		if replication == "" && cs != "Connected" {
+			// /proc/drbd shows the replication state as cs
+			replication = cs
+		}
+		if !connected(cs) {
+			add(peer + " connection is " + c.Connection)
+			// the peer's disk is unknown, not a problem of its own
+			continue
+		}
+		if replication != "" && connectionName(replication) != "Connected" {
+			add(peer + " is " + replication)
+		}
+		if pd.PeerDisk != "UpToDate" && pd.PeerDisk != "Diskless" {
+			add(peer + " disk is " + pd.PeerDisk)
+		}
+	}
+	if min := o.MinReplicas[r.Name]; min > 0 {
+		if n := r.Replicas(volume); n < min {
+			add(strconv.Itoa(n) + " UpToDate replicas, fewer than " + strconv.Itoa(min))
+		}
+	}
+	return problems
+}
+
+// MeasureSyncSpeed sets SyncSpeed, where it isn't known, from how much
+// OutOfSync went down between two calls to Status
+func MeasureSyncSpeed(before, after []Status, elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	oos := make(map[int]int64)
+	for _, s := range before {
+		oos[s.Minor] = s.OutOfSync
+	}
+	for i, s := range after {
+		b, ok := oos[s.Minor]
+		if !ok || s.SyncPercent == nil || s.SyncSpeed != 0 || b <= s.OutOfSync {
+			continue
+		}
+		after[i].SyncSpeed = int64(float64(b-s.OutOfSync) / elapsed.Seconds())
+	}
+}
+
+// procDetail is what /proc/drbd says about a resync
+type procDetail struct {
+	synced    *float64
+	speed     int64
+	outOfSync int64
+}
+
+var (
+	syncedRE    = regexp.MustCompile(`sync'ed:\s*([0-9.]+)%`)
+	speedRE     = regexp.MustCompile(`speed: ([0-9,]+) `)
+	outOfSyncRE = regexp.MustCompile(`\boos:(\d+)`)
+)
+
+// procDetails finds how far along each resync in /proc/drbd is
+func procDetails(raw []byte) map[int]procDetail {
+	details := make(map[int]procDetail)
+	minor := -1
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		t := scanner.Text()
+		if m := deviceRE.FindStringSubmatch(t); len(m) != 0 {
+			minor, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if minor < 0 {
+			continue
+		}
+		d := details[minor]
+		if m := syncedRE.FindStringSubmatch(t); len(m) != 0 {
+			if p, err := strconv.ParseFloat(m[1], 64); err == nil {
+				d.synced = &p
+			}
+		}
+		if m := speedRE.FindStringSubmatch(t); len(m) != 0 {
+			d.speed, _ = strconv.ParseInt(strings.Replace(m[1], ",", "", -1), 10, 64)
+		}
+		if m := outOfSyncRE.FindStringSubmatch(t); len(m) != 0 {
+			d.outOfSync, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		details[minor] = d
+	}
+	return details
+}
@@ -0,0 +1,63 @@
+package drbd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatus(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("/proc/drbd", exampleProcDRBD2)
+	fs.WriteFile("/etc/fstab", exampleFstab)
+	fs.WriteFile("/proc/mounts", exampleProcMounts+"\n/dev/drbd0 /r0 btrfs rw 0 0\n")
+	statuses, err := Options{FS: fs}.Status()
+	require.NoError(t, err, "status")
+	require.Len(t, statuses, 3, "minors")
+	s := statuses[0]
+	assert.Equal(t, "r0", s.Name, "name")
+	assert.Equal(t, "SyncSource", s.Connection, "connection")
+	if assert.NotNil(t, s.SyncPercent, "syncing") {
+		assert.Equal(t, 34.7, *s.SyncPercent, "sync percent")
+	}
+	assert.Equal(t, []string{"/r0"}, s.Mounts, "mounts")
+	assert.True(t, s.Mounted, "mounted")
+	assert.True(t, s.Degraded, "degraded")
+	assert.Equal(t, []string{"peer 1 is SyncSource", "peer 1 disk is Inconsistent"}, s.Problems, "problems")
+	assert.Empty(t, statuses[1].Mounts, "no mounts")
+
+	fs.WriteFile("/proc/drbd", RenderProcDRBD(States{0: stateConnected, 1: {Connection: "Unconfigured"}}))
+	fs.Remove("/etc/fstab")
+	statuses, err = Options{FS: fs}.Status()
+	require.NoError(t, err, "healthy")
+	require.Len(t, statuses, 2, "healthy minors")
+	for _, s := range statuses {
+		assert.False(t, s.Degraded, "r%d not degraded", s.Minor)
+		assert.Nil(t, s.SyncPercent, "r%d not syncing", s.Minor)
+	}
+	assert.Equal(t, []string{"/r0"}, statuses[0].Mounts, "mounted without fstab")
+
+	statuses, err = Options{FS: fs, MinReplicas: map[string]int{"r0": 3}}.Status()
+	require.NoError(t, err, "min replicas")
+	assert.Equal(t, []string{"2 UpToDate replicas, fewer than 3"}, statuses[0].Problems, "too few replicas")
+}
+
+func TestStatusDrbdsetup(t *testing.T) {
+	f := &fakeDrbdsetup{
+		status: readTestdata(t, "status.json"),
+		show:   readTestdata(t, "show.json"),
+	}
+	statuses, err := Options{Source: SourceDrbdsetup, Output: f.output, FS: NewMemFS()}.Status()
+	require.NoError(t, err, "status")
+	require.Len(t, statuses, 2, "volumes")
+	assert.Equal(t, []string{"peer beta connection is Connecting"}, statuses[0].Problems, "volume 0")
+	assert.Nil(t, statuses[0].SyncPercent, "volume 0 in sync")
+	assert.Equal(t, []string{"peer alpha is SyncSource", "peer alpha disk is Inconsistent", "peer beta connection is Connecting"},
+		statuses[1].Problems, "volume 1")
+	if assert.NotNil(t, statuses[1].SyncPercent, "volume 1 syncing") {
+		assert.Equal(t, 25.0, *statuses[1].SyncPercent, "sync percent")
+	}
+	require.Len(t, statuses[1].Peers, 2, "peers")
+	assert.Equal(t, int64(1572864), statuses[1].Peers[0].OutOfSync, "out of sync")
+}
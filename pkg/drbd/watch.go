@@ -2,12 +2,13 @@ package drbd
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -21,11 +22,14 @@ import (
 
 // State tracks the DRBD state for a resource
 type State struct {
-	Connection string
-	SelfRole   string
-	RemoteRole string
-	SelfDisk   string
-	RemoteDisk string
+	Connection string `json:"connection"`
+	SelfRole   string `json:"self_role"`
+	RemoteRole string `json:"remote_role"`
+	SelfDisk   string `json:"self_disk"`
+	RemoteDisk string `json:"remote_disk"`
+	// Client is true for a DRBD 9 device that is intentionally
+	// diskless.  /proc/drbd doesn't say.
+	Client bool `json:"client,omitempty"`
 }
 
 func (s State) Equal(o State) bool {
@@ -33,12 +37,47 @@ func (s State) Equal(o State) bool {
 		s.SelfRole == o.SelfRole &&
 		s.RemoteRole == o.RemoteRole &&
 		s.SelfDisk == o.SelfDisk &&
-		s.RemoteDisk == o.RemoteDisk
+		s.RemoteDisk == o.RemoteDisk &&
+		s.Client == o.Client
+}
+
+// Unconfigured is true for a minor that exists without a configured
+// resource.  Only Connection is set.
+func (s State) Unconfigured() bool {
+	return s.Connection == "Unconfigured"
+}
+
+// Diskless is true when there is no local disk: either a diskless
+// client or a disk that has been detached.  Client tells them apart.
+func (s State) Diskless() bool {
+	return s.SelfDisk == "Diskless"
+}
+
+// PeerDiskless is true when the peer has no disk
+func (s State) PeerDiskless() bool {
+	return s.RemoteDisk == "Diskless"
+}
+
+// attached is true when there is a local disk
+func (s State) attached() bool {
+	return s.SelfDisk != "" && !s.Diskless()
 }
 
 // Maps resource number to resource state
 type States map[int]State
 
+func (s States) equal(o States) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for r, state := range s {
+		if other, ok := o[r]; !ok || !other.Equal(state) {
+			return false
+		}
+	}
+	return true
+}
+
 // Watch returns once the DRBD state changes.
 // It returns only the subset of the state that has changed,
 // both the old and new.
@@ -48,13 +87,24 @@ type States map[int]State
 // The oldStates passed in allow Watch to be initialized with pre-existing
 // expectations
 func Watch(filename string, oldStates States, nap time.Duration) (States, States, error) {
+	return Options{ProcDRBD: filename, Nap: nap}.Watch(oldStates)
+}
+
+// Watch is like the Watch function but it reads ProcDRBD from FS, or
+// runs drbdsetup, according to Source, and naps using Clock.  While
+// anything is unsettled, it naps for FastNap.
+func (o Options) Watch(oldStates States) (States, States, error) {
 	oldValues := make(States)
 	newValues := make(States)
+	warned := make(map[string]bool)
+	src := &pollSource{o: o}
 	for {
-		newStates, err := getStates(filename)
+		rs, warnings, err := src.read(nil)
 		if err != nil {
 			return nil, nil, err
 		}
+		o.logWarnings(warned, warnings)
+		newStates := rs.States()
 		for r, state := range oldStates {
 			if n, ok := newStates[r]; ok {
 				if !n.Equal(state) {
@@ -77,61 +127,120 @@ func Watch(filename string, oldStates States, nap time.Duration) (States, States
 			return oldValues, newValues, nil
 		}
 		oldStates = newStates
-		time.Sleep(nap)
+		src.wait()
 	}
 }
 
-var re = regexp.MustCompile(`^ (\d+): cs:(\S+) ro:(\S+?)/(\S+) ds:(\S+)/(\S+) `)
-var skipRE = regexp.MustCompile(`^\s+(?:ns:\d+ |\[\=*\>\.*\] sync'ed|finish: \d)`)
+var deviceRE = regexp.MustCompile(`^\s*(\d+): (.*)$`)
+var headerRE = regexp.MustCompile(`^(?:srcversion|GIT-hash|Transports)`)
+var skipRE = regexp.MustCompile(`^\s+(?:ns:\d+ |\[=*>\.*\] (?:sync'ed|verified):|finish: \d|(?:resync|act_log): used:)`)
 
 func getStates(filename string) (States, error) {
-	fh, err := os.Open(filename)
+	return Options{ProcDRBD: filename}.getStates()
+}
+
+func (o Options) getStates() (States, error) {
+	s, _, err := o.readStates()
+	return s, err
+}
+
+// readStates also returns the lines that were skipped because
+// of Options.Lenient
+func (o Options) readStates() (States, []string, error) {
+	raw, err := o.readProcDRBD()
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseStates(bytes.NewReader(raw), o.procDRBD(), o.Lenient)
+}
+
+// readProcDRBD returns nothing if ProcDRBD doesn't exist
+func (o Options) readProcDRBD() ([]byte, error) {
+	filename := o.procDRBD()
+	fh, err := o.fs().Open(filename)
 	if err != nil {
 		// if DRBD isn't running /proc/drbd won't exist and open will fail
-		switch e := err.(type) {
-		case *os.PathError:
-			if e.Err == syscall.ENOENT {
-				return nil, nil
-			}
-		default:
-			return nil, errors.Wrapf(err, "open %s", filename)
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+		return nil, errors.Wrapf(err, "open %s", filename)
 	}
 	defer fh.Close()
-	scanner := bufio.NewScanner(fh)
-	// skip over version number
+	raw, err := ioutil.ReadAll(fh)
+	return raw, errors.Wrapf(err, "read %s", filename)
+}
+
+// parseStates understands /proc/drbd from DRBD 8.0 through 9.  DRBD 9
+// doesn't list resources in /proc/drbd so there won't be any states.
+// Lines that aren't understood are an error unless lenient is set, in
+// which case they are returned as warnings.
+func parseStates(r io.Reader, filename string, lenient bool) (States, []string, error) {
+	scanner := bufio.NewScanner(r)
 	if !scanner.Scan() {
-		t := scanner.Text()
-		if !strings.HasPrefix(t, "version") {
-			return nil, fmt.Errorf("%s did not start with a version string. Found: '%s'\n",
-				filename, t)
-		}
+		// an empty file is treated like a missing one
+		return nil, nil, errors.Wrapf(scanner.Err(), "read %s", filename)
 	}
-	// skip over version checksum
-	if !scanner.Scan() {
-		return nil, fmt.Errorf("%s ended early", filename)
+	if t := scanner.Text(); !strings.HasPrefix(t, "version:") {
+		return nil, nil, errors.Errorf("%s did not start with a version string. Found: '%s'",
+			filename, t)
 	}
 	s := make(States)
+	var warnings []string
 	for scanner.Scan() {
 		t := scanner.Text()
-		if m := re.FindStringSubmatch(t); len(m) != 0 {
-			r, _ := strconv.Atoi(m[1])
-			s[r] = State{
-				Connection: m[2],
-				SelfRole:   m[3],
-				RemoteRole: m[4],
-				SelfDisk:   m[5],
-				RemoteDisk: m[6],
+		if m := deviceRE.FindStringSubmatch(t); len(m) != 0 {
+			if r, state, ok := parseDevice(m[1], m[2]); ok {
+				s[r] = state
+				continue
 			}
-			continue
 		}
-		if skipRE.MatchString(t) {
+		if headerRE.MatchString(t) || skipRE.MatchString(t) || strings.TrimSpace(t) == "" {
 			continue
 		}
-		if t == "" {
-			continue
+		if !lenient {
+			return nil, nil, errors.Errorf("Unexpected %s output line:\n%s", filename, t)
 		}
-		return nil, fmt.Errorf("Unexpected %s output line:\n%s\n", filename, t)
+		warnings = append(warnings, t)
+	}
+	return s, warnings, errors.Wrapf(scanner.Err(), "read %s", filename)
+}
+
+// parseDevice parses the fields of a line like
+// " 0: cs:Connected ro:Primary/Secondary ds:UpToDate/UpToDate C r-----".
+// DRBD 8.0 has st: instead of ro:.  Only the first peer is used.
+func parseDevice(minor string, rest string) (int, State, bool) {
+	r, err := strconv.Atoi(minor)
+	if err != nil {
+		return 0, State{}, false
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(rest) {
+		kv := strings.SplitN(f, ":", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	cs, ok := fields["cs"]
+	if !ok {
+		return 0, State{}, false
+	}
+	if cs == "Unconfigured" {
+		return r, State{Connection: cs}, true
+	}
+	ro, ok := fields["ro"]
+	if !ok {
+		ro, ok = fields["st"]
+	}
+	roles := strings.Split(ro, "/")
+	disks := strings.Split(fields["ds"], "/")
+	if !ok || len(roles) < 2 || len(disks) < 2 {
+		return 0, State{}, false
 	}
-	return s, nil
+	return r, State{
+		Connection: cs,
+		SelfRole:   roles[0],
+		RemoteRole: roles[1],
+		SelfDisk:   disks[0],
+		RemoteDisk: disks[1],
+	}, true
 }
@@ -1,7 +1,16 @@
 package drbd
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Flaque/filet"
 	"github.com/stretchr/testify/assert"
@@ -49,3 +58,105 @@ func TestReadDRBDStatus1(t *testing.T) {
 		assert.Equal(t, "Inconsistent", s.RemoteDisk, "remote disk")
 	}
 }
+
+type brokenFS struct{}
+
+func (brokenFS) Open(name string) (io.ReadCloser, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+func TestReadDRBDStatusErrors(t *testing.T) {
+	got, err := Options{FS: NewMemFS()}.getStates()
+	require.NoError(t, err, "missing file")
+	assert.Empty(t, got, "states for missing file")
+
+	_, err = Options{FS: brokenFS{}}.getStates()
+	assert.Error(t, err, "unreadable file")
+}
+
+func TestWatchMemFS(t *testing.T) {
+	c, next := collectDeltas()
+	w := newMemWatcher(Options{}, map[string]string{
+		"/proc/drbd": exampleProcDRBD1,
+	}, func(o Options) error {
+		return o.React(func(d Delta) error {
+			next(d)
+			return nil
+		})
+	})
+	got := nextDelta(t, c, napTime)
+	assert.Equal(t, "WFConnection", got.New.Connection, "initial")
+	assert.Equal(t, testStart, got.Seen, "seen at start")
+
+	w.clock.Advance(time.Minute)
+	w.change(exampleProcDRBD2)
+	for i := 0; i < 3; i++ {
+		got = nextDelta(t, c, napTime)
+		if got.Resource == 0 {
+			assert.Equal(t, "SyncSource", got.New.Connection, "changed")
+			assert.Equal(t, time.Minute+time.Second, got.UnchangedFor, "unchanged for")
+		}
+	}
+	w.stop(t)
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+type golden struct {
+	States   States   `json:"states"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// TestGolden parses /proc/drbd output in the formats of several DRBD
+// versions.  The files were written by hand from the DRBD sources and
+// documentation, not captured from running systems.
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/proc-drbd/*.txt")
+	require.NoError(t, err, "glob")
+	require.NotEmpty(t, files, "golden files")
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		require.NoError(t, err, file)
+		states, warnings, err := parseStates(bytes.NewReader(contents), file, true)
+		require.NoError(t, err, file)
+		got := golden{States: states, Warnings: warnings}
+
+		goldenFile := strings.TrimSuffix(file, ".txt") + ".json"
+		if *updateGolden {
+			b, err := json.MarshalIndent(got, "", "\t")
+			require.NoError(t, err, goldenFile)
+			require.NoError(t, ioutil.WriteFile(goldenFile, append(b, '\n'), 0644), goldenFile)
+		}
+		b, err := ioutil.ReadFile(goldenFile)
+		require.NoError(t, err, goldenFile)
+		var want golden
+		require.NoError(t, json.Unmarshal(b, &want), goldenFile)
+		assert.Equal(t, want, got, file)
+
+		strict, _, err := parseStates(bytes.NewReader(contents), file, false)
+		if len(warnings) > 0 {
+			assert.Error(t, err, "strict %s", file)
+		} else if assert.NoError(t, err, "strict %s", file) {
+			assert.Equal(t, states, strict, "strict %s", file)
+		}
+	}
+}
+
+func TestLenient(t *testing.T) {
+	fs := NewMemFS()
+	fs.WriteFile("/proc/drbd", exampleProcDRBD1+"\tsomething new: 1\n")
+	_, err := Options{FS: fs}.getStates()
+	assert.Error(t, err, "strict")
+	got, err := Options{FS: fs, Lenient: true}.getStates()
+	require.NoError(t, err, "lenient")
+	assert.Contains(t, got, 0, "lenient")
+
+	fs.WriteFile("/proc/drbd", "")
+	got, err = Options{FS: fs}.getStates()
+	require.NoError(t, err, "empty file")
+	assert.Empty(t, got, "empty file")
+
+	fs.WriteFile("/proc/drbd", " 0: cs:Connected ro:Primary/Secondary ds:UpToDate/UpToDate C r-----\n")
+	_, err = Options{FS: fs, Lenient: true}.getStates()
+	assert.Error(t, err, "no version")
+}
@@ -0,0 +1,168 @@
+package drbdtest
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Run is a drbd.Runner.  It handles "drbdadm primary|secondary|connect|
+// disconnect|invalidate|detach|attach <resource>|all" by changing the
+// node's state.
+// Other commands are passed to Fallback.  Every command is recorded.
+func (n *Node) Run(name string, args ...string) error {
+	n.mu.Lock()
+	n.commands = append(n.commands, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+	fallback := n.Fallback
+	n.mu.Unlock()
+	if name != "drbdadm" {
+		if fallback == nil {
+			return errors.Errorf("%s: command not found", name)
+		}
+		return fallback(name, args...)
+	}
+	if len(args) != 2 {
+		return errors.Errorf("drbdadm %s: expected a command and a resource", strings.Join(args, " "))
+	}
+	command, resources := args[0], []string{args[1]}
+	var do func(r *resource) error
+	switch command {
+	case "primary":
+		do = primary
+	case "secondary":
+		do = func(r *resource) error {
+			r.role = "Secondary"
+			return nil
+		}
+	case "connect":
+		do = func(r *resource) error {
+			if r.connection != "StandAlone" {
+				return errors.New("Failure: (125) Device has a net-config (use disconnect first)")
+			}
+			r.connect()
+			return nil
+		}
+	case "disconnect":
+		do = func(r *resource) error {
+			if r.role == "Primary" && r.connected() {
+				r.needsSync = true
+			}
+			r.connection = "StandAlone"
+			r.synced = 0
+			return nil
+		}
+	case "invalidate":
+		do = invalidate
+	case "detach":
+		do = func(r *resource) error {
+			if r.disk == "Diskless" {
+				return errors.New("Device has no disk")
+			}
+			if r.role == "Primary" && !(r.connected() && r.peerDisk == "UpToDate") {
+				return errors.New("State change failed: (-2) Need access to UpToDate data")
+			}
+			r.disk = "Diskless"
+			return nil
+		}
+	case "attach":
+		do = func(r *resource) error {
+			if r.disk != "Diskless" {
+				return errors.New("Failure: (124) Device is attached to a disk (use detach first)")
+			}
+			// the disk has missed writes so it needs a resync
+			r.disk = "Inconsistent"
+			if r.connected() {
+				r.connect()
+			}
+			return nil
+		}
+	default:
+		return errors.Errorf("drbdadm: unknown command '%s'", command)
+	}
+	if args[1] == "all" {
+		n.mu.Lock()
+		resources = n.names()
+		n.mu.Unlock()
+	}
+	for _, resource := range resources {
+		err := n.change(resource, do)
+		if err != nil {
+			return errors.Wrapf(err, "drbdadm %s %s", command, resource)
+		}
+	}
+	return nil
+}
+
+func primary(r *resource) error {
+	if r.connected() && r.peerRole == "Primary" {
+		return errors.New("State change failed: (-1) Multiple primaries not allowed by config")
+	}
+	if r.disk != "UpToDate" && !(r.connected() && r.peerDisk == "UpToDate") {
+		return errors.New("State change failed: (-2) Need access to UpToDate data")
+	}
+	r.role = "Primary"
+	return nil
+}
+
+// invalidate discards the local data.  When connected, it is
+// replaced with a resync from the peer.
+func invalidate(r *resource) error {
+	if r.connected() {
+		if r.peerDisk != "UpToDate" {
+			return errors.New("State change failed: (-2) Need access to UpToDate data")
+		}
+		r.disk = "Inconsistent"
+		r.connect()
+		return nil
+	}
+	if r.role == "Primary" {
+		return errors.New("State change failed: (-2) Need access to UpToDate data")
+	}
+	r.disk = "Inconsistent"
+	return nil
+}
+
+// Output returns what drbdsetup would print for "status --json
+// [resource...]" and "events2 --now".  Other commands are run with
+// Run and have no output.
+func (n *Node) Output(name string, args ...string) ([]byte, error) {
+	if name != "drbdsetup" {
+		return nil, n.Run(name, args...)
+	}
+	n.mu.Lock()
+	n.commands = append(n.commands, strings.TrimSpace(name+" "+strings.Join(args, " ")))
+	n.mu.Unlock()
+	var flags, rest []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			flags = append(flags, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	if len(rest) == 0 {
+		return nil, errors.New("drbdsetup: missing command")
+	}
+	switch rest[0] {
+	case "status":
+		if !contains(flags, "--json") {
+			return nil, errors.New("drbdsetup status: only --json output is emulated")
+		}
+		return n.StatusJSON(rest[1:]...)
+	case "events2":
+		if !contains(flags, "--now") {
+			return nil, errors.New("drbdsetup events2: only --now is emulated")
+		}
+		return []byte(strings.Join(n.Events2Now(), "\n") + "\n"), nil
+	}
+	return nil, errors.Errorf("drbdsetup: unknown command '%s'", rest[0])
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package drbdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SocketEnv names the environment variable that tells a fake drbdadm
+// or drbdsetup where its Node is serving
+const SocketEnv = "DRBDTEST_SOCKET"
+
+// FakeCommands are the executables that InstallFakes provides
+var FakeCommands = []string{"drbdadm", "drbdsetup"}
+
+type request struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+type response struct {
+	Output []byte `json:"output"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Serve answers the commands sent by fake executables, with Output,
+// until l is closed.  That lets shell scripts run by the watcher
+// change the node's state:
+//
+//	l, _ := net.Listen("unix", dir+"/node.sock")
+//	go node.Serve(l)
+//	drbdtest.InstallFakes(dir)
+//	os.Setenv(drbdtest.SocketEnv, dir+"/node.sock")
+//	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+func (n *Node) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go n.serve(conn)
+	}
+}
+
+func (n *Node) serve(conn net.Conn) {
+	defer conn.Close()
+	var req request
+	err := json.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		return
+	}
+	var resp response
+	resp.Output, err = n.Output(req.Name, req.Args...)
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// Command sends a command to the Node serving on socket and returns
+// its output
+func Command(socket string, name string, args ...string) ([]byte, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: connect to the fake node", name)
+	}
+	defer conn.Close()
+	err = json.NewEncoder(conn).Encode(request{Name: name, Args: args})
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: send", name)
+	}
+	var resp response
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: receive", name)
+	}
+	if resp.Error != "" {
+		return resp.Output, errors.New(resp.Error)
+	}
+	return resp.Output, nil
+}
+
+// InstallFakes links the running executable into dir as each of
+// FakeCommands.  The executable must call FakeMain first thing, for
+// example from TestMain.
+func InstallFakes(dir string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "find the running executable")
+	}
+	for _, name := range FakeCommands {
+		err = os.Symlink(self, filepath.Join(dir, name))
+		if err != nil {
+			return errors.Wrapf(err, "install fake %s", name)
+		}
+	}
+	return nil
+}
+
+// FakeMain acts as one of FakeCommands, if that's what the executable
+// was run as, and exits.  Otherwise it returns.
+func FakeMain() {
+	name := filepath.Base(os.Args[0])
+	socket := os.Getenv(SocketEnv)
+	if socket == "" || !contains(FakeCommands, name) {
+		return
+	}
+	out, err := Command(socket, name, os.Args[1:]...)
+	os.Stdout.Write(out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, strings.TrimPrefix(err.Error(), name+": "))
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
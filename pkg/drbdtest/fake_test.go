@@ -0,0 +1,139 @@
+package drbdtest
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// the test binary is also the fake drbdadm and drbdsetup
+	FakeMain()
+	os.Exit(m.Run())
+}
+
+// setenv sets an environment variable and returns a function that
+// puts it back
+func setenv(t *testing.T, key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value), "setenv %s", key)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// fakes serves node and puts fake commands that talk to it first in
+// $PATH.  The returned function undoes that.
+func fakes(t *testing.T, node *Node) (dir string, done func()) {
+	dir, err := ioutil.TempDir("", "drbdtest")
+	require.NoError(t, err, "temporary directory")
+	require.NoError(t, InstallFakes(dir), "install fakes")
+	socket := filepath.Join(dir, "node.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err, "listen")
+	go node.Serve(l)
+	unsetSocket := setenv(t, SocketEnv, socket)
+	unsetPath := setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir, func() {
+		unsetPath()
+		unsetSocket()
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFakeCommands(t *testing.T) {
+	node := NewNode(nil)
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+	_, done := fakes(t, node)
+	defer done()
+
+	require.NoError(t, exec.Command("drbdadm", "primary", "r0").Run(), "promote")
+	assert.Equal(t, "Primary", node.States()[0].SelfRole, "promoted")
+	out, err := exec.Command("drbdadm", "primary", "r9").CombinedOutput()
+	assert.Error(t, err, "unknown resource")
+	assert.Contains(t, string(out), "r9", "error message")
+
+	out, err = exec.Command("drbdsetup", "status", "--json").Output()
+	require.NoError(t, err, "status")
+	rs, err := drbd.ParseStatusJSON(out)
+	require.NoError(t, err, "parse status")
+	assert.Equal(t, node.States(), rs.States(), "status")
+}
+
+// TestShellHook runs the watcher with a shell script that promotes a
+// resource whose peer has gone away
+func TestShellHook(t *testing.T) {
+	clock := drbd.NewManualClock(start)
+	node := NewNode(clock)
+	node.WriteFile("/etc/fstab", "")
+	node.WriteFile("/proc/mounts", "")
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+	dir, done := fakes(t, node)
+	defer done()
+	hook := filepath.Join(dir, "hook")
+	require.NoError(t, ioutil.WriteFile(hook, []byte(`#!/bin/sh
+# resource connection role peer-role disk peer-disk mount
+if [ "$3" = Secondary ] && [ "$4" = Unknown ]; then
+	exec drbdadm primary "$1"
+fi
+`), 0755), "hook")
+
+	ran := make(chan drbd.Delta, 10)
+	c := drbd.NewControl()
+	o := drbd.Options{
+		FS:      node,
+		Clock:   clock,
+		Nap:     time.Second,
+		Control: c,
+		CommandDone: func(delta drbd.Delta, _ *exec.Cmd, err error) {
+			assert.NoError(t, err, "hook for %s", delta.New.Connection)
+			ran <- delta
+		},
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- o.RunCommandOnChange(true, []string{hook})
+	}()
+	next := func(what string) drbd.Delta {
+		select {
+		case d := <-ran:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no hook for %s", what)
+		}
+		return drbd.Delta{}
+	}
+	clock.BlockUntil(1)
+	assert.Equal(t, "Connected", next("startup").New.Connection, "startup")
+
+	clock.BlockUntil(1)
+	require.NoError(t, node.LoseConnection("r0"), "lose connection")
+	clock.Advance(time.Second)
+	assert.Equal(t, "Unknown", next("disconnect").New.RemoteRole, "disconnected")
+	assert.Contains(t, node.Commands(), "drbdadm primary r0", "the hook promoted r0")
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	assert.Equal(t, "Primary", next("promote").New.SelfRole, "promoted")
+
+	c.Stop()
+	select {
+	case err := <-errs:
+		assert.Equal(t, drbd.ErrStopped, err, "stopped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+}
@@ -0,0 +1,298 @@
+// Package drbdtest emulates a DRBD node, and its one peer, in-process so
+// that the watcher and everything downstream of it can be tested without
+// a kernel module.
+//
+// A Node is a drbd.FS that serves /proc/drbd from its current state, and
+// its Run method is a drbd.Runner that understands enough of drbdadm to
+// change that state:
+//
+//	node := drbdtest.NewNode(clock)
+//	node.AddResource("r0", 0)
+//	node.WriteFile("/etc/fstab", "/dev/drbd0 /r0 ext4 noauto 0 0\n")
+//	o := drbd.Options{FS: node, Clock: clock, Run: node.Run}
+//
+// Serve and InstallFakes provide drbdadm and drbdsetup executables that
+// talk to a Node, so that shell scripts can be tested too.
+package drbdtest
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProcDRBD is where a Node serves its /proc/drbd text
+	ProcDRBD = "/proc/drbd"
+	// PeerName and PeerNodeID identify the peer in DRBD 9 output
+	PeerName   = "peer"
+	PeerNodeID = 1
+)
+
+// Node is a fake DRBD node.  Files other than ProcDRBD are kept in the
+// embedded MemFS.
+type Node struct {
+	*drbd.MemFS
+	// Fallback runs commands other than drbdadm.  If it is nil,
+	// they fail.
+	Fallback drbd.Runner
+
+	clock     drbd.Clock
+	mu        sync.Mutex
+	resources map[string]*resource
+	events    []string
+	commands  []string
+}
+
+// resource holds the truth about one resource and its peer.  The peer's
+// role and disk are only visible while connected.
+type resource struct {
+	name       string
+	minor      int
+	connection string // DRBD 8.4 name: Connected, WFConnection, SyncSource...
+	role       string
+	disk       string
+	peerRole   string
+	peerDisk   string
+	reachable  bool // whether the peer can be reached
+	needsSync  bool // whether there are writes the other side hasn't seen
+	synced     float64
+}
+
+// NewNode returns a node with no resources.  The clock is used for
+// events2 timestamps.  If it is nil, the real time is used.
+func NewNode(clock drbd.Clock) *Node {
+	return &Node{
+		MemFS:     drbd.NewMemFS(),
+		clock:     clock,
+		resources: make(map[string]*resource),
+	}
+}
+
+func (n *Node) now() time.Time {
+	if n.clock == nil {
+		return time.Now()
+	}
+	return n.clock.Now()
+}
+
+// AddResource brings up a resource that is connected, Secondary on
+// both sides, and UpToDate.
+func (n *Node) AddResource(name string, minor int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.resources[name]; ok {
+		return errors.Errorf("resource %s already exists", name)
+	}
+	for _, r := range n.resources {
+		if r.minor == minor {
+			return errors.Errorf("minor %d is already used by %s", minor, r.name)
+		}
+	}
+	r := &resource{
+		name:       name,
+		minor:      minor,
+		connection: "Connected",
+		role:       "Secondary",
+		disk:       "UpToDate",
+		peerRole:   "Secondary",
+		peerDisk:   "UpToDate",
+		reachable:  true,
+	}
+	n.resources[name] = r
+	n.record("create", r, resource{})
+	return nil
+}
+
+// RemoveResource takes a resource down
+func (n *Node) RemoveResource(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, err := n.get(name)
+	if err != nil {
+		return err
+	}
+	delete(n.resources, name)
+	n.record("destroy", r, *r)
+	return nil
+}
+
+// States returns the states that /proc/drbd shows
+func (n *Node) States() drbd.States {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	states := make(drbd.States)
+	for _, r := range n.resources {
+		states[r.minor] = r.state()
+	}
+	return states
+}
+
+func (r *resource) connected() bool {
+	switch r.connection {
+	case "StandAlone", "WFConnection":
+		return false
+	}
+	return true
+}
+
+func (r *resource) state() drbd.State {
+	s := drbd.State{
+		Connection: r.connection,
+		SelfRole:   r.role,
+		RemoteRole: "Unknown",
+		SelfDisk:   r.disk,
+		RemoteDisk: "DUnknown",
+	}
+	if r.connected() {
+		s.RemoteRole = r.peerRole
+		s.RemoteDisk = r.peerDisk
+	}
+	return s
+}
+
+// get is called with n.mu held
+func (n *Node) get(name string) (*resource, error) {
+	r, ok := n.resources[name]
+	if !ok {
+		return nil, errors.Errorf("'%s' not defined in your config", name)
+	}
+	return r, nil
+}
+
+// change applies f to a resource and records the change
+func (n *Node) change(name string, f func(r *resource) error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r, err := n.get(name)
+	if err != nil {
+		return err
+	}
+	before := *r
+	err = f(r)
+	n.record("change", r, before)
+	return err
+}
+
+// LoseConnection simulates the peer becoming unreachable.  If this
+// side is Primary, it is assumed to have writes that will need to be
+// synced when the connection comes back.
+func (n *Node) LoseConnection(name string) error {
+	return n.change(name, func(r *resource) error {
+		r.reachable = false
+		if r.connected() {
+			r.connection = "WFConnection"
+			r.synced = 0
+		}
+		if r.role == "Primary" {
+			r.needsSync = true
+		}
+		return nil
+	})
+}
+
+// RestoreConnection makes the peer reachable again.  Unless the
+// resource is StandAlone it reconnects, resyncing if needed.
+func (n *Node) RestoreConnection(name string) error {
+	return n.change(name, func(r *resource) error {
+		r.reachable = true
+		if r.connection == "WFConnection" {
+			r.connect()
+		}
+		return nil
+	})
+}
+
+// connect either waits for the peer or connects to it and starts a
+// resync if one is needed
+func (r *resource) connect() {
+	if !r.reachable {
+		r.connection = "WFConnection"
+		return
+	}
+	switch {
+	case r.disk != "UpToDate":
+		r.connection = "SyncTarget"
+		r.peerDisk = "UpToDate"
+		r.synced = 0
+	case r.needsSync || r.peerDisk != "UpToDate":
+		r.connection = "SyncSource"
+		r.peerDisk = "Inconsistent"
+		r.synced = 0
+	default:
+		r.connection = "Connected"
+	}
+}
+
+// SyncProgress sets how far along a resync is.  At 100 percent the
+// resync finishes and both disks are UpToDate.
+func (n *Node) SyncProgress(name string, percent float64) error {
+	return n.change(name, func(r *resource) error {
+		if r.connection != "SyncSource" && r.connection != "SyncTarget" {
+			return errors.Errorf("%s is not syncing: %s", name, r.connection)
+		}
+		if percent < 100 {
+			r.synced = percent
+			return nil
+		}
+		r.connection = "Connected"
+		r.disk = "UpToDate"
+		r.peerDisk = "UpToDate"
+		r.needsSync = false
+		r.synced = 0
+		return nil
+	})
+}
+
+// SetPeerRole simulates the peer being promoted or demoted.  The peer
+// refuses to become Primary while this side is Primary.
+func (n *Node) SetPeerRole(name string, role string) error {
+	return n.change(name, func(r *resource) error {
+		if role == "Primary" && r.role == "Primary" && r.connected() {
+			return errors.New("State change failed: (-1) Multiple primaries not allowed by config")
+		}
+		r.peerRole = role
+		return nil
+	})
+}
+
+// SetPeerDisk simulates a change in the peer's disk, eg "Failed" or
+// "Diskless"
+func (n *Node) SetPeerDisk(name string, disk string) error {
+	return n.change(name, func(r *resource) error {
+		r.peerDisk = disk
+		return nil
+	})
+}
+
+// Commands returns the commands that have been run, in order
+func (n *Node) Commands() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.commands...)
+}
+
+// names returns the resource names, sorted.  It is called with n.mu held.
+func (n *Node) names() []string {
+	names := make([]string, 0, len(n.resources))
+	for name := range n.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open serves ProcDRBD from the current state and everything else
+// from the MemFS
+func (n *Node) Open(name string) (io.ReadCloser, error) {
+	if name != ProcDRBD {
+		return n.MemFS.Open(name)
+	}
+	return ioutil.NopCloser(strings.NewReader(n.ProcDRBD())), nil
+}
@@ -0,0 +1,212 @@
+package drbdtest
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// parsed returns the states the watcher sees in the node's /proc/drbd
+func parsed(t *testing.T, node *Node) drbd.States {
+	_, states, err := drbd.Options{FS: node}.Watch(nil)
+	require.NoError(t, err, "parse /proc/drbd")
+	return states
+}
+
+// replayed returns the states from applying events2 lines
+func replayed(t *testing.T, lines []string) drbd.States {
+	e := drbd.NewEvents2()
+	for _, line := range lines {
+		_, _, err := e.Apply(line)
+		require.NoError(t, err, line)
+	}
+	return e.States()
+}
+
+func TestNode(t *testing.T) {
+	node := NewNode(drbd.NewManualClock(start))
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+	require.NoError(t, node.AddResource("r1", 1), "add r1")
+	assert.Error(t, node.AddResource("r2", 1), "minor in use")
+
+	connected := drbd.State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}
+	assert.Equal(t, drbd.States{0: connected, 1: connected}, parsed(t, node), "initial")
+
+	require.NoError(t, node.Run("drbdadm", "primary", "r0"), "primary")
+	require.NoError(t, node.LoseConnection("r0"), "lose connection")
+	assert.Equal(t, drbd.State{Connection: "WFConnection", SelfRole: "Primary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"},
+		parsed(t, node)[0], "disconnected")
+
+	require.NoError(t, node.RestoreConnection("r0"), "restore connection")
+	assert.Equal(t, drbd.State{Connection: "SyncSource", SelfRole: "Primary", RemoteRole: "Secondary", SelfDisk: "UpToDate", RemoteDisk: "Inconsistent"},
+		parsed(t, node)[0], "resync")
+	require.NoError(t, node.SyncProgress("r0", 42), "progress")
+	assert.Contains(t, node.ProcDRBD(), "sync'ed: 42.0%", "progress line")
+	require.NoError(t, node.SyncProgress("r0", 100), "finished")
+	assert.Equal(t, "Connected", parsed(t, node)[0].Connection, "resync finished")
+
+	assert.Equal(t, node.States(), parsed(t, node), "proc drbd")
+	assert.Equal(t, node.States(), replayed(t, node.Events2()), "events2")
+	assert.Equal(t, node.States(), replayed(t, node.Events2Now()), "events2 --now")
+
+	require.NoError(t, node.RemoveResource("r1"), "remove r1")
+	assert.Equal(t, node.States(), replayed(t, node.Events2()), "events2 after remove")
+	assert.NotContains(t, parsed(t, node), 1, "removed")
+}
+
+func TestCommands(t *testing.T) {
+	node := NewNode(nil)
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+
+	require.NoError(t, node.SetPeerRole("r0", "Primary"), "peer primary")
+	assert.Error(t, node.Run("drbdadm", "primary", "r0"), "two primaries")
+	require.NoError(t, node.SetPeerRole("r0", "Secondary"), "peer secondary")
+
+	assert.Error(t, node.Run("drbdadm", "connect", "r0"), "already connected")
+	require.NoError(t, node.Run("drbdadm", "disconnect", "all"), "disconnect")
+	assert.Equal(t, "StandAlone", node.States()[0].Connection, "disconnected")
+	require.NoError(t, node.Run("drbdadm", "invalidate", "r0"), "invalidate disconnected")
+	assert.Error(t, node.Run("drbdadm", "primary", "r0"), "no UpToDate data")
+	require.NoError(t, node.Run("drbdadm", "connect", "r0"), "connect")
+	assert.Equal(t, drbd.State{Connection: "SyncTarget", SelfRole: "Secondary", RemoteRole: "Secondary", SelfDisk: "Inconsistent", RemoteDisk: "UpToDate"},
+		node.States()[0], "sync target")
+	require.NoError(t, node.Run("drbdadm", "primary", "r0"), "primary while sync target")
+
+	require.NoError(t, node.SyncProgress("r0", 100), "synced")
+	require.NoError(t, node.Run("drbdadm", "detach", "r0"), "detach")
+	assert.True(t, node.States()[0].Diskless(), "detached")
+	assert.Error(t, node.Run("drbdadm", "detach", "r0"), "detach again")
+	require.NoError(t, node.Run("drbdadm", "attach", "r0"), "attach")
+	assert.Equal(t, "SyncTarget", node.States()[0].Connection, "attached")
+
+	assert.Error(t, node.Run("drbdadm", "primary", "r9"), "unknown resource")
+	assert.Error(t, node.Run("drbdadm", "resize", "r0"), "unknown command")
+	assert.Error(t, node.Run("mount", "/r0"), "no fallback")
+	node.Fallback = func(string, ...string) error { return nil }
+	assert.NoError(t, node.Run("mount", "/r0"), "fallback")
+
+	assert.Equal(t, []string{
+		"drbdadm primary r0",
+		"drbdadm connect r0",
+		"drbdadm disconnect all",
+		"drbdadm invalidate r0",
+		"drbdadm primary r0",
+		"drbdadm connect r0",
+		"drbdadm primary r0",
+		"drbdadm detach r0",
+		"drbdadm detach r0",
+		"drbdadm attach r0",
+		"drbdadm primary r9",
+		"drbdadm resize r0",
+		"mount /r0",
+		"mount /r0",
+	}, node.Commands(), "commands")
+}
+
+func TestStatusJSON(t *testing.T) {
+	node := NewNode(nil)
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+	require.NoError(t, node.Run("drbdadm", "invalidate", "r0"), "invalidate")
+	require.NoError(t, node.SyncProgress("r0", 25), "progress")
+
+	out, err := node.Output("drbdsetup", "status", "--json")
+	require.NoError(t, err, "status")
+	var status []map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &status), "decode")
+	require.Len(t, status, 1, "resources")
+	assert.Equal(t, "r0", status[0]["name"], "name")
+	connection := status[0]["connections"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "Connected", connection["connection-state"], "connection")
+	peerDevice := connection["peer_devices"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "SyncTarget", peerDevice["replication-state"], "replication")
+	assert.Equal(t, 25.0, peerDevice["percent-in-sync"], "in sync")
+
+	rs, err := drbd.ParseStatusJSON(out)
+	require.NoError(t, err, "parse status")
+	assert.Equal(t, node.States(), rs.States(), "status matches /proc/drbd")
+	assert.Equal(t, 25.0, rs["r0"].Connections[PeerNodeID].PeerDevices[0].PercentInSync, "parsed in sync")
+
+	_, err = node.Output("drbdsetup", "status", "--json", "r9")
+	assert.Error(t, err, "unknown resource")
+	out, err = node.Output("drbdsetup", "events2", "--now")
+	require.NoError(t, err, "events2")
+	assert.Contains(t, string(out), "exists -", "events2")
+}
+
+// TestFailover runs the watcher, with failover, against a node
+func TestFailover(t *testing.T) {
+	clock := drbd.NewManualClock(start)
+	node := NewNode(clock)
+	node.WriteFile("/etc/fstab", "/dev/drbd0 /r0 ext4 noauto 0 0\n")
+	node.WriteFile("/proc/mounts", "")
+	node.Fallback = func(name string, args ...string) error {
+		if name == "mountpoint" {
+			return errors.New("not a mountpoint")
+		}
+		return nil
+	}
+	require.NoError(t, node.AddResource("r0", 0), "add r0")
+
+	done := make(chan drbd.Delta, 10)
+	c := drbd.NewControl()
+	o := drbd.Options{
+		FS:      node,
+		Clock:   clock,
+		Nap:     time.Second,
+		Run:     node.Run,
+		Control: c,
+		Failover: []drbd.FailoverGroup{{
+			Name:  "web",
+			Units: []drbd.Unit{{Name: "r0", Resource: "r0", Mount: "/r0"}},
+		}},
+		CommandDone: func(delta drbd.Delta, _ *exec.Cmd, _ error) {
+			done <- delta
+		},
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- o.RunCommandOnChange(false, []string{"true"})
+	}()
+	next := func(what string) drbd.Delta {
+		select {
+		case d := <-done:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no command for %s", what)
+		}
+		return drbd.Delta{}
+	}
+	clock.BlockUntil(1)
+	assert.Equal(t, "Secondary", next("startup").New.SelfRole, "startup")
+
+	require.NoError(t, node.Run("drbdadm", "primary", "r0"), "promote")
+	clock.Advance(time.Second)
+	assert.Equal(t, "Primary", next("promote").New.SelfRole, "promoted")
+	assert.Contains(t, node.Commands(), "mount /r0", "failover mounted")
+
+	clock.BlockUntil(1)
+	require.NoError(t, node.LoseConnection("r0"), "lose connection")
+	clock.Advance(time.Second)
+	assert.Equal(t, "WFConnection", next("disconnect").New.Connection, "disconnected")
+
+	clock.BlockUntil(1)
+	require.NoError(t, node.RemoveResource("r0"), "remove r0")
+	clock.Advance(time.Second)
+	assert.Equal(t, drbd.State{}, next("remove").New, "removed")
+
+	c.Stop()
+	select {
+	case err := <-errs:
+		assert.Equal(t, drbd.ErrStopped, err, "stopped")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop")
+	}
+}
@@ -0,0 +1,205 @@
+package drbdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const events2Time = "2006-01-02T15:04:05.000000Z07:00"
+
+// sorted returns the resources in minor order.  It is called with n.mu held.
+func (n *Node) sorted() []*resource {
+	resources := make([]*resource, 0, len(n.resources))
+	for _, r := range n.resources {
+		resources = append(resources, r)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].minor < resources[j].minor
+	})
+	return resources
+}
+
+// ProcDRBD returns /proc/drbd text in the DRBD 8.4 format, with progress
+// lines for resources that are syncing
+func (n *Node) ProcDRBD() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var b strings.Builder
+	b.WriteString("version: 8.4.11 (api:1/proto:86-101)\n")
+	b.WriteString("srcversion: FC3433D849E3B88C1E7B55C\n")
+	for _, r := range n.sorted() {
+		s := r.state()
+		fmt.Fprintf(&b, "%2d: cs:%s ro:%s/%s ds:%s/%s C r-----\n",
+			r.minor, s.Connection, s.SelfRole, s.RemoteRole, s.SelfDisk, s.RemoteDisk)
+		b.WriteString("    ns:0 nr:0 dw:0 dr:0 al:0 bm:0 lo:0 pe:0 ua:0 ap:0 ep:1 wo:f oos:0\n")
+		if r.connection == "SyncSource" || r.connection == "SyncTarget" {
+			done := int(r.synced / 5)
+			if done > 19 {
+				done = 19
+			}
+			fmt.Fprintf(&b, "\t[%s>%s] sync'ed: %.1f%% (0/0)M\n",
+				strings.Repeat("=", done), strings.Repeat(".", 19-done), r.synced)
+			b.WriteString("\tfinish: 0:00:00 speed: 0 (0) K/sec\n")
+		}
+	}
+	return b.String()
+}
+
+// drbd9 returns the DRBD 9 connection and replication states
+func (r *resource) drbd9() (connection string, replication string) {
+	switch r.connection {
+	case "StandAlone":
+		return "StandAlone", "Off"
+	case "WFConnection":
+		return "Connecting", "Off"
+	case "Connected":
+		return "Connected", "Established"
+	}
+	return "Connected", r.connection
+}
+
+// events2 is the DRBD 9 view of a resource: one line per object, without
+// the timestamp and verb
+func (r *resource) events2() []string {
+	connection, replication := r.drbd9()
+	s := r.state()
+	return []string{
+		fmt.Sprintf("resource name:%s role:%s suspended:no", r.name, r.role),
+		fmt.Sprintf("connection name:%s peer-node-id:%d conn-name:%s connection:%s role:%s",
+			r.name, PeerNodeID, PeerName, connection, s.RemoteRole),
+		fmt.Sprintf("device name:%s volume:0 minor:%d disk:%s client:no quorum:yes",
+			r.name, r.minor, r.disk),
+		fmt.Sprintf("peer-device name:%s peer-node-id:%d conn-name:%s volume:0 replication:%s peer-disk:%s",
+			r.name, PeerNodeID, PeerName, replication, s.RemoteDisk),
+	}
+}
+
+// record adds events2 lines for what changed.  It is called with n.mu held.
+func (n *Node) record(verb string, r *resource, before resource) {
+	ts := n.now().Format(events2Time)
+	lines := r.events2()
+	switch verb {
+	case "create":
+	case "destroy":
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+	default:
+		old := before.events2()
+		changed := lines[:0]
+		for i, line := range lines {
+			if line != old[i] {
+				changed = append(changed, line)
+			}
+		}
+		lines = changed
+	}
+	for _, line := range lines {
+		n.events = append(n.events, ts+" "+verb+" "+line)
+	}
+}
+
+// Events2 returns what "drbdsetup events2 --timestamps" would have
+// printed since the node was created: create, change, and destroy lines.
+func (n *Node) Events2() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.events...)
+}
+
+// Events2Now returns what "drbdsetup events2 --now --timestamps" prints:
+// the current state as exists lines, ending with "exists -"
+func (n *Node) Events2Now() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ts := n.now().Format(events2Time)
+	var lines []string
+	for _, r := range n.sorted() {
+		for _, line := range r.events2() {
+			lines = append(lines, ts+" exists "+line)
+		}
+	}
+	return append(lines, ts+" exists -")
+}
+
+type statusResource struct {
+	Name        string             `json:"name"`
+	NodeID      int                `json:"node-id"`
+	Role        string             `json:"role"`
+	Suspended   bool               `json:"suspended"`
+	Devices     []statusDevice     `json:"devices"`
+	Connections []statusConnection `json:"connections"`
+}
+
+type statusDevice struct {
+	Volume    int    `json:"volume"`
+	Minor     int    `json:"minor"`
+	DiskState string `json:"disk-state"`
+	Client    bool   `json:"client"`
+	Quorum    bool   `json:"quorum"`
+}
+
+type statusConnection struct {
+	PeerNodeID      int                `json:"peer-node-id"`
+	Name            string             `json:"name"`
+	ConnectionState string             `json:"connection-state"`
+	Congested       bool               `json:"congested"`
+	PeerRole        string             `json:"peer-role"`
+	PeerDevices     []statusPeerDevice `json:"peer_devices"`
+}
+
+type statusPeerDevice struct {
+	Volume           int     `json:"volume"`
+	ReplicationState string  `json:"replication-state"`
+	PeerDiskState    string  `json:"peer-disk-state"`
+	PeerClient       bool    `json:"peer-client"`
+	ResyncSuspended  string  `json:"resync-suspended"`
+	PercentInSync    float64 `json:"percent-in-sync"`
+}
+
+// StatusJSON returns what "drbdsetup status --json" prints.  If names
+// are given, only those resources are included.
+func (n *Node) StatusJSON(names ...string) ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(names) == 0 {
+		names = n.names()
+	}
+	status := make([]statusResource, 0, len(names))
+	for _, name := range names {
+		r, err := n.get(name)
+		if err != nil {
+			return nil, err
+		}
+		s := r.state()
+		connection, replication := r.drbd9()
+		inSync := 100.0
+		if r.connection == "SyncSource" || r.connection == "SyncTarget" {
+			inSync = r.synced
+		}
+		status = append(status, statusResource{
+			Name: r.name,
+			Role: r.role,
+			Devices: []statusDevice{{
+				Minor:     r.minor,
+				DiskState: r.disk,
+				Quorum:    true,
+			}},
+			Connections: []statusConnection{{
+				PeerNodeID:      PeerNodeID,
+				Name:            PeerName,
+				ConnectionState: connection,
+				PeerRole:        s.RemoteRole,
+				PeerDevices: []statusPeerDevice{{
+					ReplicationState: replication,
+					PeerDiskState:    s.RemoteDisk,
+					ResyncSuspended:  "no",
+					PercentInSync:    inSync,
+				}},
+			}},
+		})
+	}
+	return json.MarshalIndent(status, "", "  ")
+}
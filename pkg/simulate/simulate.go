@@ -0,0 +1,317 @@
+// Package simulate runs a command under the real watcher against a
+// scripted sequence of DRBD states and checks what the command was
+// called with.
+package simulate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/pkg/errors"
+)
+
+// Scenario is a sequence of states and the command invocations they
+// should cause.  Scenarios are usually JSON files:
+//
+//	{
+//		"name": "failover",
+//		"fstab": "/dev/drbd0 /r0 ext4 noauto 0 0\n",
+//		"command": [ "./my-command" ],
+//		"steps": [
+//			{ "resources": { "r0": { "connection": "Connected", "self_role": "Secondary",
+//				"remote_role": "Primary", "self_disk": "UpToDate", "remote_disk": "UpToDate" } } },
+//			{ "after": "1s", "resources": { "r0": { "connection": "WFConnection", "self_role": "Secondary",
+//				"remote_role": "Unknown", "self_disk": "UpToDate", "remote_disk": "DUnknown" } } }
+//		],
+//		"expect": [
+//			{ "args": [ "r0", "Connected", "Secondary", "Primary", "UpToDate", "UpToDate", "/r0" ] },
+//			{ "args": [ "r0", "WFConnection", "Secondary", "Unknown", "UpToDate", "DUnknown", "/r0" ],
+//			  "env": { "OLD_CONNECTED_STATE": "Connected" } }
+//		]
+//	}
+type Scenario struct {
+	Name string `json:"name"`
+	// Fstab and Mounts are the contents of /etc/fstab and /proc/mounts
+	Fstab   string   `json:"fstab"`
+	Mounts  string   `json:"mounts"`
+	Command []string `json:"command"`
+	Steps   []Step   `json:"steps"`
+	// Expect lists the expected invocations of Command.  They are in
+	// order for each resource, but resources are handled at the same
+	// time so there is no order between them.
+	Expect []Expectation `json:"expect"`
+
+	Settle      Duration `json:"settle"`
+	MaxParallel int      `json:"max_parallel"`
+	// Timeout is how long to wait for the expected invocations after
+	// the last step.  It defaults to five seconds.
+	Timeout Duration `json:"timeout"`
+}
+
+// Step is the state of every resource at a point in the scenario
+type Step struct {
+	// After is the time since the prior step
+	After     Duration              `json:"after"`
+	Resources map[string]drbd.State `json:"resources"`
+}
+
+// Expectation is what a command invocation should look like
+type Expectation struct {
+	// Resource is the resource that the invocation is for, like "r0".
+	// It defaults to the first of Args or, if the scenario only has
+	// one resource, to that one.
+	Resource string `json:"resource"`
+	// Args are the arguments added by the watcher (not the ones in
+	// Scenario.Command).  If nil, they aren't checked.
+	Args []string `json:"args"`
+	// Env are environment variables that must have these values
+	Env map[string]string `json:"env"`
+}
+
+// Invocation is an observed command invocation
+type Invocation struct {
+	Resource string
+	Args     []string
+	Env      map[string]string
+	Err      error
+}
+
+// Result is what happened when a scenario was run
+type Result struct {
+	Invocations []Invocation
+	Failures    []string
+}
+
+// Passed is true if all expectations were met
+func (r Result) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Duration is a time.Duration written like "1.5s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses durations like "1.5s"
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	p, err := time.ParseDuration(s)
+	*d = Duration(p)
+	return err
+}
+
+// Load reads a JSON scenario file
+func Load(filename string) (*Scenario, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", filename)
+	}
+	var s Scenario
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s", filename)
+	}
+	if s.Name == "" {
+		s.Name = filename
+	}
+	return &s, nil
+}
+
+const nap = 10 * time.Millisecond
+
+// Run runs the scenario using the real watcher
+func (s *Scenario) Run() (*Result, error) {
+	if len(s.Command) == 0 {
+		return nil, errors.Errorf("scenario %s has no command", s.Name)
+	}
+	resources, err := s.expectedResources()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "drbd-simulate")
+	if err != nil {
+		return nil, errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	o := drbd.Options{
+		ProcDRBD:    dir + "/proc-drbd",
+		ProcMounts:  dir + "/proc-mounts",
+		Fstab:       dir + "/fstab",
+		Nap:         nap,
+		Settle:      time.Duration(s.Settle),
+		MaxParallel: s.MaxParallel,
+		Startup:     drbd.StartupInitial,
+		Control:     drbd.NewControl(),
+	}
+	for filename, contents := range map[string]string{o.Fstab: s.Fstab, o.ProcMounts: s.Mounts} {
+		err := ioutil.WriteFile(filename, []byte(contents), 0644)
+		if err != nil {
+			return nil, errors.Wrapf(err, "write %s", filename)
+		}
+	}
+
+	var mu sync.Mutex
+	result := &Result{}
+	o.CommandDone = func(delta drbd.Delta, cmd *exec.Cmd, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.Invocations = append(result.Invocations, Invocation{
+			Resource: delta.Name,
+			Args:     cmd.Args[len(s.Command):],
+			Env:      envMap(cmd.Env),
+			Err:      err,
+		})
+	}
+	invoked := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(result.Invocations)
+	}
+
+	snapshots := make([]drbd.Snapshot, 0, len(s.Steps))
+	var at time.Time
+	for i, step := range s.Steps {
+		at = at.Add(time.Duration(step.After))
+		states := make(drbd.States)
+		for name, state := range step.Resources {
+			r, err := drbd.ParseResource(name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "step %d", i+1)
+			}
+			states[r] = state
+		}
+		snapshots = append(snapshots, drbd.Snapshot{
+			Time:     at,
+			ProcDRBD: drbd.RenderProcDRBD(states),
+		})
+	}
+
+	watcher := make(chan error, 1)
+	go func() {
+		watcher <- o.RunCommandOnChange(false, s.Command)
+	}()
+	err = drbd.Replayer{Snapshots: snapshots, Speed: 1}.Run(o)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(s.Timeout)
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for invoked() < len(s.Expect) && time.Now().Before(deadline) {
+		time.Sleep(nap)
+	}
+	// catch unexpected extra invocations
+	time.Sleep(10*nap + o.Settle)
+
+	o.Control.Stop()
+	err = <-watcher
+	if err != drbd.ErrStopped {
+		return nil, errors.Wrap(err, "watcher")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	result.check(s.Expect, resources)
+	return result, nil
+}
+
+// expectedResources is the resource of each expectation
+func (s *Scenario) expectedResources() ([]string, error) {
+	all := make(map[string]bool)
+	var only string
+	for _, step := range s.Steps {
+		for name := range step.Resources {
+			all[name] = true
+			only = name
+		}
+	}
+	resources := make([]string, len(s.Expect))
+	for i, e := range s.Expect {
+		switch {
+		case e.Resource != "":
+			resources[i] = e.Resource
+		case len(e.Args) > 0:
+			resources[i] = e.Args[0]
+		case len(all) == 1:
+			resources[i] = only
+		default:
+			return nil, errors.Errorf("scenario %s: expectation %d needs a resource or args, because there is no order between resources", s.Name, i+1)
+		}
+	}
+	return resources, nil
+}
+
+// check compares the invocations of each resource, in order, with
+// the expectations for it
+func (r *Result) check(expect []Expectation, resources []string) {
+	expected := make(map[string][]Expectation)
+	for i, e := range expect {
+		expected[resources[i]] = append(expected[resources[i]], e)
+	}
+	invoked := make(map[string][]Invocation)
+	for _, inv := range r.Invocations {
+		invoked[inv.Resource] = append(invoked[inv.Resource], inv)
+	}
+	names := make([]string, 0, len(expected)+len(invoked))
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range invoked {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		expect, invocations := expected[name], invoked[name]
+		for i, e := range expect {
+			if i >= len(invocations) {
+				r.Failures = append(r.Failures, fmt.Sprintf("%s invocation %d: expected %v, but there was no invocation", name, i+1, e.Args))
+				continue
+			}
+			got := invocations[i]
+			if e.Args != nil && !reflect.DeepEqual(e.Args, got.Args) {
+				r.Failures = append(r.Failures, fmt.Sprintf("%s invocation %d: args %v, expected %v", name, i+1, got.Args, e.Args))
+			}
+			keys := make([]string, 0, len(e.Env))
+			for k := range e.Env {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if v, ok := got.Env[k]; !ok || v != e.Env[k] {
+					r.Failures = append(r.Failures, fmt.Sprintf("%s invocation %d: %s=%q, expected %q", name, i+1, k, v, e.Env[k]))
+				}
+			}
+		}
+		for i := len(expect); i < len(invocations); i++ {
+			r.Failures = append(r.Failures, fmt.Sprintf("%s invocation %d: unexpected %v", name, i+1, invocations[i].Args))
+		}
+	}
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m
+}
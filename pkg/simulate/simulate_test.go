@@ -0,0 +1,72 @@
+package simulate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muir/drbd-watcher/pkg/drbd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenarioFile(t *testing.T) {
+	s, err := Load("testdata/disconnect.json")
+	require.NoError(t, err, "load")
+	assert.Equal(t, 50*time.Millisecond, time.Duration(s.Steps[1].After), "after")
+	result, err := s.Run()
+	require.NoError(t, err, "run")
+	assert.Empty(t, result.Failures, "failures")
+	assert.True(t, result.Passed(), "passed")
+	assert.Len(t, result.Invocations, 2, "invocations")
+}
+
+func TestScenarioFailures(t *testing.T) {
+	connected := drbd.State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}
+	s := &Scenario{
+		Name:    "failures",
+		Command: []string{"false"},
+		Steps: []Step{
+			{Resources: map[string]drbd.State{"r1": connected}},
+		},
+		Expect: []Expectation{
+			{Args: []string{"r1", "Connected", "Primary", "Secondary", "UpToDate", "UpToDate", ""}},
+			{Env: map[string]string{"OLD_SELF_ROLE": "Primary"}},
+		},
+		Timeout: Duration(100 * time.Millisecond),
+	}
+	result, err := s.Run()
+	require.NoError(t, err, "run")
+	assert.False(t, result.Passed(), "passed")
+	assert.Len(t, result.Failures, 2, "failures: %v", result.Failures)
+	if assert.Len(t, result.Invocations, 1, "invocations") {
+		assert.Error(t, result.Invocations[0].Err, "false fails")
+	}
+}
+
+// TestScenarioResources expects the invocations of each resource in
+// order, but not an order between resources
+func TestScenarioResources(t *testing.T) {
+	connected := drbd.State{Connection: "Connected", SelfRole: "Secondary", RemoteRole: "Primary", SelfDisk: "UpToDate", RemoteDisk: "UpToDate"}
+	disconnected := drbd.State{Connection: "WFConnection", SelfRole: "Secondary", RemoteRole: "Unknown", SelfDisk: "UpToDate", RemoteDisk: "DUnknown"}
+	s := &Scenario{
+		Name:    "resources",
+		Command: []string{"true"},
+		Steps: []Step{
+			{Resources: map[string]drbd.State{"r0": connected, "r1": connected}},
+			{After: Duration(50 * time.Millisecond), Resources: map[string]drbd.State{"r0": disconnected, "r1": disconnected}},
+		},
+		Expect: []Expectation{
+			{Resource: "r1", Env: map[string]string{"OLD_CONNECTED_STATE": ""}},
+			{Resource: "r1", Env: map[string]string{"OLD_CONNECTED_STATE": "Connected"}},
+			{Args: []string{"r0", "Connected", "Secondary", "Primary", "UpToDate", "UpToDate", ""}},
+			{Args: []string{"r0", "WFConnection", "Secondary", "Unknown", "UpToDate", "DUnknown", ""}},
+		},
+	}
+	result, err := s.Run()
+	require.NoError(t, err, "run")
+	assert.Empty(t, result.Failures, "failures")
+
+	s.Expect = append(s.Expect, Expectation{Env: map[string]string{"FLAPPING": "false"}})
+	_, err = s.Run()
+	assert.Error(t, err, "no resource, and no order between resources")
+}
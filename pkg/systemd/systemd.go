@@ -0,0 +1,99 @@
+// Package systemd implements the parts of the systemd service
+// protocols that the watcher uses: readiness and status notification
+// (sd_notify), the watchdog, and socket activation.  Without systemd
+// they do nothing.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notify sends state, for example "READY=1", to the socket named by
+// $NOTIFY_SOCKET.  It returns false, and no error, when the variable
+// isn't set.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' {
+		// abstract namespace
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, errors.Wrap(err, "notify systemd")
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, errors.Wrap(err, "notify systemd")
+	}
+	return true, nil
+}
+
+// WatchdogInterval is how often systemd expects "WATCHDOG=1".  It is
+// zero when the watchdog isn't enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("invalid WATCHDOG_USEC '%s'", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation,
+// in the order of the socket unit's Listen lines.  The LISTEN_*
+// variables are removed so that commands run by the watcher don't
+// see them.
+func Listeners() ([]net.Listener, error) {
+	return listeners(listenFDsStart)
+}
+
+func listeners(start int) ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, errors.Errorf("invalid LISTEN_FDS '%s'", fds)
+	}
+	ls := make([]net.Listener, 0, n)
+	for fd := start; fd < start+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener has its own copy of the descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "socket activation file descriptor %d", fd)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
@@ -0,0 +1,107 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setenv sets an environment variable and returns a function that
+// puts it back
+func setenv(t *testing.T, key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	require.NoError(t, os.Setenv(key, value), "setenv %s", key)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	defer setenv(t, "NOTIFY_SOCKET", "")()
+	sent, err := Notify("READY=1")
+	assert.NoError(t, err, "without systemd")
+	assert.False(t, sent, "without systemd")
+
+	dir, err := ioutil.TempDir("", "systemd")
+	require.NoError(t, err, "temporary directory")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err, "listen")
+	defer conn.Close()
+
+	defer setenv(t, "NOTIFY_SOCKET", name)()
+	sent, err = Notify("READY=1\nSTATUS=2 resources: 2 Connected")
+	require.NoError(t, err, "notify")
+	assert.True(t, sent, "sent")
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	require.NoError(t, err, "read")
+	assert.Equal(t, "READY=1\nSTATUS=2 resources: 2 Connected", string(b[:n]), "received")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer setenv(t, "WATCHDOG_USEC", "")()
+	d, err := WatchdogInterval()
+	assert.NoError(t, err, "disabled")
+	assert.Zero(t, d, "disabled")
+
+	defer setenv(t, "WATCHDOG_USEC", "30000000")()
+	defer setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()))()
+	d, err = WatchdogInterval()
+	assert.NoError(t, err, "enabled")
+	assert.Equal(t, 30*time.Second, d, "enabled")
+
+	defer setenv(t, "WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))()
+	d, err = WatchdogInterval()
+	assert.NoError(t, err, "another process")
+	assert.Zero(t, d, "another process")
+
+	defer setenv(t, "WATCHDOG_PID", "")()
+	defer setenv(t, "WATCHDOG_USEC", "soon")()
+	_, err = WatchdogInterval()
+	assert.Error(t, err, "invalid")
+}
+
+func TestListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "listen")
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err, "file")
+	// listeners takes over the descriptor
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err, "dup")
+	f.Close()
+	l.Close()
+
+	defer setenv(t, "LISTEN_PID", strconv.Itoa(os.Getpid()))()
+	defer setenv(t, "LISTEN_FDS", "1")()
+	ls, err := listeners(fd)
+	require.NoError(t, err, "listeners")
+	require.Len(t, ls, 1, "listeners")
+	defer ls[0].Close()
+	assert.Equal(t, "", os.Getenv("LISTEN_FDS"), "removed from the environment")
+
+	conn, err := net.Dial("tcp", ls[0].Addr().String())
+	require.NoError(t, err, "dial")
+	conn.Close()
+
+	defer setenv(t, "LISTEN_PID", strconv.Itoa(os.Getpid()+1))()
+	defer setenv(t, "LISTEN_FDS", "1")()
+	ls, err = listeners(fd)
+	assert.NoError(t, err, "another process")
+	assert.Empty(t, ls, "another process")
+}